@@ -27,6 +27,10 @@ type Environment struct {
 	ConfigPath           string `env:"CONFIG_PATH,default=./config/config.yaml"`
 	ConfigReloadDuration uint   `env:"CONFIG_RELOAD_DURATION_SECONDS,default=15"`
 	LogLevel             string `env:"LOG_LEVEL,default=INFO"`
+	StrictConfig         bool   `env:"STRICT_CONFIG,default=true"`
+	DryRun               bool   `env:"DRY_RUN,default=false"`
+	StatePath            string `env:"STATE_PATH,default=/var/lib/ipruler/state.json"`
+	WatchNetlink         bool   `env:"WATCH_NETLINK,default=true"`
 }
 
 func (e *Environment) String() string {
@@ -38,7 +42,11 @@ Environments:
 	ConfigPath: %s
 	ConfigReloadDuration: %d
 	LogLevel: %s
-`, e.Mode, e.EnablePersistence, e.APIPort, e.ConfigPath, e.ConfigReloadDuration, e.LogLevel)
+	StrictConfig: %t
+	DryRun: %t
+	StatePath: %s
+	WatchNetlink: %t
+`, e.Mode, e.EnablePersistence, e.APIPort, e.ConfigPath, e.ConfigReloadDuration, e.LogLevel, e.StrictConfig, e.DryRun, e.StatePath, e.WatchNetlink)
 }
 
 func main() {
@@ -46,9 +54,9 @@ func main() {
 
 	switch envirnment.Mode {
 	case "api":
-		api.SetupHttpApiMode(envirnment.ConfigReloadDuration, envirnment.APIPort, envirnment.APIBindAddress)
+		api.SetupHttpApiMode(envirnment.ConfigReloadDuration, envirnment.APIPort, envirnment.APIBindAddress, envirnment.StrictConfig, envirnment.DryRun, envirnment.StatePath, envirnment.WatchNetlink)
 	case "ConfigBased":
-		api.SetupConfigfileBasedMode(envirnment.ConfigPath, envirnment.EnablePersistence, envirnment.ConfigReloadDuration)
+		api.SetupConfigfileBasedMode(envirnment.ConfigPath, envirnment.EnablePersistence, envirnment.ConfigReloadDuration, envirnment.StrictConfig, envirnment.DryRun, envirnment.StatePath, envirnment.WatchNetlink)
 	default:
 		log.Fatalf("mode %s is not defined", envirnment.Mode)
 	}
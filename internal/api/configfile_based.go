@@ -4,32 +4,74 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/plutocholia/ipruler/internal/ipruler"
 )
 
-func SetupConfigfileBasedMode(configPath string, enablePersistence bool, configReloadDuration uint) {
+func SetupConfigfileBasedMode(configPath string, enablePersistence bool, configReloadDuration uint, strictConfig bool, dryRun bool, statePath string, watch bool) {
 	var oldData []byte
+	// the last config that is synced without errors, which is synced while the config file is broken
+	var goodData []byte
 
 	configLifeCycle := ipruler.CreateConfigLifeCycle()
+	configLifeCycle.StrictDecoding = strictConfig
+	configLifeCycle.DryRun = dryRun
+
+	// resume from the config applied before the agent is restarted, which is also the last good config
+	state, err := loadState(statePath, dryRun)
+	if err != nil {
+		log.Printf("Error in loading the state, starting without a config: %s", err)
+	}
+	goodData = state.restore(configLifeCycle)
+
+	// the watcher reconciles the changes on the node between the syncs
+	var lock sync.Mutex
+	if watch && !dryRun {
+		go configLifeCycle.KeepWatching(func(f func()) {
+			lock.Lock()
+			defer lock.Unlock()
+			f()
+		}, nil)
+	}
 
 	for {
+		lock.Lock()
 		data, err := os.ReadFile(configPath)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			log.Printf("Error in reading config file: %v", err)
+			data = oldData
 		}
 
+		synced := false
 		if !reflect.DeepEqual(data, oldData) {
 			log.Println("detected changes in config")
 			oldData = data
+			if err := configLifeCycle.WaveSync(data); err != nil {
+				log.Printf("Error in syncing the config, keeping the last good config: %s", err)
+			} else {
+				goodData = data
+				synced = true
+				state.trySave(data, nil)
+			}
+		}
+		if !synced && goodData != nil {
+			if err := configLifeCycle.WaveSync(goodData); err != nil {
+				log.Printf("Error in syncing the config: %s", err)
+			} else {
+				synced = true
+			}
 		}
 
-		configLifeCycle.WaveSync(data)
-		if enablePersistence {
-			configLifeCycle.PersistState()
+		// nothing is synced to be persisted in dry-run mode
+		if synced && enablePersistence && !dryRun {
+			if err := configLifeCycle.PersistState(); err != nil {
+				log.Printf("Error in persisting the config: %s", err)
+			}
 		}
 
+		lock.Unlock()
 		time.Sleep(time.Duration(configReloadDuration) * time.Second)
 	}
 }
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A config which is applied with a confirm-timeout, like `commit confirmed` of Junos
+type pendingConfirm struct {
+	// the last confirmed config, which is restored when the deadline passes (nil when there was none)
+	confirmedData []byte
+	deadline      time.Time
+	timer         *time.Timer
+}
+
+func (a *HttpApi) waitForConfirm(confirmedData []byte, timeout time.Duration) *pendingConfirm {
+	pending := &pendingConfirm{confirmedData: confirmedData, deadline: time.Now().Add(timeout)}
+	pending.timer = time.AfterFunc(timeout, func() { a.do(func() { a.revert(pending) }) })
+	log.Printf("The config is reverted unless it's confirmed before %s", pending.deadline.Format(time.RFC3339))
+	return pending
+}
+
+func (a *HttpApi) confirm(c *gin.Context) {
+	confirmed := false
+	a.do(func() {
+		if a.pending == nil {
+			return
+		}
+		a.pending.timer.Stop()
+		a.pending = nil
+		a.state.trySave(a.data, nil)
+		confirmed = true
+	})
+	if !confirmed {
+		c.JSON(http.StatusConflict, gin.H{"status": "failed", "message": "there is no config waiting for confirmation"})
+		return
+	}
+	log.Println("The config is confirmed")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Goes back to the last confirmed config, the config from before the first update which is not confirmed.
+func (a *HttpApi) revert(pending *pendingConfirm) {
+	// confirmed or replaced while the revert was queued
+	if a.pending != pending {
+		return
+	}
+	a.pending = nil
+
+	log.Println("The config is not confirmed before the deadline, reverting to the last confirmed config")
+	var err error
+	if pending.confirmedData == nil {
+		err = a.configLifeCycle.Remove()
+	} else {
+		err = a.configLifeCycle.WaveSync(pending.confirmedData)
+	}
+	if err != nil {
+		log.Printf("Error in reverting the config: %s", err)
+	}
+	// the confirmed config is re-applied periodically, even if reverting has failed
+	a.data = pending.confirmedData
+	a.state.trySave(a.data, nil)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// a config routing the destination through the link d0 of the fake node
+func routeConfig(destination string) string {
+	return fmt.Sprintf("routes:\n- to: %s\n  via: 172.31.201.1\n  table: 100\n", destination)
+}
+
+// waits until the routes of the table are the wanted ones
+func waitForRoutes(t *testing.T, table int, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		routes := routeDestinations(t, table)
+		if slices.Equal(routes, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routes of table %d: got %v, want %v", table, routes, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// the pending confirm of the api, and the config it re-applies
+func pendingState(api *HttpApi) (pending *pendingConfirm, data string) {
+	api.do(func() { pending, data = api.pending, string(api.data) })
+	return pending, data
+}
+
+// a confirmed config is kept after the deadline, and is no more pending
+func TestConfirm(t *testing.T) {
+	setupFakeNode(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	api, app := newTestApi(t, statePath, false)
+
+	if status, response := post(t, app, "/confirm", ""); status != http.StatusConflict {
+		t.Errorf("POST /confirm without a pending config: got %d %v", status, response)
+	}
+	status, response := post(t, app, "/update?confirm-timeout=200ms", testConfig)
+	if _, exists := response["confirm-deadline"]; status != http.StatusOK || !exists {
+		t.Fatalf("POST /update with a confirm-timeout: got %d %v", status, response)
+	}
+	if status, response := post(t, app, "/confirm", ""); status != http.StatusOK {
+		t.Fatalf("POST /confirm: got %d %v", status, response)
+	}
+	if pending, _ := pendingState(api); pending != nil {
+		t.Errorf("the confirmed config is still pending")
+	}
+	if store, err := loadState(statePath, false); err != nil || store.state.ConfirmDeadline != nil {
+		t.Errorf("state after confirm: %+v, %v", store.state, err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	waitForRoutes(t, 100, "10.20.0.0/16")
+	if status, response := post(t, app, "/confirm", ""); status != http.StatusConflict {
+		t.Errorf("POST /confirm of a confirmed config: got %d %v", status, response)
+	}
+}
+
+// a config which is not confirmed before the deadline is reverted to the last confirmed config
+func TestConfirm_Expiry(t *testing.T) {
+	setupFakeNode(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	api, app := newTestApi(t, statePath, false)
+
+	confirmed := routeConfig("10.20.0.0/16")
+	if status, response := post(t, app, "/update", confirmed); status != http.StatusOK {
+		t.Fatalf("POST /update: got %d %v", status, response)
+	}
+	if status, response := post(t, app, "/update?confirm-timeout=500ms", routeConfig("10.30.0.0/16")); status != http.StatusOK {
+		t.Fatalf("POST /update with a confirm-timeout: got %d %v", status, response)
+	}
+	waitForRoutes(t, 100, "10.30.0.0/16")
+	// the deadline passes
+	waitForRoutes(t, 100, "10.20.0.0/16")
+	if pending, data := pendingState(api); pending != nil || data != confirmed {
+		t.Errorf("after the deadline: pending %v, config %q, want the confirmed config", pending, data)
+	}
+	if store, err := loadState(statePath, false); err != nil || store.state.Config != confirmed || store.state.ConfirmDeadline != nil {
+		t.Errorf("state after the deadline: %+v, %v", store.state, err)
+	}
+}
+
+// An update with a confirm-timeout while a config is pending replaces it and restarts the timer, and it's still
+// reverted to the last confirmed config. An update without a confirm-timeout confirms it.
+func TestConfirm_SecondUpdate(t *testing.T) {
+	setupFakeNode(t)
+	api, app := newTestApi(t, "", false)
+
+	confirmed := routeConfig("10.20.0.0/16")
+	post(t, app, "/update", confirmed)
+	post(t, app, "/update?confirm-timeout=1h", routeConfig("10.30.0.0/16"))
+	if status, response := post(t, app, "/update?confirm-timeout=500ms", routeConfig("10.40.0.0/16")); status != http.StatusOK {
+		t.Fatalf("POST /update while a config is pending: got %d %v", status, response)
+	}
+	waitForRoutes(t, 100, "10.40.0.0/16")
+	waitForRoutes(t, 100, "10.20.0.0/16")
+	if pending, data := pendingState(api); pending != nil || data != confirmed {
+		t.Errorf("after the deadline: pending %v, config %q, want the confirmed config", pending, data)
+	}
+
+	post(t, app, "/update?confirm-timeout=100ms", routeConfig("10.30.0.0/16"))
+	update := routeConfig("10.40.0.0/16")
+	if status, response := post(t, app, "/update", update); status != http.StatusOK {
+		t.Fatalf("POST /update without a confirm-timeout: got %d %v", status, response)
+	}
+	time.Sleep(300 * time.Millisecond)
+	waitForRoutes(t, 100, "10.40.0.0/16")
+	if pending, data := pendingState(api); pending != nil || data != update {
+		t.Errorf("after an update without a confirm-timeout: pending %v, config %q", pending, data)
+	}
+}
+
+// nothing is applied in dry-run mode, so there is no deadline to revert the config
+func TestConfirm_DryRun(t *testing.T) {
+	setupFakeNode(t)
+	api, app := newTestApi(t, "", true)
+
+	status, response := post(t, app, "/update?confirm-timeout=1h", testConfig)
+	if _, exists := response["confirm-deadline"]; status != http.StatusOK || exists {
+		t.Errorf("POST /update with a confirm-timeout in dry-run mode: got %d %v", status, response)
+	}
+	if pending, _ := pendingState(api); pending != nil {
+		t.Errorf("a confirm deadline is armed in dry-run mode")
+	}
+	if status, response := post(t, app, "/confirm", ""); status != http.StatusConflict {
+		t.Errorf("POST /confirm in dry-run mode: got %d %v", status, response)
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/plutocholia/ipruler/internal/config"
+	"github.com/plutocholia/ipruler/internal/ipruler"
+)
+
+// Returns 400 for a config that can't be parsed, 422 for a config with invalid items and 500 for kernel errors.
+func errorStatus(err error) int {
+	var emptyConfig *ipruler.EmptyConfig
+	var parseErr *config.ParseError
+	var fieldErr *config.FieldError
+	if errors.As(err, &emptyConfig) || errors.As(err, &parseErr) {
+		return http.StatusBadRequest
+	}
+	for _, e := range config.FlattenErrors(err) {
+		if errors.As(e, &fieldErr) {
+			return http.StatusUnprocessableEntity
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Describes every single error, with the item and field of config errors and the errno of kernel errors.
+func errorDetails(err error) []gin.H {
+	details := []gin.H{}
+	for _, e := range config.FlattenErrors(err) {
+		var fieldErr *config.FieldError
+		var syncErr *ipruler.SyncError
+		if errors.As(e, &fieldErr) {
+			detail := gin.H{"path": fieldErr.Path(), "message": fieldErr.Err.Error()}
+			if fieldErr.Line > 0 {
+				detail["line"], detail["column"] = fieldErr.Line, fieldErr.Column
+			}
+			details = append(details, detail)
+		} else if errors.As(e, &syncErr) {
+			detail := gin.H{"reason": syncErr.Reason, "op": syncErr.Op, "object": syncErr.Object, "item": syncErr.Item, "message": syncErr.Err.Error()}
+			if errno, ok := syncErr.Errno(); ok {
+				detail["errno"] = int(errno)
+			}
+			details = append(details, detail)
+		} else {
+			details = append(details, gin.H{"message": e.Error()})
+		}
+	}
+	return details
+}
+
+func respondError(c *gin.Context, err error) {
+	c.JSON(errorStatus(err), gin.H{"status": "failed", "message": err.Error(), "errors": errorDetails(err)})
+}
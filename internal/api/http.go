@@ -5,8 +5,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"reflect"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,14 +14,20 @@ import (
 
 type HttpApi struct {
 	configLifeCycle *ipruler.ConfigLifeCycle
-	lock            sync.Mutex
-	data            []byte
+	// the work of the reconciler goroutine, which is the only one using configLifeCycle and the fields below
+	queue chan func()
+	data  []byte
+	// the config applied with a confirm-timeout, which is not confirmed yet
+	pending *pendingConfirm
+	state   *stateStore
 }
 
 func (a *HttpApi) setupRoutes(app *gin.Engine) {
 	app.GET("/health", a.health)
 	app.POST("/update", a.update)
 	app.POST("/cleanup", a.cleanUp)
+	app.POST("/plan", a.plan)
+	app.POST("/confirm", a.confirm)
 }
 
 func (a *HttpApi) health(c *gin.Context) {
@@ -33,65 +37,134 @@ func (a *HttpApi) health(c *gin.Context) {
 }
 
 func (a *HttpApi) update(c *gin.Context) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read request body"})
 		return
 	}
 
-	err = a.configLifeCycle.WaveSync(body)
-	if _err, ok := err.(*ipruler.EmptyConfig); ok {
-		log.Println(_err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "message": _err.Error()})
+	// with a confirm-timeout, the config is reverted unless it's confirmed before the deadline
+	var confirmTimeout time.Duration
+	if value := c.Query("confirm-timeout"); value != "" {
+		if confirmTimeout, err = time.ParseDuration(value); err != nil || confirmTimeout <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "message": fmt.Sprintf("invalid confirm-timeout %s, it must be a positive duration like 120s", value)})
+			return
+		}
+	}
+
+	var pending *pendingConfirm
+	a.do(func() { pending, err = a.applyUpdate(body, confirmTimeout) })
+	if err != nil {
+		log.Printf("Error in syncing the config: %s", err)
+		respondError(c, err)
 		return
 	}
-	// configLifeCycle.PersistState()
-	a.data = body
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	if pending == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "confirm-deadline": pending.deadline})
 }
 
-func (a *HttpApi) cleanUp(c *gin.Context) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+// Applies the config of an update, and returns its pending confirm when it's applied with a confirm-timeout
+func (a *HttpApi) applyUpdate(body []byte, confirmTimeout time.Duration) (*pendingConfirm, error) {
+	// the periodic re-apply keeps the last good config (a.data) when the new one fails
+	if err := a.configLifeCycle.WaveSync(body); err != nil {
+		return nil, err
+	}
+	// nothing is applied in dry-run mode, so there is nothing to revert
+	if confirmTimeout != 0 && a.configLifeCycle.DryRun {
+		log.Println("The confirm-timeout is ignored in dry-run mode")
+		confirmTimeout = 0
+	}
 
-	a.data = nil
+	// an update confirms the pending config, unless it has to be confirmed itself, in which case it's reverted
+	// to the last confirmed config as well
+	confirmedData := a.data
+	if a.pending != nil {
+		if confirmTimeout != 0 {
+			confirmedData = a.pending.confirmedData
+		}
+		a.pending.timer.Stop()
+		a.pending = nil
+	}
+	a.data = body
 
-	err := a.configLifeCycle.Remove()
-	if _err, ok := err.(*ipruler.EmptyConfig); ok {
-		log.Println(_err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "message": _err.Error()})
+	if confirmTimeout != 0 {
+		a.pending = a.waitForConfirm(confirmedData, confirmTimeout)
+	}
+	a.state.trySave(a.data, a.pending)
+	return a.pending, nil
+}
+
+func (a *HttpApi) cleanUp(c *gin.Context) {
+	var err error
+	a.do(func() {
+		// the periodic re-apply stops along with the config
+		a.data = nil
+		if a.pending != nil {
+			a.pending.timer.Stop()
+			a.pending = nil
+		}
+		a.state.trySave(nil, nil)
+		err = a.configLifeCycle.Remove()
+	})
+	if err != nil {
+		log.Printf("Error in cleaning up the config: %s", err)
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
-func (a *HttpApi) backgroundSync(configReloadDuration uint) {
-	var oldData []byte
-
-	clc := ipruler.CreateConfigLifeCycle()
+// Returns the changes the config would make to the node, without applying them
+func (a *HttpApi) plan(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read request body"})
+		return
+	}
 
-	for {
-		a.lock.Lock()
-		if !reflect.DeepEqual(a.data, oldData) {
-			log.Println("detected changes in config")
-			oldData = a.data
-		}
-		clc.WaveSync(a.data)
-		a.lock.Unlock()
-		time.Sleep(time.Duration(configReloadDuration) * time.Second)
+	var plan *ipruler.Plan
+	a.do(func() { plan, err = a.configLifeCycle.Plan(body) })
+	if err != nil {
+		respondError(c, err)
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "changes": plan.Changes})
 }
 
-func SetupHttpApiMode(configReloadDuration uint, port string, bind_address string) {
+func SetupHttpApiMode(configReloadDuration uint, port string, bind_address string, strictConfig bool, dryRun bool, statePath string, watch bool) {
 	api := HttpApi{
 		configLifeCycle: ipruler.CreateConfigLifeCycle(),
+		queue:           make(chan func()),
 	}
+	api.configLifeCycle.StrictDecoding = strictConfig
+	api.configLifeCycle.DryRun = dryRun
+	api.restoreState(statePath, dryRun)
 	app := gin.Default()
 	api.setupRoutes(app)
-	go api.backgroundSync(configReloadDuration)
+	go api.reconcile()
+	go api.resyncPeriodically(configReloadDuration)
+	if watch && !dryRun {
+		go api.configLifeCycle.KeepWatching(api.do, nil)
+	}
 	app.Run(fmt.Sprintf("%s:%s", bind_address, port))
 }
+
+// Resumes from the config the agent has applied before it's restarted, along with its pending confirm
+func (a *HttpApi) restoreState(statePath string, dryRun bool) {
+	var err error
+	if a.state, err = loadState(statePath, dryRun); err != nil {
+		log.Printf("Error in loading the state, starting without a config: %s", err)
+	}
+	a.data = a.state.restore(a.configLifeCycle)
+	if deadline := a.state.state.ConfirmDeadline; deadline != nil && !dryRun {
+		var confirmedData []byte
+		if a.state.state.ConfirmedConfig != "" {
+			confirmedData = []byte(a.state.state.ConfirmedConfig)
+		}
+		a.pending = a.waitForConfirm(confirmedData, time.Until(*deadline))
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/plutocholia/ipruler/internal/ipruler"
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// A config routing 10.20.0.0/16 through the link d0 of the fake node
+const testConfig = `
+routes:
+- to: 10.20.0.0/16
+  via: 172.31.201.1
+  table: 100
+`
+
+// Replaces the node with a fake one, which has the link d0 (172.31.201.2/24), and an empty iproute2
+// configuration directory.
+func setupFakeNode(t *testing.T) *utils.FakeNetlink {
+	fake := utils.NewFakeNetlink()
+	d0 := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "d0", Flags: net.FlagUp}}
+	addr, _ := netlink.ParseAddr("172.31.201.2/24")
+	if err := fake.LinkAdd(d0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddrAdd(d0, addr); err != nil {
+		t.Fatal(err)
+	}
+	node, configPath := utils.Netlink, utils.IPROUTE2_CONFIG_PATH
+	utils.Netlink, utils.IPROUTE2_CONFIG_PATH = fake, t.TempDir()
+	t.Cleanup(func() {
+		utils.Netlink, utils.IPROUTE2_CONFIG_PATH = node, configPath
+	})
+	return fake
+}
+
+// An api on the fake node with its reconciler running, which keeps its state in statePath (nothing when it's
+// empty). The confirm deadlines are stopped when the test ends.
+func newTestApi(t *testing.T, statePath string, dryRun bool) (*HttpApi, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	api := &HttpApi{configLifeCycle: ipruler.CreateConfigLifeCycle(), queue: make(chan func())}
+	api.configLifeCycle.DryRun = dryRun
+	api.restoreState(statePath, dryRun)
+	go api.reconcile()
+	t.Cleanup(func() {
+		api.do(func() {
+			if api.pending != nil {
+				api.pending.timer.Stop()
+				api.pending = nil
+			}
+		})
+	})
+	app := gin.New()
+	api.setupRoutes(app)
+	return api, app
+}
+
+// posts the body to the endpoint, and returns the status and the decoded response
+func post(t *testing.T, app *gin.Engine, url string, body string) (int, map[string]any) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, url, bytes.NewBufferString(body)))
+	response := map[string]any{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("POST %s: invalid response %q", url, recorder.Body.String())
+	}
+	return recorder.Code, response
+}
+
+// the destinations of the routes of the table
+func routeDestinations(t *testing.T, table int) []string {
+	t.Helper()
+	routes, err := utils.Netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinations := []string{}
+	for _, route := range routes {
+		destinations = append(destinations, route.Dst.String())
+	}
+	return destinations
+}
+
+// the plan endpoint and dry-run mode report the changes of a config, and leave the node unchanged
+func TestPlanAndDryRun(t *testing.T) {
+	setupFakeNode(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	_, app := newTestApi(t, statePath, true)
+
+	status, response := post(t, app, "/plan", testConfig)
+	if changes, _ := response["changes"].([]any); status != http.StatusOK || len(changes) != 1 {
+		t.Fatalf("POST /plan: got %d %v, want the route to add", status, response)
+	}
+
+	if status, response := post(t, app, "/update", testConfig); status != http.StatusOK {
+		t.Fatalf("POST /update in dry-run mode: got %d %v", status, response)
+	}
+	if routes := routeDestinations(t, 100); len(routes) != 0 {
+		t.Errorf("routes of table 100 in dry-run mode: %v", routes)
+	}
+	if status, response := post(t, app, "/plan", testConfig); status != http.StatusOK || len(response["changes"].([]any)) != 1 {
+		t.Errorf("POST /plan after a dry-run update: got %d %v, want the route to add", status, response)
+	}
+	if _, err := os.Stat(statePath); err == nil {
+		t.Errorf("the state is saved in dry-run mode")
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"github.com/plutocholia/ipruler/internal/ipruler"
+)
+
+// The reconciler is the only goroutine which syncs the node in api mode. The HTTP handlers, the periodic
+// re-apply, the confirm deadlines and the netlink watcher queue their work, so it's done one by one by a single
+// ConfigLifeCycle, which keeps the history of every config applied to the node.
+func (a *HttpApi) reconcile() {
+	for work := range a.queue {
+		work()
+	}
+}
+
+// Queues f to the reconciler and waits until it's done. configLifeCycle, data, pending and state are only used
+// inside f.
+func (a *HttpApi) do(f func()) {
+	done := make(chan struct{})
+	a.queue <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+// Re-applies the last given config at each interval, to keep the node in sync with it
+func (a *HttpApi) resyncPeriodically(configReloadDuration uint) {
+	for {
+		a.do(a.resync)
+		time.Sleep(time.Duration(configReloadDuration) * time.Second)
+	}
+}
+
+func (a *HttpApi) resync() {
+	// nothing is given yet, or it's cleaned up
+	if a.data == nil {
+		return
+	}
+	if err := a.configLifeCycle.WaveSync(a.data); err != nil {
+		if _, ok := err.(*ipruler.EmptyConfig); !ok {
+			log.Printf("Error in syncing the config: %s", err)
+		}
+	}
+}
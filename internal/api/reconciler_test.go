@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// A node which reports the syncs that use it at the same time, and keeps the routes added to it in order
+type serialNetlink struct {
+	utils.NetlinkHandle
+	active   atomic.Int32
+	overlaps atomic.Int32
+	mu       sync.Mutex
+	added    []string
+}
+
+// marks the node as used until the returned function is called, the short sleep lets another sync overlap it
+func (s *serialNetlink) use() func() {
+	if s.active.Add(1) > 1 {
+		s.overlaps.Add(1)
+	}
+	time.Sleep(time.Millisecond)
+	return func() { s.active.Add(-1) }
+}
+
+func (s *serialNetlink) RouteAdd(route *netlink.Route) error {
+	defer s.use()()
+	s.mu.Lock()
+	s.added = append(s.added, route.Dst.String())
+	s.mu.Unlock()
+	return s.NetlinkHandle.RouteAdd(route)
+}
+
+func (s *serialNetlink) RouteDel(route *netlink.Route) error {
+	defer s.use()()
+	return s.NetlinkHandle.RouteDel(route)
+}
+
+func (s *serialNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	defer s.use()()
+	return s.NetlinkHandle.RouteListFiltered(family, filter, filterMask)
+}
+
+// Concurrent updates and watcher events are done one by one. Every update is applied, and the config the agent
+// keeps re-applying is the one of the update applied last, which is the one on the node.
+func TestReconciler(t *testing.T) {
+	fake := setupFakeNode(t)
+	node := &serialNetlink{NetlinkHandle: fake}
+	utils.Netlink = node
+	api, app := newTestApi(t, "", false)
+
+	var wg sync.WaitGroup
+	destinations := []string{}
+	for i := range 10 {
+		destination := fmt.Sprintf("10.%d.0.0/16", 100+i)
+		destinations = append(destinations, destination)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, response := post(t, app, "/update", routeConfig(destination)); status != http.StatusOK {
+				t.Errorf("POST /update of %s: got %d %v", destination, status, response)
+			}
+		}()
+	}
+	// the watcher reconciles the routes in between
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			api.do(func() {
+				if err := api.configLifeCycle.Reconcile(map[string]bool{"routes": true}); err != nil {
+					t.Errorf("Reconcile: %s", err)
+				}
+			})
+		}
+	}()
+	wg.Wait()
+
+	if overlaps := node.overlaps.Load(); overlaps != 0 {
+		t.Errorf("the node is used by %d syncs at the same time", overlaps)
+	}
+	node.mu.Lock()
+	added := slices.Clone(node.added)
+	node.mu.Unlock()
+	sorted := slices.Clone(added)
+	slices.Sort(sorted)
+	if !slices.Equal(sorted, destinations) {
+		t.Fatalf("added routes: %v, want each route of the updates once", added)
+	}
+	last := added[len(added)-1]
+	if _, data := pendingState(api); data != routeConfig(last) {
+		t.Errorf("config re-applied after the updates: %q, want the one of %s", data, last)
+	}
+	waitForRoutes(t, 100, last)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/plutocholia/ipruler/internal/ipruler"
+)
+
+// The state of the agent kept in a file on the host, so that the applied config is not forgotten across restarts
+type State struct {
+	// increases every time the applied config changes
+	Version   int       `json:"version"`
+	AppliedAt time.Time `json:"applied-at"`
+	Config    string    `json:"config"`
+	// the config to revert to when Config is not confirmed before the deadline (see pendingConfirm)
+	ConfirmedConfig string     `json:"confirmed-config,omitempty"`
+	ConfirmDeadline *time.Time `json:"confirm-deadline,omitempty"`
+}
+
+// Keeps the state in its file, a store without a path keeps nothing
+type stateStore struct {
+	path     string
+	readOnly bool
+	state    State
+}
+
+// Loads the state of the file, which is empty when the file does not exist yet. In dry-run mode nothing is
+// applied, and the state is only read.
+func loadState(path string, dryRun bool) (*stateStore, error) {
+	store := &stateStore{path: path, readOnly: dryRun}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return store, fmt.Errorf("error reading state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.state); err != nil {
+		store.state = State{}
+		return store, fmt.Errorf("error parsing state file %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// Saves the applied config and the pending confirm, if there is one. The file is replaced at once, so that
+// it's never left half written.
+func (s *stateStore) save(data []byte, pending *pendingConfirm) error {
+	if s.path == "" || s.readOnly {
+		return nil
+	}
+	state := s.state
+	if string(data) != state.Config {
+		state.Version++
+		state.AppliedAt = time.Now()
+		state.Config = string(data)
+	}
+	state.ConfirmedConfig, state.ConfirmDeadline = "", nil
+	if pending != nil {
+		state.ConfirmedConfig = string(pending.confirmedData)
+		state.ConfirmDeadline = &pending.deadline
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("error creating state directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	s.state = state
+	return nil
+}
+
+// Restores the saved config as the current config of the life cycle, and returns it (nil if there is none)
+func (s *stateStore) restore(configLifeCycle *ipruler.ConfigLifeCycle) []byte {
+	if s.state.Config == "" {
+		return nil
+	}
+	log.Printf("Restoring the config of version %d, applied at %s", s.state.Version, s.state.AppliedAt.Format(time.RFC3339))
+	data := []byte(s.state.Config)
+	if err := configLifeCycle.Restore(data); err != nil {
+		log.Printf("Error in restoring the config: %s", err)
+	}
+	return data
+}
+
+// logs the errors of saving the state, which don't fail the sync
+func (s *stateStore) trySave(data []byte, pending *pendingConfirm) {
+	if err := s.save(data, pending); err != nil {
+		log.Printf("Error in saving the state: %s", err)
+	}
+}
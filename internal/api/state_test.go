@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func writeState(t *testing.T, path string, state State) {
+	t.Helper()
+	content, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the saved config and pending confirm are loaded back, and the version only increases when the config changes
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipruler", "state.json")
+	store, err := loadState(path, false)
+	if err != nil || store.state.Version != 0 || store.state.Config != "" {
+		t.Fatalf("state of a missing file: %+v, %v", store.state, err)
+	}
+
+	pending := &pendingConfirm{confirmedData: []byte(routeConfig("10.20.0.0/16")), deadline: time.Now().Add(time.Hour).Round(0)}
+	if err := store.save([]byte(testConfig), pending); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadState(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loaded.state
+	if state.Version != 1 || state.Config != testConfig || state.AppliedAt.IsZero() {
+		t.Errorf("loaded state: %+v", state)
+	}
+	if state.ConfirmedConfig != string(pending.confirmedData) || state.ConfirmDeadline == nil || !state.ConfirmDeadline.Equal(pending.deadline) {
+		t.Errorf("loaded pending confirm: %q, %v", state.ConfirmedConfig, state.ConfirmDeadline)
+	}
+
+	// confirming keeps the version of the config
+	if err := loaded.save([]byte(testConfig), nil); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ = loadState(path, false); loaded.state.Version != 1 || loaded.state.ConfirmDeadline != nil || loaded.state.ConfirmedConfig != "" {
+		t.Errorf("state after confirm: %+v", loaded.state)
+	}
+	if err := loaded.save([]byte(routeConfig("10.30.0.0/16")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ = loadState(path, false); loaded.state.Version != 2 {
+		t.Errorf("version after a new config: %d, want 2", loaded.state.Version)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("the temporary file is left behind")
+	}
+}
+
+// a corrupt file is reported and the agent starts without a config, the next save replaces it
+func TestStateStore_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"version": 3, "config": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := loadState(path, false)
+	if err == nil {
+		t.Errorf("loading a corrupt file: got no error")
+	}
+	if store.state.Version != 0 || store.state.Config != "" {
+		t.Errorf("state of a corrupt file: %+v", store.state)
+	}
+
+	if err := store.save([]byte(testConfig), nil); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = loadState(path, false); err != nil || store.state.Config != testConfig {
+		t.Errorf("state saved over a corrupt file: %+v, %v", store.state, err)
+	}
+}
+
+// The agent resumes from the saved config, so the next update removes what is no more in the config. A corrupt
+// file starts the agent without a config.
+func TestRestoreState(t *testing.T) {
+	fake := setupFakeNode(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	// the route the agent has applied before it's restarted
+	d0, _ := fake.LinkByName("d0")
+	_, dst, _ := net.ParseCIDR("10.30.0.0/16")
+	if err := fake.RouteAdd(&netlink.Route{LinkIndex: d0.Attrs().Index, Dst: dst, Gw: net.ParseIP("172.31.201.1"), Table: 100}); err != nil {
+		t.Fatal(err)
+	}
+	previous := routeConfig("10.30.0.0/16")
+	writeState(t, statePath, State{Version: 4, AppliedAt: time.Now(), Config: previous})
+
+	api, app := newTestApi(t, statePath, false)
+	if pending, data := pendingState(api); pending != nil || data != previous {
+		t.Errorf("restored state: pending %v, config %q", pending, data)
+	}
+	if status, response := post(t, app, "/update", testConfig); status != http.StatusOK {
+		t.Fatalf("POST /update: got %d %v", status, response)
+	}
+	waitForRoutes(t, 100, "10.20.0.0/16")
+	if store, _ := loadState(statePath, false); store.state.Version != 5 {
+		t.Errorf("version after the update: %d, want 5", store.state.Version)
+	}
+
+	if err := os.WriteFile(statePath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	api, _ = newTestApi(t, statePath, false)
+	if _, data := pendingState(api); data != "" {
+		t.Errorf("config restored from a corrupt file: %q", data)
+	}
+}
+
+// a pending confirm is resumed with its deadline, and a deadline which has passed while the agent was down
+// reverts the config right away
+func TestRestoreState_PendingConfirm(t *testing.T) {
+	setupFakeNode(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	confirmed, unconfirmed := routeConfig("10.20.0.0/16"), routeConfig("10.30.0.0/16")
+	deadline := time.Now().Add(time.Hour).Round(0)
+	writeState(t, statePath, State{Version: 2, AppliedAt: time.Now(), Config: unconfirmed, ConfirmedConfig: confirmed, ConfirmDeadline: &deadline})
+
+	api, _ := newTestApi(t, statePath, false)
+	pending, data := pendingState(api)
+	if pending == nil || pending.deadline.Sub(deadline).Abs() > time.Second || string(pending.confirmedData) != confirmed {
+		t.Fatalf("restored pending confirm: %+v", pending)
+	}
+	if data != unconfirmed {
+		t.Errorf("restored config: %q, want the unconfirmed one", data)
+	}
+
+	passed := time.Now().Add(-time.Minute)
+	writeState(t, statePath, State{Version: 2, AppliedAt: time.Now(), Config: unconfirmed, ConfirmedConfig: confirmed, ConfirmDeadline: &passed})
+	api, _ = newTestApi(t, statePath, false)
+	waitForRoutes(t, 100, "10.20.0.0/16")
+	if pending, data := pendingState(api); pending != nil || data != confirmed {
+		t.Errorf("after the passed deadline: pending %v, config %q, want the confirmed config", pending, data)
+	}
+	if store, _ := loadState(statePath, false); store.state.Config != confirmed || store.state.ConfirmDeadline != nil {
+		t.Errorf("state after the passed deadline: %+v", store.state)
+	}
+}
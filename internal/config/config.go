@@ -1,19 +1,45 @@
 package config
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/plutocholia/ipruler/internal/utils"
 	"github.com/vishvananda/netlink"
 )
 
 type Config struct {
-	Rules    []*netlink.Rule
-	Routes   []*netlink.Route
-	Vlans    []*netlink.Vlan
-	Settings Settings
+	Rules     []*netlink.Rule
+	Routes    []*netlink.Route
+	Vlans     []*netlink.Vlan
+	Addresses []*netlink.Addr
+	Tables    map[string]int
+	Settings  Settings
+	// the network namespace of the objects, empty for the one of the agent
+	Namespace string
 }
 
 type Settings struct {
-	TableHardSync map[int]bool
+	TableHardSync     map[int]bool
+	RulePriorityRange *PriorityRange
+	// protocol of the routes that don't define one, 0 means the default of `ip route` (boot)
+	RouteProtocol int
+	// alias of the vlans created by the agent
+	VlanAlias string
+	// hard-sync only removes the objects tagged by the agent (route-protocol, rule-priority-range and vlan-alias)
+	OwnedOnly bool
+	// the links whose addresses are all the ones of the config, by name
+	AddressHardSync map[string]bool
+}
+
+// Range of rule priorities owned by the agent
+type PriorityRange struct {
+	Start int
+	End   int
+}
+
+func (p *PriorityRange) Contains(priority int) bool {
+	return p != nil && priority >= p.Start && priority <= p.End
 }
 
 func (c *Config) String() string {
@@ -27,51 +53,263 @@ func (c *Config) String() string {
 	for _, route := range c.Routes {
 		result += "\n\t" + route.String()
 	}
+	result += "\ntables:"
+	for name, id := range c.Tables {
+		result += fmt.Sprintf("\n\t%d %s", id, name)
+	}
 	result += "\nvlans:"
 	for _, vlan := range c.Vlans {
 		result += "\n\t" + utils.VlanToString(vlan)
 	}
+	result += "\naddresses:"
+	for _, addr := range c.Addresses {
+		result += "\n\t" + utils.AddrToString(addr)
+	}
 	return result
 }
 
-func CreateConfig(configModel *ConfigModel) *Config {
-	config := &Config{}
+func CreateConfig(configModel *ConfigModel) (*Config, error) {
+	config := &Config{Namespace: configModel.Namespace}
+
+	if err := config.AddTables(configModel.Tables); err != nil {
+		return nil, err
+	}
+	if err := config.AddSettings(configModel.Settings); err != nil {
+		return nil, err
+	}
+	if err := config.AddVlans(configModel.Vlans); err != nil {
+		return nil, err
+	}
+	if err := config.AddAddresses(configModel.Addresses); err != nil {
+		return nil, err
+	}
+	if err := config.AddRoutes(configModel.Routes); err != nil {
+		return nil, err
+	}
+	if err := config.AddRules(configModel.Rules); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// The Add methods report the errors of all the items of a section together, and add none of them if there is any.
+func (config *Config) AddVlans(vlans []VlanModel) error {
+	result := []*netlink.Vlan{}
+	errs := []error{}
+	for i, vlan := range vlans {
+		res, err := vlan.toNetlink(config)
+		if err != nil {
+			errs = append(errs, itemError(err, "vlans", i))
+			continue
+		}
+		res.(*netlink.Vlan).Alias = config.Settings.VlanAlias
+		result = append(result, res.(*netlink.Vlan))
+	}
+	if len(errs) != 0 {
+		return JoinErrors(errs)
+	}
+	config.Vlans = result
+	return nil
+}
+
+func (config *Config) AddAddresses(addresses []AddressModel) error {
+	result := []*netlink.Addr{}
+	errs := []error{}
+	for i, address := range addresses {
+		res, err := address.toNetlink(config)
+		if err != nil {
+			errs = append(errs, itemError(err, "addresses", i))
+			continue
+		}
+		result = append(result, res.(*netlink.Addr))
+	}
+	if len(errs) != 0 {
+		return JoinErrors(errs)
+	}
+	config.Addresses = result
+	return nil
+}
 
-	config.AddSettings(configModel.Settings)
-	config.AddVlans(configModel.Vlans)
-	config.AddRoutes(configModel.Routes)
-	config.AddRules(configModel.Rules)
+func (config *Config) AddRoutes(routes []RouteModel) error {
+	result := []*netlink.Route{}
+	errs := []error{}
+	for i, route := range routes {
+		res, err := route.toNetlink(config)
+		if err != nil {
+			errs = append(errs, itemError(err, "routes", i))
+			continue
+		}
+		if route.Protocol == "" && config.Settings.RouteProtocol != 0 {
+			res.(*netlink.Route).Protocol = netlink.RouteProtocol(config.Settings.RouteProtocol)
+		}
+		result = append(result, res.(*netlink.Route))
+	}
+	if len(errs) != 0 {
+		return JoinErrors(errs)
+	}
+	config.Routes = result
+	return nil
+}
 
-	return config
+func (config *Config) AddRules(rules []RuleModel) error {
+	result := []*netlink.Rule{}
+	errs := []error{}
+	for i, rule := range rules {
+		res, err := rule.toNetlink(config)
+		if err != nil {
+			errs = append(errs, itemError(err, "rules", i))
+			continue
+		}
+		rule := res.(*netlink.Rule)
+		if rule.Family != netlink.FAMILY_ALL {
+			result = append(result, rule)
+			continue
+		}
+		// the rules of both families
+		for _, family := range utils.IPFamilies {
+			familyRule := *rule
+			familyRule.Family = family
+			result = append(result, &familyRule)
+		}
+	}
+	if len(errs) != 0 {
+		return JoinErrors(errs)
+	}
+	config.Rules = result
+	return nil
 }
 
-func (config *Config) AddVlans(vlans []VlanModel) {
-	for _, vlan := range vlans {
-		if res, ok := vlan.ToNetlink().(*netlink.Vlan); ok {
-			config.Vlans = append(config.Vlans, res)
+// Tables have to be added (and synced to rt_tables.d) before anything that refers to them by name.
+func (config *Config) AddTables(tables []TableModel) error {
+	result := make(map[string]int)
+	errs := []error{}
+	foreignTables := utils.ForeignRouteTables()
+	ids := make(map[int]string)
+	for i, table := range tables {
+		if err := validateTable(&table); err != nil {
+			errs = append(errs, itemError(err, "tables", i))
+			continue
 		}
+		if id, exists := foreignTables[table.Name]; exists && id != table.ID {
+			errs = append(errs, itemError(fieldErrorf("id", "table %s is already defined with id %d outside of the agent", table.Name, id), "tables", i))
+		} else if _, exists := result[table.Name]; exists {
+			errs = append(errs, itemError(fieldErrorf("name", "table %s is defined more than once", table.Name), "tables", i))
+		} else if name, exists := ids[table.ID]; exists {
+			errs = append(errs, itemError(fieldErrorf("id", "table %s has the same id as table %s", table.Name, name), "tables", i))
+		} else {
+			result[table.Name] = table.ID
+			ids[table.ID] = table.Name
+		}
+	}
+	if len(errs) != 0 {
+		return JoinErrors(errs)
 	}
+	config.Tables = result
+	return nil
 }
 
-func (config *Config) AddRoutes(routes []RouteModel) {
-	for _, route := range routes {
-		if res, ok := route.ToNetlink().(*netlink.Route); ok {
-			config.Routes = append(config.Routes, res)
+func (config *Config) AddSettings(settings SettingsModel) error {
+	result := Settings{TableHardSync: make(map[int]bool)}
+	errs := []error{}
+	for i, table := range settings.TableHardSync {
+		id, err := config.tableID(table)
+		if err != nil {
+			errs = append(errs, settingsError(fmt.Sprintf("table-hard-sync[%d]", i), err))
+			continue
+		}
+		result.TableHardSync[id] = true
+	}
+
+	if settings.RulePriorityRange != "" {
+		start, end, err := parseRange(settings.RulePriorityRange, 32)
+		if err != nil {
+			errs = append(errs, settingsError("rule-priority-range", err))
+		} else {
+			result.RulePriorityRange = &PriorityRange{Start: int(start), End: int(end)}
+		}
+	}
+
+	if settings.RouteProtocol != "" {
+		value, exists := utils.GetRouteProtocol(settings.RouteProtocol)
+		if !exists {
+			errs = append(errs, settingsError("route-protocol", fmt.Errorf("route protocol '%s' does not exist", settings.RouteProtocol)))
 		}
+		result.RouteProtocol = value
+	}
+
+	result.VlanAlias = settings.VlanAlias
+
+	result.AddressHardSync = make(map[string]bool)
+	for _, dev := range settings.AddressHardSync {
+		result.AddressHardSync[dev] = true
+	}
+
+	result.OwnedOnly = settings.OwnedOnly
+	if settings.OwnedOnly && (settings.RouteProtocol == "" || settings.RulePriorityRange == "" || settings.VlanAlias == "") {
+		errs = append(errs, settingsError("owned-only", fmt.Errorf("owned-only needs route-protocol, rule-priority-range and vlan-alias to recognise the owned objects")))
+	}
+
+	if len(errs) != 0 {
+		return JoinErrors(errs)
+	}
+	config.Settings = result
+	return nil
+}
+
+// Resolves the tables and links the items refer to
+type resolver interface {
+	tableID(table string) (int, error)
+	linkIndex(dev string, gw net.IP) (int, error)
+	// the handle of the network namespace the links are in
+	netlink() (utils.NetlinkHandle, error)
+}
+
+// resolves everything from the node
+type nodeResolver struct{}
+
+func (nodeResolver) tableID(table string) (int, error) {
+	return getTableID(table)
+}
+
+func (nodeResolver) linkIndex(dev string, gw net.IP) (int, error) {
+	return getLinkIndex(utils.Netlink, dev, gw)
+}
+
+func (nodeResolver) netlink() (utils.NetlinkHandle, error) {
+	return utils.Netlink, nil
+}
+
+// The config resolves its own tables and vlans, which are not on the node yet when the config is only planned.
+func (config *Config) tableID(table string) (int, error) {
+	if id, exists := config.Tables[table]; exists {
+		return id, nil
 	}
+	return getTableID(table)
 }
 
-func (config *Config) AddRules(rules []RuleModel) {
-	for _, rule := range rules {
-		if res, ok := rule.ToNetlink().(*netlink.Rule); ok {
-			config.Rules = append(config.Rules, res)
+// the index of a vlan of the config which is not created yet is 0
+func (config *Config) linkIndex(dev string, gw net.IP) (int, error) {
+	handle, err := config.netlink()
+	if err != nil {
+		return 0, err
+	}
+	index, err := getLinkIndex(handle, dev, gw)
+	if err != nil && dev != "" {
+		for _, vlan := range config.Vlans {
+			if vlan.Name == dev {
+				return 0, nil
+			}
 		}
 	}
+	return index, err
 }
 
-func (config *Config) AddSettings(settings SettingsModel) {
-	config.Settings.TableHardSync = make(map[int]bool)
-	for _, table := range settings.TableHardSync {
-		config.Settings.TableHardSync[table] = true
+// the links of the config are in its namespace
+func (config *Config) netlink() (utils.NetlinkHandle, error) {
+	handle, err := utils.NamespaceNetlink(config.Namespace)
+	if err != nil {
+		return nil, fieldErrorf("namespace", "%w", err)
 	}
+	return handle, nil
 }
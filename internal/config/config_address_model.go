@@ -0,0 +1,178 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The lifetime of an address which never expires (INFINITY_LIFE_TIME of the kernel)
+const ADDRESS_LIFETIME_FOREVER = math.MaxUint32
+
+// The longest name of a link, and of the label of an address (IFNAMSIZ without the terminating NUL)
+const MAX_LINK_NAME_LENGTH = 15
+
+type AddressModel struct {
+	Dev   string `yaml:"dev"`
+	CIDR  string `yaml:"cidr"`
+	Label string `yaml:"label"`
+	Scope string `yaml:"scope"`
+	Peer  string `yaml:"peer"`
+	// seconds, or `forever` (default), the preferred lifetime is the valid one by default
+	ValidLft     string `yaml:"valid-lft"`
+	PreferredLft string `yaml:"preferred-lft"`
+	// the kernel adds no route to the network of the address
+	NoPrefixRoute bool `yaml:"noprefixroute"`
+	// the network namespace of the address (and of its dev), the one of the config when it's empty
+	Namespace string `yaml:"namespace"`
+}
+
+func (a *AddressModel) IsEmpty() bool {
+	if a.Dev == "" &&
+		a.CIDR == "" &&
+		a.Label == "" &&
+		a.Scope == "" &&
+		a.Peer == "" &&
+		a.ValidLft == "" &&
+		a.PreferredLft == "" &&
+		!a.NoPrefixRoute &&
+		a.Namespace == "" {
+		return true
+	}
+	return false
+}
+
+func (a *AddressModel) String() string {
+	return fmt.Sprintf("dev: %s - cidr: %s - label: %s - scope: %s - peer: %s", a.Dev, a.CIDR, a.Label, a.Scope, a.Peer)
+}
+
+// parses a lifetime in seconds or `forever`, an empty lifetime is forever.
+func parseLifetime(value string) (int, error) {
+	if value == "" || value == "forever" {
+		return ADDRESS_LIFETIME_FOREVER, nil
+	}
+	lifetime, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || lifetime == ADDRESS_LIFETIME_FOREVER {
+		return 0, fmt.Errorf("lifetime (%s) must be a number of seconds or forever", value)
+	}
+	return int(lifetime), nil
+}
+
+func (a *AddressModel) ToNetlink() (interface{}, error) {
+	return a.toNetlink(nodeResolver{})
+}
+
+func (a *AddressModel) toNetlink(res resolver) (interface{}, error) {
+	var err error
+	addr := &netlink.Addr{}
+
+	ip, ipnet, err := net.ParseCIDR(a.CIDR)
+	if err != nil {
+		return nil, fieldErrorf("cidr", "could not parse CIDR of (%s)", a.CIDR)
+	}
+	addr.IPNet = &net.IPNet{IP: ip, Mask: ipnet.Mask}
+	if utils.GetIPFamily(ip) == netlink.FAMILY_V4 {
+		addr.IPNet.IP = ip.To4()
+	}
+
+	if a.Dev == "" {
+		return nil, fieldErrorf("dev", "address needs dev")
+	}
+	if addr.LinkIndex, err = res.linkIndex(a.Dev, nil); err != nil {
+		return nil, err
+	}
+
+	// like `ip address`, the label of an address is the name of its dev or starts with it, and the kernel labels
+	// an IPv4 address with the name of its dev by default
+	if a.Label != "" {
+		if !strings.HasPrefix(a.Label, a.Dev) || len(a.Label) > MAX_LINK_NAME_LENGTH {
+			return nil, fieldErrorf("label", "label %s must start with the name of dev %s, and have at most %d characters", a.Label, a.Dev, MAX_LINK_NAME_LENGTH)
+		}
+		if utils.GetIPFamily(ip) != netlink.FAMILY_V4 {
+			return nil, fieldErrorf("label", "only IPv4 addresses have a label")
+		}
+		addr.Label = a.Label
+	} else if utils.GetIPFamily(ip) == netlink.FAMILY_V4 {
+		addr.Label = a.Dev
+	}
+
+	// the kernel derives the scope of an IPv6 address from its type
+	if a.Scope != "" {
+		value, exists := utils.RouteScopes[a.Scope]
+		if !exists {
+			return nil, fieldErrorf("scope", "address scope '%s' does not exist", a.Scope)
+		}
+		if utils.GetIPFamily(ip) != netlink.FAMILY_V4 {
+			return nil, fieldErrorf("scope", "only IPv4 addresses have a scope")
+		}
+		addr.Scope = value
+	}
+
+	if a.Peer != "" {
+		peer, err := parsePeer(a.Peer)
+		if err != nil {
+			return nil, err
+		}
+		if utils.GetIPFamily(peer.IP) != utils.GetIPFamily(ip) {
+			return nil, fieldErrorf("peer", "peer (%s) and address (%s) are not the same IP family", a.Peer, a.CIDR)
+		}
+		// the prefix length of a point-to-point address is the one of its peer
+		if ones, bits := addr.Mask.Size(); ones != bits {
+			return nil, fieldErrorf("cidr", "address (%s) with a peer must be a single address (/%d)", a.CIDR, bits)
+		}
+		addr.Peer = peer
+	}
+
+	// the kernel needs both lifetimes once one of them is defined, the preferred lifetime is the valid one by
+	// default
+	if a.ValidLft != "" || a.PreferredLft != "" {
+		if addr.ValidLft, err = parseLifetime(a.ValidLft); err != nil {
+			return nil, fieldErrorf("valid-lft", "%w", err)
+		}
+		if addr.ValidLft == 0 {
+			return nil, fieldErrorf("valid-lft", "an address with a valid lifetime of 0 is expired")
+		}
+		if addr.PreferedLft, err = parseLifetime(cmp.Or(a.PreferredLft, a.ValidLft)); err != nil {
+			return nil, fieldErrorf("preferred-lft", "%w", err)
+		}
+		if addr.PreferedLft > addr.ValidLft {
+			return nil, fieldErrorf("preferred-lft", "preferred lifetime (%s) is longer than the valid lifetime (%s)", a.PreferredLft, a.ValidLft)
+		}
+	}
+
+	if a.NoPrefixRoute {
+		addr.Flags |= unix.IFA_F_NOPREFIXROUTE
+	}
+
+	return addr, nil
+}
+
+// parses the peer of a point-to-point address, an address without a prefix length is a host
+func parsePeer(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fieldErrorf("peer", "invalid peer address %s", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fieldErrorf("peer", "could not parse CIDR of (%s)", value)
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: ipnet.Mask}, nil
+}
@@ -1,42 +1,217 @@
 package config
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"reflect"
+	"strings"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Model interface {
 	String() string
-	ToNetlink() interface{}
+	ToNetlink() (interface{}, error)
 }
 
 type ConfigModel struct {
-	Rules    []RuleModel   `yaml:"rules"`
-	Settings SettingsModel `yaml:"settings"`
-	Routes   []RouteModel  `yaml:"routes"`
-	Vlans    []VlanModel   `yaml:"vlans"`
+	Rules     []RuleModel    `yaml:"rules"`
+	Settings  SettingsModel  `yaml:"settings"`
+	Routes    []RouteModel   `yaml:"routes"`
+	Vlans     []VlanModel    `yaml:"vlans"`
+	Addresses []AddressModel `yaml:"addresses"`
+	Tables    []TableModel   `yaml:"tables"`
+	// the network namespace of the items that don't define one, the one of the agent when it's empty
+	Namespace string `yaml:"namespace"`
+
+	// the parsed YAML document, to find the position of the items and fields
+	node *yaml.Node
+	// the index of the items in the document by section, when the model is a part of it (see Namespaces)
+	indexes map[string][]int
 }
 
 func (c *ConfigModel) IsEmpty() bool {
 	if len(c.Rules) == 0 &&
 		c.Settings.IsEmpty() &&
 		len(c.Routes) == 0 &&
-		len(c.Vlans) == 0 {
+		len(c.Vlans) == 0 &&
+		len(c.Addresses) == 0 &&
+		len(c.Tables) == 0 {
 		return true
 	}
 	return false
 }
 
+// Splits the config by the network namespace of its items, which is the one of the item or else the one of the
+// config. Every part has the tables and settings of the config, and the part of the namespace of the config is
+// there even when it has no item.
+func (c *ConfigModel) Namespaces() map[string]*ConfigModel {
+	models := make(map[string]*ConfigModel)
+	part := func(namespace string) *ConfigModel {
+		if namespace == "" {
+			namespace = c.Namespace
+		}
+		if model, exists := models[namespace]; exists {
+			return model
+		}
+		model := &ConfigModel{
+			Settings:  c.Settings,
+			Tables:    c.Tables,
+			Namespace: namespace,
+			node:      c.node,
+			indexes:   map[string][]int{"vlans": {}, "addresses": {}, "routes": {}, "rules": {}},
+		}
+		models[namespace] = model
+		return model
+	}
+	part("")
+	for i, vlan := range c.Vlans {
+		model := part(vlan.Namespace)
+		model.Vlans = append(model.Vlans, vlan)
+		model.indexes["vlans"] = append(model.indexes["vlans"], c.index("vlans", i))
+	}
+	for i, address := range c.Addresses {
+		model := part(address.Namespace)
+		model.Addresses = append(model.Addresses, address)
+		model.indexes["addresses"] = append(model.indexes["addresses"], c.index("addresses", i))
+	}
+	for i, route := range c.Routes {
+		model := part(route.Namespace)
+		model.Routes = append(model.Routes, route)
+		model.indexes["routes"] = append(model.indexes["routes"], c.index("routes", i))
+	}
+	for i, rule := range c.Rules {
+		model := part(rule.Namespace)
+		model.Rules = append(model.Rules, rule)
+		model.indexes["rules"] = append(model.indexes["rules"], c.index("rules", i))
+	}
+	return models
+}
+
+// the index in the document of an item of the model
+func (c *ConfigModel) index(section string, index int) int {
+	if indexes, exists := c.indexes[section]; exists && index >= 0 && index < len(indexes) {
+		return indexes[index]
+	}
+	return index
+}
+
 // General Functions
-func CreateConfigModel(data []byte) *ConfigModel {
-	configModel := ConfigModel{}
-	err := yaml.Unmarshal(data, &configModel)
-	if err != nil {
-		log.Fatalf("error: %v", err)
+
+// Decodes the config. In strict mode, the keys that are not fields of the config (e.g. a typo like `tabel` or
+// `on_link`) are reported instead of being ignored. Values of a wrong type are reported in both modes.
+func CreateConfigModel(data []byte, strict bool) (*ConfigModel, error) {
+	configModel := ConfigModel{node: &yaml.Node{}}
+	if err := yaml.Unmarshal(data, configModel.node); err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	if strict {
+		if err := JoinErrors(unknownFields(configModel.node, reflect.TypeOf(configModel), "")); err != nil {
+			return nil, err
+		}
+	}
+	if err := configModel.node.Decode(&configModel); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, &ParseError{Err: err}
+		}
+		errs := []error{}
+		for _, message := range typeErr.Errors {
+			errs = append(errs, &ParseError{Err: errors.New(message)})
+		}
+		return nil, JoinErrors(errs)
+	}
+	return &configModel, nil
+}
+
+// walks the YAML along the config type, and reports the keys of mappings which are not a field of their struct.
+func unknownFields(node *yaml.Node, t reflect.Type, path string) []error {
+	errs := []error{}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.AliasNode:
+		return unknownFields(node.Alias, t, path)
+	case yaml.DocumentNode:
+		for _, content := range node.Content {
+			errs = append(errs, unknownFields(content, t, path)...)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return errs
+		}
+		for i, content := range node.Content {
+			errs = append(errs, unknownFields(content, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return errs
+		}
+		fields := make(map[string]reflect.Type)
+		names := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			fields[name] = field.Type
+			names = append(names, name)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldPath := key.Value
+			if path != "" {
+				fieldPath = path + "." + key.Value
+			}
+			fieldType, exists := fields[key.Value]
+			if !exists {
+				err := fmt.Errorf("unknown field '%s'", key.Value)
+				if suggestion := closestName(key.Value, names); suggestion != "" {
+					err = fmt.Errorf("unknown field '%s', did you mean '%s'?", key.Value, suggestion)
+				}
+				errs = append(errs, &FieldError{Index: -1, Field: fieldPath, Err: err, Line: key.Line, Column: key.Column})
+				continue
+			}
+			errs = append(errs, unknownFields(value, fieldType, fieldPath)...)
+		}
 	}
-	return &configModel
+	return errs
+}
+
+// returns the name which is at most 2 edits away from the given one (ignoring `_` vs `-` and case), if there is one.
+func closestName(name string, names []string) string {
+	normalize := func(value string) string {
+		return strings.ToLower(strings.ReplaceAll(value, "_", "-"))
+	}
+	closest, closestDistance := "", 3
+	for _, candidate := range names {
+		if distance := editDistance(normalize(name), normalize(candidate)); distance < closestDistance {
+			closest, closestDistance = candidate, distance
+		}
+	}
+	return closest
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
 }
 
 func getStringFromModel(v []Model, identifier string) string {
@@ -74,9 +249,14 @@ func (c *ConfigModel) String() string {
 	for i, vlan := range c.Vlans {
 		vlansModelInt[i] = &vlan
 	}
+	addressesModelInt := make([]Model, len(c.Addresses))
+	for i, address := range c.Addresses {
+		addressesModelInt[i] = &address
+	}
 	res += getStringFromModel(rulesModelInt, "Rules")
 	res += getStringFromModel(routesModelInt, "Routes")
 	res += getStringFromModel(vlansModelInt, "Vlans")
+	res += getStringFromModel(addressesModelInt, "Addresses")
 
 	return res
 }
@@ -2,7 +2,6 @@ package config
 
 import (
 	"fmt"
-	"log"
 	"net"
 
 	"github.com/plutocholia/ipruler/internal/utils"
@@ -10,88 +9,280 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// Kernel default metric of IPv6 routes added without an explicit metric (IP6_RT_PRIO_USER).
+const IPV6_DEFAULT_ROUTE_METRIC = 1024
+
 type RouteModel struct {
 	To       string `yaml:"to"`
 	Via      string `yaml:"via"`
-	Table    int    `yaml:"table"`
+	Table    string `yaml:"table"`
 	Dev      string `yaml:"dev"`
 	Protocol string `yaml:"protocol"`
 	OnLink   bool   `yaml:"on-link"`
 	Scope    string `yaml:"scope"`
+	Metric   int    `yaml:"metric"`
+	Src      string `yaml:"src"`
+	MTU      int    `yaml:"mtu"`
+	AdvMSS   int    `yaml:"advmss"`
+	Hoplimit int    `yaml:"hoplimit"`
+	InitCwnd int    `yaml:"initcwnd"`
+	InitRwnd int    `yaml:"initrwnd"`
+	Realm    int    `yaml:"realm"`
+	Type     string `yaml:"type"`
+	// the network namespace of the route, the one of the config when it's empty
+	Namespace string `yaml:"namespace"`
+
+	Nexthops []NexthopModel `yaml:"nexthops"`
+}
+
+// A nexthop of a multipath (ECMP) route
+type NexthopModel struct {
+	Via    string `yaml:"via"`
+	Dev    string `yaml:"dev"`
+	Weight int    `yaml:"weight"`
+	OnLink bool   `yaml:"on-link"`
 }
 
 func (r *RouteModel) IsEmpty() bool {
 	if r.To == "" &&
 		r.Via == "" &&
-		r.Table == 0 &&
+		r.Table == "" &&
 		r.Dev == "" &&
 		r.Protocol == "" &&
 		!r.OnLink &&
-		r.Scope == "" {
+		r.Scope == "" &&
+		r.Metric == 0 &&
+		r.Src == "" &&
+		r.MTU == 0 &&
+		r.AdvMSS == 0 &&
+		r.Hoplimit == 0 &&
+		r.InitCwnd == 0 &&
+		r.InitRwnd == 0 &&
+		r.Realm == 0 &&
+		r.Type == "" &&
+		r.Namespace == "" &&
+		len(r.Nexthops) == 0 {
 		return true
 	}
 	return false
 }
 
-func getReachableLink(ip net.IP) netlink.Link {
-	routes, err := netlink.RouteGet(ip)
+func getReachableLink(handle utils.NetlinkHandle, ip net.IP) (netlink.Link, error) {
+	routes, err := handle.RouteGet(ip)
 	if err != nil {
-		log.Fatalf("RouteGet failed: %v", err)
+		return nil, fmt.Errorf("gateway %s is not reachable: %w", ip, err)
 	}
-	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	link, err := handle.LinkByIndex(routes[0].LinkIndex)
 	if err != nil {
-		log.Fatalf("LinkByIndex failed: %v", err)
+		return nil, fmt.Errorf("link of gateway %s is not found: %w", ip, err)
 	}
-	return link
+	return link, nil
+}
+
+// returns the index of dev, or of the link through which gw is reachable when dev is not defined.
+func getLinkIndex(handle utils.NetlinkHandle, dev string, gw net.IP) (int, error) {
+	if dev == "" {
+		link, err := getReachableLink(handle, gw)
+		if err != nil {
+			return 0, fieldErrorf("via", "%w", err)
+		}
+		return link.Attrs().Index, nil
+	}
+	link, err := handle.LinkByName(dev)
+	if err != nil {
+		return 0, fieldErrorf("dev", "failed to get the network interface %s: %w", dev, err)
+	}
+	return link.Attrs().Index, nil
+}
+
+func parseGateway(via string) (net.IP, error) {
+	gw := net.ParseIP(via)
+	if gw == nil {
+		return nil, fieldErrorf("via", "invalid gateway IP address %s", via)
+	}
+	return gw, nil
+}
+
+func getOnLinkFlag(onLink bool) int {
+	if !onLink {
+		return 0
+	}
+	return utils.RouteFlags["onlink"]
 }
 
 func (r *RouteModel) String() string {
-	return fmt.Sprintf("to: %s - via: %s - table: %d", r.To, r.Via, r.Table)
+	return fmt.Sprintf("type: %s - to: %s - via: %s - table: %s - nexthops: %v", r.Type, r.To, r.Via, r.Table, r.Nexthops)
+}
+
+func (n *NexthopModel) String() string {
+	return fmt.Sprintf("via: %s - dev: %s - weight: %d - on-link: %t", n.Via, n.Dev, n.Weight, n.OnLink)
 }
 
-func (r *RouteModel) ToNetlink() interface{} {
+func (n *NexthopModel) ToNetlink() (interface{}, error) {
+	return n.toNetlink(nodeResolver{})
+}
+
+func (n *NexthopModel) toNetlink(res resolver) (interface{}, error) {
+	var err error
+	nexthop := &netlink.NexthopInfo{}
+
+	if n.Via != "" {
+		if nexthop.Gw, err = parseGateway(n.Via); err != nil {
+			return nil, err
+		}
+	} else if n.Dev == "" {
+		return nil, fieldErrorf("", "nexthop (%s) needs either via or dev", n.String())
+	}
+	if nexthop.LinkIndex, err = res.linkIndex(n.Dev, nexthop.Gw); err != nil {
+		return nil, err
+	}
+
+	// netlink keeps `weight - 1` in Hops, the weight is 1 when it's not defined
+	if n.Weight < 0 || n.Weight > 256 {
+		return nil, fieldErrorf("weight", "weight %d must be between 1 and 256", n.Weight)
+	} else if n.Weight > 0 {
+		nexthop.Hops = n.Weight - 1
+	}
+
+	nexthop.Flags = getOnLinkFlag(n.OnLink)
+
+	return nexthop, nil
+}
+
+func (r *RouteModel) ToNetlink() (interface{}, error) {
+	return r.toNetlink(nodeResolver{})
+}
+
+func (r *RouteModel) toNetlink(res resolver) (interface{}, error) {
+	var err error
 	route := &netlink.Route{}
-	// add `Dst` to route
+
+	// add `Type` to route (`ip route add` command sets RTN_UNICAST when type is not defined)
+	if r.Type != "" {
+		if value, exists := utils.RouteTypes[r.Type]; exists {
+			route.Type = value
+		} else {
+			return nil, fieldErrorf("type", "route type '%s' does not exist", r.Type)
+		}
+	} else {
+		route.Type = unix.RTN_UNICAST
+	}
+	if !utils.RouteTypeHasNexthop(route.Type) && (r.Via != "" || r.Dev != "" || r.OnLink || len(r.Nexthops) != 0) {
+		return nil, fieldErrorf("type", "route of type '%s' can not have via, dev, on-link or nexthops", r.Type)
+	}
+
+	// add `Gw` to route
+	if r.Via != "" {
+		if route.Gw, err = parseGateway(r.Via); err != nil {
+			return nil, err
+		}
+	}
+
+	// add `MultiPath` to route, a multipath route has its gateways and devices in the nexthops
+	if len(r.Nexthops) != 0 {
+		if r.Via != "" || r.Dev != "" || r.OnLink {
+			return nil, fieldErrorf("nexthops", "route can not have via, dev or on-link along with nexthops")
+		}
+		for i, nexthopModel := range r.Nexthops {
+			value, err := nexthopModel.toNetlink(res)
+			if err != nil {
+				return nil, itemError(err, "nexthops", i)
+			}
+			nexthop := value.(*netlink.NexthopInfo)
+			if route.Gw == nil {
+				route.Gw = nexthop.Gw // only used to find the family of the route below
+			}
+			route.MultiPath = append(route.MultiPath, nexthop)
+		}
+	}
+
+	// add `Dst` and `Family` to route. `default` takes the family of the gateway (IPv4 if there is none),
+	// and is represented the same way netlink reports it (0.0.0.0/0 or ::/0)
 	if r.To == "default" {
-		route.Dst = nil
+		route.Family = netlink.FAMILY_V4
+		if route.Gw != nil {
+			route.Family = utils.GetIPFamily(route.Gw)
+		}
+		route.Dst = utils.ZeroIPNet(route.Family)
 	} else {
 		if _, ipnet, err := net.ParseCIDR(r.To); err != nil {
-			log.Fatalf("Could not Parse CIDR of (%s)", r.To)
+			return nil, fieldErrorf("to", "could not parse CIDR of (%s)", r.To)
 		} else {
 			route.Dst = ipnet
+			route.Family = utils.GetIPFamily(ipnet.IP)
 		}
 	}
+	if len(route.MultiPath) == 0 && route.Gw != nil && utils.GetIPFamily(route.Gw) != route.Family {
+		return nil, fieldErrorf("via", "gateway (%s) and destination (%s) are not the same IP family", r.Via, r.To)
+	}
+	for i, nexthop := range route.MultiPath {
+		if nexthop.Gw != nil && utils.GetIPFamily(nexthop.Gw) != route.Family {
+			return nil, fieldErrorf(fmt.Sprintf("nexthops[%d].via", i), "gateway (%s) and destination (%s) are not the same IP family", nexthop.Gw, r.To)
+		}
+	}
+	if len(route.MultiPath) != 0 {
+		route.Gw = nil
+	}
 
-	// add `Table` to route
-	route.Table = r.Table
-
-	// add `Gw` to route
-	if r.Via != "" {
-		gw := net.ParseIP(r.Via)
-		if gw == nil {
-			log.Fatalf("Invalid gateway IP address: %s", gw)
+	// add `Src` (preferred source) to route
+	if r.Src != "" {
+		route.Src = net.ParseIP(r.Src)
+		if route.Src == nil {
+			return nil, fieldErrorf("src", "invalid source IP address %s", r.Src)
+		}
+		if utils.GetIPFamily(route.Src) != route.Family {
+			return nil, fieldErrorf("src", "source (%s) and destination (%s) are not the same IP family", r.Src, r.To)
 		}
-		route.Gw = gw
 	}
 
-	// add `LinkIndex` to route based on route.Gw if Dev is not defined.
-	if r.Dev == "" {
-		link := getReachableLink(route.Gw)
-		route.LinkIndex = link.Attrs().Index
-	} else { // add `LinkIndex` to route based on route.Dev
-		link, err := netlink.LinkByName(r.Dev)
-		if err != nil {
-			log.Fatalf("Failed to get the network interface: %v\n", err)
+	// add `Priority` to route (the kernel assigns a default metric to IPv6 routes)
+	if r.Metric < 0 {
+		return nil, fieldErrorf("metric", "metric %d is negative", r.Metric)
+	} else if r.Metric > 0 {
+		route.Priority = r.Metric
+	} else if route.Family == netlink.FAMILY_V6 {
+		route.Priority = IPV6_DEFAULT_ROUTE_METRIC
+	}
+
+	// add metrics and realm to route
+	if r.MTU < 0 || r.AdvMSS < 0 || r.Hoplimit < 0 || r.Hoplimit > 255 || r.InitCwnd < 0 || r.InitRwnd < 0 || r.Realm < 0 {
+		return nil, fieldErrorf("", "route has an invalid mtu, advmss, hoplimit, initcwnd, initrwnd or realm")
+	}
+	route.MTU = r.MTU
+	route.AdvMSS = r.AdvMSS
+	route.Hoplimit = r.Hoplimit
+	route.InitCwnd = r.InitCwnd
+	route.InitRwnd = r.InitRwnd
+	route.Realm = r.Realm
+
+	// add `Table` to route (like `ip route add`, local, broadcast and anycast routes go to the local table
+	// and the others to the main table by default)
+	if route.Table, err = res.tableID(r.Table); err != nil {
+		return nil, err
+	}
+	if route.Table == 0 && (route.Type == unix.RTN_LOCAL || route.Type == unix.RTN_BROADCAST || route.Type == unix.RTN_ANYCAST) {
+		route.Table = unix.RT_TABLE_LOCAL
+	} else if route.Table == 0 {
+		route.Table = unix.RT_TABLE_MAIN
+	}
+
+	// add `LinkIndex` to route based on route.Dev, or route.Gw if Dev is not defined (multipath routes
+	// have it in their nexthops and blackhole, unreachable, prohibit and throw routes have no device).
+	if len(route.MultiPath) == 0 && utils.RouteTypeHasNexthop(route.Type) {
+		if r.Dev == "" && route.Gw == nil {
+			return nil, fieldErrorf("", "route needs either via, dev or nexthops")
+		}
+		if route.LinkIndex, err = res.linkIndex(r.Dev, route.Gw); err != nil {
+			return nil, err
 		}
-		route.LinkIndex = link.Attrs().Index
 	}
 
 	// handle protocol
 	if r.Protocol != "" {
-		if value, exists := utils.RouteProtocols[r.Protocol]; exists {
-			route.Protocol = value
+		if value, exists := utils.GetRouteProtocol(r.Protocol); exists {
+			route.Protocol = netlink.RouteProtocol(value)
 		} else {
-			log.Fatalf("Route Protocol '%s' does not exist.\n", r.Protocol)
+			return nil, fieldErrorf("protocol", "route protocol '%s' does not exist", r.Protocol)
 		}
 	} else {
 		// add `Protocol` to route (`ip route add` command sets RTPROT_BOOT when protocol is not defined)
@@ -99,29 +290,22 @@ func (r *RouteModel) ToNetlink() interface{} {
 	}
 
 	// handle flag
-	if r.OnLink {
-		if value, exists := utils.RouteFlags["onlink"]; exists {
-			route.Flags = value
-		} else {
-			log.Fatalf("Route flags '%s' does not exist.\n", "onlink")
-		}
-	} else {
-		route.Flags = 0
-	}
+	route.Flags = getOnLinkFlag(r.OnLink)
 
 	// handle Scope
 	if r.Scope != "" {
 		if value, exists := utils.RouteScopes[r.Scope]; exists {
 			route.Scope = netlink.Scope(value)
 		} else {
-			log.Fatalf("Route scope '%s' does not exist.\n", r.Scope)
+			return nil, fieldErrorf("scope", "route scope '%s' does not exist", r.Scope)
 		}
+	} else if route.Type == unix.RTN_LOCAL {
+		route.Scope = unix.RT_SCOPE_HOST
+	} else if route.Type == unix.RTN_BROADCAST || route.Type == unix.RTN_ANYCAST {
+		route.Scope = unix.RT_SCOPE_LINK
 	} else {
 		route.Scope = unix.RT_SCOPE_UNIVERSE
 	}
 
-	// add `Type` to route (`ip route add` command sets RTN_UNICAST when type is not defined)
-	route.Type = unix.RTN_UNICAST
-
-	return route
+	return route, nil
 }
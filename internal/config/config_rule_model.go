@@ -3,17 +3,65 @@ package config
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
+	"github.com/plutocholia/ipruler/internal/utils"
 	"github.com/vishvananda/netlink"
 )
 
+// The largest TOS of a rule, which is a byte
+const MAX_RULE_TOS = 255
+
 type RuleModel struct {
-	From  string `yaml:"from"`
-	Table int    `yaml:"table"`
+	// a pointer, since 0 is a priority (the kernel picks one when it's not defined)
+	Priority *int   `yaml:"priority"`
+	From     string `yaml:"from"`
+	To       string `yaml:"to"`
+	Table    string `yaml:"table"`
+	FwMark   string `yaml:"fwmark"`
+	Iif      string `yaml:"iif"`
+	Oif      string `yaml:"oif"`
+	Tos      uint   `yaml:"tos"`
+	IPProto  string `yaml:"ipproto"`
+	Sport    string `yaml:"sport"`
+	Dport    string `yaml:"dport"`
+	UIDRange string `yaml:"uidrange"`
+	Not      bool   `yaml:"not"`
+	L3mdev   bool   `yaml:"l3mdev"`
+	Action   string `yaml:"action"`
+	Goto     int    `yaml:"goto"`
+	// inet, inet6 or all (a rule for each family), the family of from and to (IPv4 without them) by default
+	Family string `yaml:"family"`
+	// the network namespace of the rule, the one of the config when it's empty
+	Namespace string `yaml:"namespace"`
+
+	// pointers, since 0 is a meaningful value (e.g. `lookup main suppress_prefixlength 0`)
+	SuppressPrefixLength *int `yaml:"suppress-prefixlength"`
+	SuppressIfGroup      *int `yaml:"suppress-ifgroup"`
 }
 
 func (r *RuleModel) IsEmpty() bool {
-	if r.From == "" && r.Table == 0 {
+	if r.Priority == nil &&
+		r.From == "" &&
+		r.To == "" &&
+		r.Table == "" &&
+		r.FwMark == "" &&
+		r.Iif == "" &&
+		r.Oif == "" &&
+		r.Tos == 0 &&
+		r.IPProto == "" &&
+		r.Sport == "" &&
+		r.Dport == "" &&
+		r.UIDRange == "" &&
+		!r.Not &&
+		!r.L3mdev &&
+		r.Action == "" &&
+		r.Goto == 0 &&
+		r.Family == "" &&
+		r.Namespace == "" &&
+		r.SuppressPrefixLength == nil &&
+		r.SuppressIfGroup == nil {
 		return true
 	}
 	return false
@@ -21,18 +69,280 @@ func (r *RuleModel) IsEmpty() bool {
 
 // RuleModel Methods
 func (r *RuleModel) String() string {
-	return fmt.Sprintf("Src: %s - Table: %d", r.From, r.Table)
+	priority := "auto"
+	if r.Priority != nil {
+		priority = strconv.Itoa(*r.Priority)
+	}
+	return fmt.Sprintf("Priority: %s - Family: %s - Src: %s - Dst: %s - FwMark: %s - Iif: %s - Oif: %s - Action: %s - Table: %s", priority, r.Family, r.From, r.To, r.FwMark, r.Iif, r.Oif, r.Action, r.Table)
+}
+
+// The families of `family`
+var ruleFamilies = map[string]int{
+	"inet":  netlink.FAMILY_V4,
+	"inet6": netlink.FAMILY_V6,
+	"all":   netlink.FAMILY_ALL,
+}
+
+// returns the family of the rule, given its parsed from and to. FAMILY_ALL is a rule for each family, which can't
+// have from or to.
+func (r *RuleModel) family(src *net.IPNet, dst *net.IPNet) (int, error) {
+	family := 0
+	if src != nil {
+		family = utils.GetIPFamily(src.IP)
+	}
+	if dst != nil {
+		if src != nil && family != utils.GetIPFamily(dst.IP) {
+			return 0, fieldErrorf("to", "from (%s) and to (%s) are not the same IP family", r.From, r.To)
+		}
+		family = utils.GetIPFamily(dst.IP)
+	}
+	if r.Family == "" {
+		if family == 0 {
+			return netlink.FAMILY_V4, nil
+		}
+		return family, nil
+	}
+
+	value, exists := ruleFamilies[r.Family]
+	if !exists {
+		return 0, fieldErrorf("family", "rule family '%s' must be inet, inet6 or all", r.Family)
+	}
+	if family != 0 && value != family {
+		return 0, fieldErrorf("family", "rule family %s is not the one of from (%s) and to (%s)", r.Family, r.From, r.To)
+	}
+	return value, nil
 }
 
-func (r *RuleModel) ToNetlink() interface{} {
+// parses a rule prefix, `all` (or an empty value) matches every address.
+func parseRulePrefix(value string) (*net.IPNet, error) {
+	if value == "" || value == "all" {
+		return nil, nil
+	}
+	_, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CIDR of (%s)", value)
+	}
+	return ipnet, nil
+}
+
+// parses `start-end` or a single `value` (same start and end) range.
+func parseRange(value string, bitSize int) (uint64, uint64, error) {
+	startStr, endStr, found := strings.Cut(value, "-")
+	if !found {
+		endStr = startStr
+	}
+	start, err := strconv.ParseUint(strings.TrimSpace(startStr), 10, bitSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range (%s): %w", value, err)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(endStr), 10, bitSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range (%s): %w", value, err)
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid range (%s): start is bigger than end", value)
+	}
+	return start, end, nil
+}
+
+func (r *RuleModel) ToNetlink() (interface{}, error) {
+	return r.toNetlink(nodeResolver{})
+}
+
+func (r *RuleModel) toNetlink(res resolver) (interface{}, error) {
+	var err error
 	rule := netlink.NewRule()
-	rule.Table = r.Table
+	if rule.Table, err = res.tableID(r.Table); err != nil {
+		return nil, err
+	}
 
-	if _, ipnet, err := net.ParseCIDR(r.From); err != nil {
-		// Handle the Error!
-	} else {
-		rule.Src = ipnet
+	// add `Priority` to rule (the kernel picks one when it's not defined)
+	if r.Priority != nil {
+		if *r.Priority < 0 {
+			return nil, fieldErrorf("priority", "priority %d is negative", *r.Priority)
+		}
+		rule.Priority = *r.Priority
 	}
+	rule.Invert = r.Not
+	rule.Tos = r.Tos
+	rule.IifName = r.Iif
+	rule.OifName = r.Oif
 
-	return rule
+	// add `Src`, `Dst` and `Family` to rule
+	if rule.Src, err = parseRulePrefix(r.From); err != nil {
+		return nil, fieldErrorf("from", "%w", err)
+	}
+	if rule.Dst, err = parseRulePrefix(r.To); err != nil {
+		return nil, fieldErrorf("to", "%w", err)
+	}
+	if rule.Family, err = r.family(rule.Src, rule.Dst); err != nil {
+		return nil, err
+	}
+
+	if r.FwMark != "" {
+		if rule.Mark, rule.Mask, err = parseFwMark(r.FwMark); err != nil {
+			return nil, err
+		}
+	}
+	if r.Tos > MAX_RULE_TOS {
+		return nil, fieldErrorf("tos", "tos %d must be between 0 and %d", r.Tos, MAX_RULE_TOS)
+	}
+	if r.IPProto != "" {
+		if rule.IPProto, err = parseIPProto(r.IPProto); err != nil {
+			return nil, err
+		}
+	}
+
+	// handle port and uid ranges
+	if r.Sport != "" {
+		start, end, err := parseRange(r.Sport, 16)
+		if err != nil {
+			return nil, fieldErrorf("sport", "%w", err)
+		}
+		rule.Sport = netlink.NewRulePortRange(uint16(start), uint16(end))
+	}
+	if r.Dport != "" {
+		start, end, err := parseRange(r.Dport, 16)
+		if err != nil {
+			return nil, fieldErrorf("dport", "%w", err)
+		}
+		rule.Dport = netlink.NewRulePortRange(uint16(start), uint16(end))
+	}
+	if r.UIDRange != "" {
+		start, end, err := parseRange(r.UIDRange, 32)
+		if err != nil {
+			return nil, fieldErrorf("uidrange", "%w", err)
+		}
+		rule.UIDRange = netlink.NewRuleUIDRange(uint32(start), uint32(end))
+	}
+
+	action, err := r.action(rule.Table)
+	if err != nil {
+		return nil, err
+	}
+	rule.Type = uint8(utils.RuleActions[action])
+	if action == "goto" {
+		rule.Goto = r.Goto
+	}
+	if r.SuppressPrefixLength != nil {
+		rule.SuppressPrefixlen = *r.SuppressPrefixLength
+	}
+	if r.SuppressIfGroup != nil {
+		rule.SuppressIfgroup = *r.SuppressIfGroup
+	}
+
+	return rule, nil
+}
+
+// Parses a fwmark (`mark` or `mark/mask`), the kernel reports a full mask when it's not defined. Like `ip rule`,
+// the mark 0 without a mask matches every packet: the kernel reports such a rule without a mark, so it has no mask.
+func parseFwMark(value string) (uint32, *uint32, error) {
+	markStr, maskStr, found := strings.Cut(value, "/")
+	mark, err := strconv.ParseUint(markStr, 0, 32)
+	if err != nil {
+		return 0, nil, fieldErrorf("fwmark", "invalid fwmark (%s): %w", value, err)
+	}
+	mask := uint64(0xffffffff)
+	if found {
+		if mask, err = strconv.ParseUint(maskStr, 0, 32); err != nil {
+			return 0, nil, fieldErrorf("fwmark", "invalid fwmark mask (%s): %w", value, err)
+		}
+	}
+	if mark == 0 && (!found || mask == 0) {
+		return 0, nil, nil
+	}
+	mask32 := uint32(mask)
+	return uint32(mark), &mask32, nil
+}
+
+// parses an IP protocol given by name or number
+func parseIPProto(value string) (int, error) {
+	if id, exists := utils.IPProtocols[value]; exists {
+		return id, nil
+	}
+	if id, err := strconv.ParseUint(value, 10, 8); err == nil {
+		return int(id), nil
+	}
+	return 0, fieldErrorf("ipproto", "IP protocol '%s' does not exist", value)
+}
+
+// returns the action of the rule (`ip rule` looks up a table when it's not defined), and checks that the table,
+// l3mdev, goto and the suppressors go with it. table is the id of the table of the rule, 0 when it has none (and
+// negative when it has one which is unknown).
+func (r *RuleModel) action(table int) (string, error) {
+	action := r.Action
+	if action == "" {
+		action = "table"
+	}
+	if _, exists := utils.RuleActions[action]; !exists {
+		return "", fieldErrorf("action", "rule action '%s' does not exist", r.Action)
+	}
+	if action == "table" {
+		// l3mdev rules get their table from the l3mdev device, so a rule without table is an l3mdev rule
+		if r.L3mdev && table != 0 {
+			return "", fieldErrorf("l3mdev", "rule can not have both l3mdev and table")
+		} else if !r.L3mdev && table == 0 {
+			return "", fieldErrorf("table", "rule has no table")
+		}
+	} else if table != 0 || r.L3mdev {
+		return "", fieldErrorf("action", "rule with action '%s' can not have a table or l3mdev", action)
+	}
+
+	if action == "goto" {
+		if r.Goto <= 0 || (r.Priority != nil && r.Goto <= *r.Priority) {
+			return "", fieldErrorf("goto", "rule must goto a priority after its own")
+		}
+	} else if r.Goto != 0 {
+		return "", fieldErrorf("goto", "rule can not have goto with action '%s'", action)
+	}
+
+	// the suppressors only apply to table lookups
+	if r.SuppressPrefixLength != nil || r.SuppressIfGroup != nil {
+		if action != "table" || r.L3mdev {
+			return "", fieldErrorf("action", "rule can only have suppressors with action 'table'")
+		}
+		// netlink only passes the suppressors along for tables that fit in the rule header
+		if table >= 256 {
+			return "", fieldErrorf("table", "rule can only have suppressors with tables below 256")
+		}
+	}
+	return action, nil
+}
+
+// Checks the selectors and the action of the rule like its conversion does, each field on its own so that all
+// their errors are reported. table is the id of the table of the rule like for action.
+func (r *RuleModel) validate(table int) []error {
+	errs := []error{}
+	if r.Priority != nil && *r.Priority < 0 {
+		errs = append(errs, fieldErrorf("priority", "priority %d is negative", *r.Priority))
+	}
+	if r.FwMark != "" {
+		if _, _, err := parseFwMark(r.FwMark); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if r.Tos > MAX_RULE_TOS {
+		errs = append(errs, fieldErrorf("tos", "tos %d must be between 0 and %d", r.Tos, MAX_RULE_TOS))
+	}
+	if r.IPProto != "" {
+		if _, err := parseIPProto(r.IPProto); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, ruleRange := range []struct {
+		field   string
+		value   string
+		bitSize int
+	}{{"sport", r.Sport, 16}, {"dport", r.Dport, 16}, {"uidrange", r.UIDRange, 32}} {
+		if ruleRange.value == "" {
+			continue
+		}
+		if _, _, err := parseRange(ruleRange.value, ruleRange.bitSize); err != nil {
+			errs = append(errs, fieldErrorf(ruleRange.field, "%w", err))
+		}
+	}
+	if _, err := r.action(table); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
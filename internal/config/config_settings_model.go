@@ -1,11 +1,22 @@
 package config
 
 type SettingsModel struct {
-	TableHardSync []int `yaml:"table-hard-sync"`
+	TableHardSync     []string `yaml:"table-hard-sync"`
+	RulePriorityRange string   `yaml:"rule-priority-range"`
+	RouteProtocol     string   `yaml:"route-protocol"`
+	VlanAlias         string   `yaml:"vlan-alias"`
+	OwnedOnly         bool     `yaml:"owned-only"`
+	// the links whose addresses are hard-synced
+	AddressHardSync []string `yaml:"address-hard-sync"`
 }
 
 func (s *SettingsModel) IsEmpty() bool {
-	if len(s.TableHardSync) == 0 {
+	if len(s.TableHardSync) == 0 &&
+		s.RulePriorityRange == "" &&
+		s.RouteProtocol == "" &&
+		s.VlanAlias == "" &&
+		!s.OwnedOnly &&
+		len(s.AddressHardSync) == 0 {
 		return true
 	}
 	return false
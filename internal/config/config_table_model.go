@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/plutocholia/ipruler/internal/utils"
+)
+
+type TableModel struct {
+	Name string `yaml:"name"`
+	ID   int    `yaml:"id"`
+}
+
+func (t *TableModel) IsEmpty() bool {
+	if t.Name == "" && t.ID == 0 {
+		return true
+	}
+	return false
+}
+
+func (t *TableModel) String() string {
+	return fmt.Sprintf("name: %s - id: %d", t.Name, t.ID)
+}
+
+// resolves a table given by id or by name (from rt_tables, rt_tables.d or the `tables` section), an empty table is 0.
+func getTableID(table string) (int, error) {
+	if table == "" {
+		return 0, nil
+	}
+	id, exists := utils.GetTableID(table)
+	if !exists {
+		return 0, fieldErrorf("table", "table '%s' is neither an id nor a name in rt_tables or the tables section", table)
+	}
+	return id, nil
+}
+
+func validateTable(t *TableModel) error {
+	if _, err := strconv.Atoi(t.Name); err == nil || t.Name == "" {
+		return fieldErrorf("name", "table must have a non-numeric name")
+	}
+	if _, reserved := utils.ReservedRouteTables[t.Name]; reserved {
+		return fieldErrorf("name", "table name '%s' is reserved", t.Name)
+	}
+	if t.ID <= 0 || int64(t.ID) > 0xffffffff || t.ID == utils.ReservedRouteTables["default"] ||
+		t.ID == utils.ReservedRouteTables["main"] || t.ID == utils.ReservedRouteTables["local"] {
+		return fieldErrorf("id", "table must have a non-reserved id between 1 and 4294967295")
+	}
+	return nil
+}
@@ -0,0 +1,520 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/plutocholia/ipruler/internal/utils"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func toRule(t *testing.T, model *RuleModel) *netlink.Rule {
+	t.Helper()
+	rule, err := model.ToNetlink()
+	if err != nil {
+		t.Fatalf("rule (%s): %s", model.String(), err)
+	}
+	return rule.(*netlink.Rule)
+}
+
+func toRoute(t *testing.T, model *RouteModel) *netlink.Route {
+	t.Helper()
+	route, err := model.ToNetlink()
+	if err != nil {
+		t.Fatalf("route (%s): %s", model.String(), err)
+	}
+	return route.(*netlink.Route)
+}
+
+func TestRuleModel_Family(t *testing.T) {
+	cases := map[string]int{
+		"172.31.201.11/32": netlink.FAMILY_V4,
+		"2001:db8::/64":    netlink.FAMILY_V6,
+	}
+	for from, family := range cases {
+		model := RuleModel{From: from, Table: "101"}
+		rule := toRule(t, &model)
+		if rule.Family != family {
+			t.Errorf("rule from %s: expected family %d, got %d", from, family, rule.Family)
+		}
+		if rule.Src.String() != from {
+			t.Errorf("rule from %s: unexpected src %s", from, rule.Src)
+		}
+	}
+}
+
+// a rule which only selects on other selectors than from and to gets its family from `family`
+func TestRuleModel_ExplicitFamily(t *testing.T) {
+	rule := toRule(t, &RuleModel{Iif: "lo", FwMark: "0x10", Family: "inet6", Table: "101"})
+	if rule.Family != netlink.FAMILY_V6 {
+		t.Errorf("selector-only inet6 rule: expected family %d, got %d", netlink.FAMILY_V6, rule.Family)
+	}
+
+	priority := 1000
+	config, err := CreateConfig(&ConfigModel{Rules: []RuleModel{{Oif: "lo", Family: "all", Table: "101", Priority: &priority}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Rules) != 2 || config.Rules[0].Family != netlink.FAMILY_V4 || config.Rules[1].Family != netlink.FAMILY_V6 {
+		t.Errorf("rule of all families: expected a rule for each family, got %v", config.Rules)
+	}
+
+	for _, model := range []RuleModel{
+		{From: "10.0.0.0/8", Family: "inet6", Table: "101"},
+		{To: "2001:db8::/64", Family: "all", Table: "101"},
+		{Iif: "lo", Family: "ipx", Table: "101"},
+	} {
+		_, err := model.ToNetlink()
+		if fieldErr, ok := err.(*FieldError); !ok || fieldErr.Field != "family" {
+			t.Errorf("%s: got %v, want an error of family", model.String(), err)
+		}
+	}
+}
+
+func TestRuleModel_Priority(t *testing.T) {
+	zero := 0
+	if rule := toRule(t, &RuleModel{Priority: &zero, Iif: "lo", Table: "101"}); rule.Priority != 0 {
+		t.Errorf("rule of priority 0: got priority %d", rule.Priority)
+	}
+	if rule := toRule(t, &RuleModel{Iif: "lo", Table: "101"}); rule.Priority != -1 {
+		t.Errorf("rule without priority: got priority %d, want the kernel to pick one", rule.Priority)
+	}
+
+	// with owned-only, the rules of the config have to be in the owned priority range
+	data := `
+settings:
+  owned-only: true
+  route-protocol: static
+  vlan-alias: ipruler
+  rule-priority-range: 1000-1999
+rules:
+- from: 10.0.0.0/24
+  table: 101
+  priority: 1000
+- from: 10.0.1.0/24
+  table: 101
+  priority: 2000
+- from: 10.0.2.0/24
+  table: 101
+`
+	configModel, err := CreateConfigModel([]byte(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, e := range FlattenErrors(configModel.Validate()) {
+		if fieldErr, ok := e.(*FieldError); ok {
+			paths = append(paths, fmt.Sprintf("%s:%d", fieldErr.Path(), fieldErr.Line))
+		}
+	}
+	if len(paths) != 2 || paths[0] != "rules[1].priority:13" || paths[1] != "rules[2].priority:14" {
+		t.Errorf("unexpected errors %v", paths)
+	}
+}
+
+// with owned-only, a route can only have the protocol of the agent, which tags it as owned
+func TestConfigModel_ValidateOwnedRouteProtocol(t *testing.T) {
+	data := `
+settings:
+  owned-only: true
+  route-protocol: 200
+  vlan-alias: ipruler
+  rule-priority-range: 1000-1999
+routes:
+- to: 10.0.0.0/24
+  dev: lo
+  protocol: "200"
+- to: 10.0.1.0/24
+  dev: lo
+  protocol: static
+- to: 10.0.2.0/24
+  dev: lo
+`
+	configModel, err := CreateConfigModel([]byte(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := FlattenErrors(configModel.Validate())
+	if len(errs) != 1 {
+		t.Fatalf("expected an error, got %v", errs)
+	}
+	if fieldErr, ok := errs[0].(*FieldError); !ok || fieldErr.Path() != "routes[1].protocol" {
+		t.Errorf("unexpected error (%s)", errs[0])
+	}
+}
+
+func TestRouteModel_Family(t *testing.T) {
+	cases := []struct {
+		model  RouteModel
+		family int
+		dst    string
+	}{
+		{RouteModel{To: "default", Dev: "lo"}, netlink.FAMILY_V4, "0.0.0.0/0"},
+		{RouteModel{To: "::/0", Dev: "lo"}, netlink.FAMILY_V6, "::/0"},
+		{RouteModel{To: "default", Via: "fe80::1", Dev: "lo"}, netlink.FAMILY_V6, "::/0"},
+		{RouteModel{To: "2001:db8::/64", Dev: "lo"}, netlink.FAMILY_V6, "2001:db8::/64"},
+	}
+	for _, c := range cases {
+		route := toRoute(t, &c.model)
+		if route.Family != c.family {
+			t.Errorf("route (%s): expected family %d, got %d", c.model.String(), c.family, route.Family)
+		}
+		if route.Dst.String() != c.dst {
+			t.Errorf("route (%s): expected dst %s, got %s", c.model.String(), c.dst, route.Dst)
+		}
+		if c.family == netlink.FAMILY_V6 && route.Priority != IPV6_DEFAULT_ROUTE_METRIC {
+			t.Errorf("route (%s): expected the default IPv6 metric, got %d", c.model.String(), route.Priority)
+		}
+	}
+}
+
+func TestRuleModel_Selectors(t *testing.T) {
+	model := RuleModel{FwMark: "0x10", Iif: "eth0", IPProto: "udp", Dport: "53", UIDRange: "1000-2000", Not: true, Table: "101"}
+	rule := toRule(t, &model)
+	if rule.Mark != 0x10 || rule.Mask == nil || *rule.Mask != 0xffffffff {
+		t.Errorf("unexpected fwmark %d/%v", rule.Mark, rule.Mask)
+	}
+	if rule.IPProto != 17 || rule.IifName != "eth0" || !rule.Invert {
+		t.Errorf("unexpected selectors in (%s)", rule)
+	}
+	if *rule.Dport != *netlink.NewRulePortRange(53, 53) || *rule.UIDRange != *netlink.NewRuleUIDRange(1000, 2000) {
+		t.Errorf("unexpected ranges %v %v", rule.Dport, rule.UIDRange)
+	}
+	if rule.Family != netlink.FAMILY_V4 {
+		t.Errorf("expected rules without prefixes to be IPv4, got %d", rule.Family)
+	}
+}
+
+// the mark 0 without a mask (or with the mask 0) matches every packet, it's the rule the kernel reports without a
+// mark
+func TestRuleModel_FwMarkZero(t *testing.T) {
+	mask := func(m uint32) *uint32 { return &m }
+	cases := []struct {
+		fwmark string
+		mark   uint32
+		mask   *uint32
+	}{
+		{"0", 0, nil},
+		{"0x0/0", 0, nil},
+		{"0/0xff", 0, mask(0xff)},
+		{"0x10", 0x10, mask(0xffffffff)},
+	}
+	for _, c := range cases {
+		rule := toRule(t, &RuleModel{FwMark: c.fwmark, Table: "101"})
+		if rule.Mark != c.mark || (rule.Mask == nil) != (c.mask == nil) || (c.mask != nil && *rule.Mask != *c.mask) {
+			t.Errorf("fwmark %s: got %d/%v, want %d/%v", c.fwmark, rule.Mark, rule.Mask, c.mark, c.mask)
+		}
+	}
+
+	// the kernel reports the rule without a mark
+	rule := toRule(t, &RuleModel{FwMark: "0", Table: "101"})
+	kernelRule := *toRule(t, &RuleModel{Table: "101"})
+	if !utils.RuleEquality(rule, &kernelRule) {
+		t.Errorf("rule with fwmark 0 (%s) differs from the one the kernel reports", rule)
+	}
+}
+
+func TestRouteModel_Metric(t *testing.T) {
+	model := RouteModel{To: "2001:db8::/64", Dev: "lo", Metric: 10, MTU: 1400, Src: "2001:db8::1"}
+	route := toRoute(t, &model)
+	if route.Priority != 10 || route.MTU != 1400 || route.Src.String() != "2001:db8::1" {
+		t.Errorf("unexpected attributes in route (%s)", route)
+	}
+}
+
+func TestRouteModel_Type(t *testing.T) {
+	blackhole := toRoute(t, &RouteModel{To: "default", Type: "blackhole", Table: "102"})
+	if blackhole.Type != unix.RTN_BLACKHOLE || blackhole.LinkIndex != 0 || blackhole.Dst.String() != "0.0.0.0/0" {
+		t.Errorf("unexpected blackhole route (%s)", blackhole)
+	}
+	local := toRoute(t, &RouteModel{To: "10.0.0.1/32", Type: "local", Dev: "lo"})
+	if local.Table != unix.RT_TABLE_LOCAL || local.Scope != unix.RT_SCOPE_HOST {
+		t.Errorf("unexpected local route (%s)", local)
+	}
+	unicast := toRoute(t, &RouteModel{To: "10.0.0.0/24", Dev: "lo"})
+	if unicast.Table != unix.RT_TABLE_MAIN {
+		t.Errorf("unexpected table of unicast route (%s)", unicast)
+	}
+}
+
+func TestAddressModel(t *testing.T) {
+	res, err := (&AddressModel{Dev: "lo", CIDR: "10.0.0.1/32", Peer: "10.0.0.2/30", ValidLft: "60", NoPrefixRoute: true}).ToNetlink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := res.(*netlink.Addr)
+	if addr.Label != "lo" || addr.Peer.String() != "10.0.0.2/30" || addr.ValidLft != 60 || addr.PreferedLft != 60 ||
+		addr.Flags&unix.IFA_F_NOPREFIXROUTE == 0 {
+		t.Errorf("unexpected address (%s)", utils.AddrToString(addr))
+	}
+
+	tests := []struct {
+		model AddressModel
+		field string
+	}{
+		{AddressModel{Dev: "lo", CIDR: "10.0.0.1"}, "cidr"},
+		{AddressModel{CIDR: "10.0.0.1/24"}, "dev"},
+		{AddressModel{Dev: "lo", CIDR: "10.0.0.1/24", Label: "eth0:1"}, "label"},
+		{AddressModel{Dev: "lo", CIDR: "2001:db8::1/64", Label: "lo:1"}, "label"},
+		{AddressModel{Dev: "lo", CIDR: "2001:db8::1/64", Scope: "link"}, "scope"},
+		{AddressModel{Dev: "lo", CIDR: "10.0.0.1/24", Peer: "10.0.0.2"}, "cidr"},
+		{AddressModel{Dev: "lo", CIDR: "10.0.0.1/32", Peer: "2001:db8::2"}, "peer"},
+		{AddressModel{Dev: "lo", CIDR: "10.0.0.1/24", ValidLft: "60", PreferredLft: "120"}, "preferred-lft"},
+		{AddressModel{Dev: "lo", CIDR: "10.0.0.1/24", ValidLft: "-1"}, "valid-lft"},
+	}
+	for _, test := range tests {
+		_, err := test.model.ToNetlink()
+		if fieldErr, ok := err.(*FieldError); !ok || fieldErr.Field != test.field {
+			t.Errorf("%s: got %v, want an error of %s", test.model.String(), err, test.field)
+		}
+	}
+}
+
+func TestVlanModel(t *testing.T) {
+	txQLen := 500
+	res, err := (&VlanModel{Name: "lo.10", Link: "lo", ID: 10, MTU: 1400, MAC: "02:00:00:00:00:10", TxQLen: &txQLen,
+		EgressQosMap: map[uint32]uint32{1: 2, 3: 0}, Gvrp: true, State: "down"}).ToNetlink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vlan := res.(*netlink.Vlan)
+	if vlan.MTU != 1400 || vlan.HardwareAddr.String() != "02:00:00:00:00:10" || vlan.TxQLen != 500 ||
+		len(vlan.EgressQosMap) != 1 || vlan.IngressQosMap == nil || !*vlan.Gvrp || *vlan.Mvrp || vlan.Flags&net.FlagUp != 0 {
+		t.Errorf("unexpected vlan (%s)", utils.VlanToString(vlan))
+	}
+
+	negative := -1
+	tests := []struct {
+		model VlanModel
+		field string
+	}{
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, MTU: 40}, "mtu"},
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, MAC: "02:00:00:00:00"}, "mac"},
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, MAC: "01:00:5e:00:00:01"}, "mac"},
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, TxQLen: &negative}, "txqlen"},
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, IngressQosMap: map[uint32]uint32{8: 1}}, "ingress-qos-map"},
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, EgressQosMap: map[uint32]uint32{1: 8}}, "egress-qos-map"},
+		{VlanModel{Name: "lo.10", Link: "lo", ID: 10, State: "dormant"}, "state"},
+	}
+	for _, test := range tests {
+		_, err := test.model.ToNetlink()
+		if fieldErr, ok := err.(*FieldError); !ok || fieldErr.Field != test.field {
+			t.Errorf("%s: got %v, want an error of %s", test.model.String(), err, test.field)
+		}
+	}
+}
+
+func TestCreateConfig_Errors(t *testing.T) {
+	model := &ConfigModel{
+		Routes: []RouteModel{
+			{To: "10.0.0.0/24", Dev: "lo"},
+			{To: "10.0.1.0/24", Via: "10.0.0.x", Dev: "lo"},
+			{To: "10.0.2.0/24", Nexthops: []NexthopModel{{Dev: "lo", Weight: 300}}},
+		},
+	}
+	_, err := CreateConfig(model)
+	if err == nil {
+		t.Fatal("expected an error for the invalid routes")
+	}
+	paths := []string{}
+	for _, e := range FlattenErrors(err) {
+		fieldErr, ok := e.(*FieldError)
+		if !ok {
+			t.Fatalf("expected a field error, got %T (%s)", e, e)
+		}
+		paths = append(paths, fieldErr.Path())
+	}
+	if len(paths) != 2 || paths[0] != "routes[1].via" || paths[1] != "routes[2].nexthops[0].weight" {
+		t.Errorf("unexpected error paths %v", paths)
+	}
+
+	if _, err := CreateConfigModel([]byte("routes: ["), true); err == nil {
+		t.Error("expected a parse error")
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Errorf("expected a parse error, got %T (%s)", err, err)
+	}
+}
+
+func TestFlattenErrors(t *testing.T) {
+	inner := JoinErrors([]error{fieldErrorf("via", "a"), fieldErrorf("dev", "b")})
+	err := errors.Join(inner, JoinErrors([]error{fieldErrorf("to", "c")}), errors.New("d"))
+	if errs := FlattenErrors(err); len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %d (%v)", len(errs), errs)
+	}
+	if errs := FlattenErrors(fieldErrorf("via", "a")); len(errs) != 1 {
+		t.Errorf("expected a single error, got %v", errs)
+	}
+}
+
+func TestConfigModel_Validate(t *testing.T) {
+	data := `
+settings:
+  table-hard-sync: ["101", "102"]
+vlans:
+- name: lo.10
+  link: lo
+  id: 10
+- name: lo.11
+  link: lo
+  id: 10
+rules:
+- from: 10.0.0.1
+  table: "101"
+addresses:
+- dev: lo.10
+  cidr: 10.0.0.1/24
+- dev: lo.10
+  cidr: 10.0.0.1/16
+- dev: lo0
+  cidr: 10.0.0.2/24
+`
+	configModel, err := CreateConfigModel([]byte(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]int{
+		"vlans[1].id":                 {10, 7},
+		"rules[0].from":               {12, 9},
+		"settings.table-hard-sync[1]": {3, 28},
+		"addresses[1].cidr":           {18, 9},
+		"addresses[2].dev":            {19, 8},
+	}
+	errs := FlattenErrors(configModel.Validate())
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for _, e := range errs {
+		fieldErr, ok := e.(*FieldError)
+		if !ok {
+			t.Fatalf("expected a field error, got %T (%s)", e, e)
+		}
+		if position, exists := expected[fieldErr.Path()]; !exists || position != [2]int{fieldErr.Line, fieldErr.Column} {
+			t.Errorf("unexpected error (%s)", fieldErr)
+		}
+	}
+}
+
+// the selectors and the action of the rules are checked with their position, before anything is converted
+func TestConfigModel_ValidateRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		path string
+		// the position of the field, in the rule below `- table: "101"`
+		line, column int
+	}{
+		{"fwmark", "fwmark: 0xzz", "rules[0].fwmark", 4, 11},
+		{"fwmark mask", "fwmark: 0x10/mask", "rules[0].fwmark", 4, 11},
+		{"tos", "tos: 256", "rules[0].tos", 4, 8},
+		{"sport", "sport: 2000-1000", "rules[0].sport", 4, 10},
+		{"dport", "dport: 70000", "rules[0].dport", 4, 10},
+		{"uidrange", "uidrange: 0-x", "rules[0].uidrange", 4, 13},
+		{"ipproto", "ipproto: xtp", "rules[0].ipproto", 4, 12},
+		{"action", "action: drop", "rules[0].action", 4, 11},
+		{"action with table", "action: blackhole", "rules[0].action", 4, 11},
+		{"goto without action", "goto: 2000", "rules[0].goto", 4, 9},
+		{"goto before the rule", "priority: 3000\n  action: goto\n  goto: 2000", "rules[0].goto", 6, 9},
+		{"l3mdev with table", "l3mdev: true", "rules[0].l3mdev", 4, 11},
+		{"suppressor of another action", "action: goto\n  goto: 100\n  suppress-prefixlength: 0", "rules[0].action", 4, 11},
+		{"priority", "priority: -1", "rules[0].priority", 4, 13},
+	}
+	for _, test := range tests {
+		data := "\nrules:\n- table: \"101\"\n  " + test.rule + "\n"
+		// the actions without a table have no table
+		if strings.Contains(test.rule, "action: goto") {
+			data = strings.Replace(data, "- table: \"101\"", "- from: all", 1)
+		}
+		configModel, err := CreateConfigModel([]byte(data), true)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		errs := FlattenErrors(configModel.Validate())
+		if len(errs) != 1 {
+			t.Errorf("%s: expected an error, got %v", test.name, errs)
+			continue
+		}
+		fieldErr, ok := errs[0].(*FieldError)
+		if !ok || fieldErr.Path() != test.path || fieldErr.Line != test.line || fieldErr.Column != test.column {
+			t.Errorf("%s: got %v, want an error of %s at %d:%d", test.name, errs[0], test.path, test.line, test.column)
+		}
+	}
+}
+
+func TestConfigModel_Namespaces(t *testing.T) {
+	data := `
+namespace: blue
+routes:
+- to: 10.0.0.0/24
+  dev: lo
+- to: 10.0.1.0/24
+  dev: lo
+  namespace: green
+- to: 10.0.2.0/24
+  dev: lo
+  via: 10.0.0.x
+  namespace: green
+`
+	configModel, err := CreateConfigModel([]byte(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := configModel.Namespaces()
+	if len(models) != 2 || len(models["blue"].Routes) != 1 || len(models["green"].Routes) != 2 {
+		t.Fatalf("unexpected parts %v", models)
+	}
+	if models["green"].Namespace != "green" || models["green"].Routes[0].To != "10.0.1.0/24" {
+		t.Errorf("unexpected part of green (%s)", models["green"])
+	}
+
+	// the error of a part is located in the whole config
+	err = models["green"].Locate(itemError(fieldErrorf("via", "invalid"), "routes", 1))
+	if fieldErr := err.(*FieldError); fieldErr.Path() != "routes[2].via" || fieldErr.Line != 11 {
+		t.Errorf("unexpected error (%s)", fieldErr)
+	}
+
+	// the namespaces don't exist
+	expected := map[string]bool{"namespace": true, "routes[1].namespace": true, "routes[2].namespace": true}
+	errs := FlattenErrors(configModel.Validate())
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for _, e := range errs {
+		if fieldErr, ok := e.(*FieldError); !ok || !expected[fieldErr.Path()] {
+			t.Errorf("unexpected error (%s)", e)
+		}
+	}
+}
+
+func TestCreateConfigModel_Strict(t *testing.T) {
+	data := `
+routes:
+- to: 10.0.0.0/24
+  dev: lo
+  on_link: true
+rules:
+- from: 10.0.0.1/32
+  tabel: "101"
+`
+	if _, err := CreateConfigModel([]byte(data), false); err != nil {
+		t.Errorf("unexpected error in non-strict mode: %s", err)
+	}
+	_, err := CreateConfigModel([]byte(data), true)
+	errs := FlattenErrors(err)
+	expected := []string{
+		"line 5, column 3: routes[0].on_link: unknown field 'on_link', did you mean 'on-link'?",
+		"line 8, column 3: rules[0].tabel: unknown field 'tabel', did you mean 'table'?",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected error (%s), got (%s)", expected[i], err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// Validates the config before anything is synced, and reports every problem found with its position in the YAML.
+// It only reads the state of the node (links and routes to the gateways), in the namespace of each item.
+func (c *ConfigModel) Validate() error {
+	errs := []error{}
+
+	// the items of a namespace which can't be opened are not checked against the node
+	handles := make(map[string]utils.NetlinkHandle)
+	namespaceErrs := make(map[string]error)
+	handle := func(namespace string) (utils.NetlinkHandle, error) {
+		if namespace == "" {
+			namespace = c.Namespace
+		}
+		if _, exists := handles[namespace]; !exists && namespaceErrs[namespace] == nil {
+			handles[namespace], namespaceErrs[namespace] = utils.NamespaceNetlink(namespace)
+		}
+		return handles[namespace], namespaceErrs[namespace]
+	}
+	if _, err := handle(""); err != nil {
+		errs = append(errs, &FieldError{Index: -1, Field: "namespace", Err: err})
+	}
+	// the namespace error of an item is reported when it's the item's own namespace
+	itemHandle := func(namespace string, section string, index int) utils.NetlinkHandle {
+		h, err := handle(namespace)
+		if err != nil && namespace != "" && namespace != c.Namespace {
+			errs = append(errs, itemError(fieldErrorf("namespace", "%w", err), section, index))
+		}
+		return h
+	}
+
+	// links that don't exist yet can be the vlans of the same config, in the same namespace
+	vlanNames := make(map[string]map[string]bool)
+	for _, vlan := range c.Vlans {
+		namespace := cmp.Or(vlan.Namespace, c.Namespace)
+		if vlanNames[namespace] == nil {
+			vlanNames[namespace] = make(map[string]bool)
+		}
+		vlanNames[namespace][vlan.Name] = true
+	}
+	linkExists := func(h utils.NetlinkHandle, namespace string) func(string) bool {
+		return func(name string) bool {
+			if vlanNames[cmp.Or(namespace, c.Namespace)][name] {
+				return true
+			}
+			_, err := h.LinkByName(name)
+			return err == nil
+		}
+	}
+	// tables of the `tables` section are not in rt_tables.d until they are synced
+	tableIDs := make(map[string]int)
+	for _, table := range c.Tables {
+		tableIDs[table.Name] = table.ID
+	}
+	resolveTable := func(table string) (int, bool) {
+		if id, exists := tableIDs[table]; exists {
+			return id, true
+		}
+		return utils.GetTableID(table)
+	}
+	referencedTables := make(map[int]bool)
+	// with owned-only, the rules of the config are recognised as owned by their priority
+	var ownedPriorities *PriorityRange
+	if c.Settings.OwnedOnly && c.Settings.RulePriorityRange != "" {
+		if start, end, err := parseRange(c.Settings.RulePriorityRange, 32); err == nil {
+			ownedPriorities = &PriorityRange{Start: int(start), End: int(end)}
+		}
+	}
+
+	for i, vlan := range c.Vlans {
+		for j := 0; j < i; j++ {
+			if cmp.Or(c.Vlans[j].Namespace, c.Namespace) != cmp.Or(vlan.Namespace, c.Namespace) {
+				continue
+			}
+			if c.Vlans[j].Name == vlan.Name {
+				errs = append(errs, itemError(fieldErrorf("name", "vlan %s is already defined in vlans[%d]", vlan.Name, j), "vlans", i))
+			} else if c.Vlans[j].Link == vlan.Link && c.Vlans[j].ID == vlan.ID {
+				errs = append(errs, itemError(fieldErrorf("id", "vlan id %d of link %s is already defined in vlans[%d]", vlan.ID, vlan.Link, j), "vlans", i))
+			}
+		}
+		if vlan.ID <= 0 || vlan.ID >= 4095 {
+			errs = append(errs, itemError(fieldErrorf("id", "vlan id %d must be between 1 and 4094", vlan.ID), "vlans", i))
+		}
+		if err := vlan.setAttributes(&netlink.Vlan{}); err != nil {
+			errs = append(errs, itemError(err, "vlans", i))
+		}
+		h := itemHandle(vlan.Namespace, "vlans", i)
+		if h == nil {
+			continue
+		}
+		if !linkExists(h, vlan.Namespace)(vlan.Link) {
+			errs = append(errs, itemError(fieldErrorf("link", "link %s does not exist", vlan.Link), "vlans", i))
+		} else if parent, err := h.LinkByName(vlan.Link); err == nil && vlan.MTU > parent.Attrs().MTU {
+			// the kernel rejects a vlan larger than its link
+			errs = append(errs, itemError(fieldErrorf("mtu", "mtu %d is larger than the mtu %d of link %s", vlan.MTU, parent.Attrs().MTU, vlan.Link), "vlans", i))
+		}
+	}
+
+	for i, address := range c.Addresses {
+		namespace := cmp.Or(address.Namespace, c.Namespace)
+		exists := func(string) bool { return true }
+		if h := itemHandle(address.Namespace, "addresses", i); h != nil {
+			exists = linkExists(h, address.Namespace)
+		}
+		for _, err := range address.validate(exists) {
+			errs = append(errs, itemError(err, "addresses", i))
+		}
+		ip, _, err := net.ParseCIDR(address.CIDR)
+		if err != nil {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			other, _, _ := net.ParseCIDR(c.Addresses[j].CIDR)
+			if cmp.Or(c.Addresses[j].Namespace, c.Namespace) == namespace && c.Addresses[j].Dev == address.Dev && ip.Equal(other) {
+				errs = append(errs, itemError(fieldErrorf("cidr", "address %s of dev %s is already defined in addresses[%d]", ip, address.Dev, j), "addresses", i))
+				break
+			}
+		}
+	}
+
+	for i, route := range c.Routes {
+		// with owned-only, the routes of the config are recognised as owned by the protocol of the agent
+		if c.Settings.OwnedOnly && route.Protocol != "" && c.Settings.RouteProtocol != "" {
+			protocol, exists := utils.GetRouteProtocol(route.Protocol)
+			owned, _ := utils.GetRouteProtocol(c.Settings.RouteProtocol)
+			if exists && protocol != owned {
+				errs = append(errs, itemError(fieldErrorf("protocol", "route protocol %s is not the route-protocol %s of owned-only, the route would not be removed once it leaves the config", route.Protocol, c.Settings.RouteProtocol), "routes", i))
+			}
+		}
+		if h := itemHandle(route.Namespace, "routes", i); h != nil {
+			for _, err := range route.validate(h, linkExists(h, route.Namespace), vlanNames[cmp.Or(route.Namespace, c.Namespace)]) {
+				errs = append(errs, itemError(err, "routes", i))
+			}
+		}
+		id, exists := 0, true
+		if route.Table != "" {
+			id, exists = resolveTable(route.Table)
+		} else if route.Type == "local" || route.Type == "broadcast" || route.Type == "anycast" {
+			id = unix.RT_TABLE_LOCAL
+		} else {
+			id = unix.RT_TABLE_MAIN
+		}
+		if !exists {
+			errs = append(errs, itemError(fieldErrorf("table", "table '%s' is neither an id nor a name in rt_tables or the tables section", route.Table), "routes", i))
+		}
+		referencedTables[id] = true
+	}
+
+	for i, rule := range c.Rules {
+		itemHandle(rule.Namespace, "rules", i)
+		if ownedPriorities != nil && (rule.Priority == nil || !ownedPriorities.Contains(*rule.Priority)) {
+			errs = append(errs, itemError(fieldErrorf("priority", "rule needs a priority in the rule-priority-range %s of owned-only", c.Settings.RulePriorityRange), "rules", i))
+		}
+		src, srcErr := parseRulePrefix(rule.From)
+		if srcErr != nil {
+			errs = append(errs, itemError(fieldErrorf("from", "%w", srcErr), "rules", i))
+		}
+		dst, dstErr := parseRulePrefix(rule.To)
+		if dstErr != nil {
+			errs = append(errs, itemError(fieldErrorf("to", "%w", dstErr), "rules", i))
+		}
+		if srcErr == nil && dstErr == nil {
+			if _, err := rule.family(src, dst); err != nil {
+				errs = append(errs, itemError(err, "rules", i))
+			}
+		}
+		table := 0
+		if rule.Table != "" {
+			if id, exists := resolveTable(rule.Table); exists {
+				referencedTables[id] = true
+				table = id
+			} else {
+				errs = append(errs, itemError(fieldErrorf("table", "table '%s' is neither an id nor a name in rt_tables or the tables section", rule.Table), "rules", i))
+				table = -1
+			}
+		}
+		for _, err := range rule.validate(table) {
+			errs = append(errs, itemError(err, "rules", i))
+		}
+	}
+
+	// a hard-synced table that nothing refers to would be flushed
+	for i, table := range c.Settings.TableHardSync {
+		field := fmt.Sprintf("table-hard-sync[%d]", i)
+		if id, exists := resolveTable(table); !exists {
+			errs = append(errs, settingsError(field, fmt.Errorf("table '%s' is neither an id nor a name in rt_tables or the tables section", table)))
+		} else if !referencedTables[id] {
+			errs = append(errs, settingsError(field, fmt.Errorf("table '%s' is hard-synced but no route or rule refers to it", table)))
+		}
+	}
+
+	// the hard-synced links can be in any namespace of the config
+	for i, dev := range c.Settings.AddressHardSync {
+		exists := false
+		for namespace := range c.Namespaces() {
+			if h, err := handle(namespace); err != nil || linkExists(h, namespace)(dev) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			errs = append(errs, settingsError(fmt.Sprintf("address-hard-sync[%d]", i), fmt.Errorf("network interface %s does not exist", dev)))
+		}
+	}
+
+	return c.Locate(JoinErrors(errs))
+}
+
+// checks an address like its conversion does, with the vlans of the config as existing links.
+func (a *AddressModel) validate(linkExists func(string) bool) []error {
+	if _, err := a.toNetlink(validationResolver{linkExists: linkExists}); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// resolves the links by their existence only, as the vlans of the config have no index before they are created
+type validationResolver struct {
+	linkExists func(string) bool
+}
+
+func (validationResolver) tableID(table string) (int, error) {
+	return getTableID(table)
+}
+
+func (r validationResolver) linkIndex(dev string, gw net.IP) (int, error) {
+	if !r.linkExists(dev) {
+		return 0, fieldErrorf("dev", "network interface %s does not exist", dev)
+	}
+	return 0, nil
+}
+
+func (validationResolver) netlink() (utils.NetlinkHandle, error) {
+	return nil, errors.New("no network namespace while validating")
+}
+
+// checks the addresses and devices of a route and whether its gateways are reachable, or on-link.
+func (r *RouteModel) validate(handle utils.NetlinkHandle, linkExists func(string) bool, vlanNames map[string]bool) []error {
+	errs := []error{}
+
+	family := 0
+	if r.To != "default" {
+		if _, ipnet, err := net.ParseCIDR(r.To); err != nil {
+			errs = append(errs, fieldErrorf("to", "could not parse CIDR of (%s)", r.To))
+		} else {
+			family = utils.GetIPFamily(ipnet.IP)
+		}
+	}
+	if r.Src != "" {
+		if src := net.ParseIP(r.Src); src == nil {
+			errs = append(errs, fieldErrorf("src", "invalid source IP address %s", r.Src))
+		} else if family != 0 && utils.GetIPFamily(src) != family {
+			errs = append(errs, fieldErrorf("src", "source (%s) and destination (%s) are not the same IP family", r.Src, r.To))
+		}
+	}
+
+	if r.Via != "" || r.Dev != "" {
+		errs = append(errs, validateNexthop(handle, r.Via, r.Dev, r.OnLink, family, linkExists, vlanNames)...)
+	}
+	for i, nexthop := range r.Nexthops {
+		for _, err := range validateNexthop(handle, nexthop.Via, nexthop.Dev, nexthop.OnLink, family, linkExists, vlanNames) {
+			errs = append(errs, itemError(err, "nexthops", i))
+		}
+	}
+	return errs
+}
+
+func validateNexthop(handle utils.NetlinkHandle, via string, dev string, onLink bool, family int, linkExists func(string) bool, vlanNames map[string]bool) []error {
+	errs := []error{}
+	if dev != "" && !linkExists(dev) {
+		errs = append(errs, fieldErrorf("dev", "network interface %s does not exist", dev))
+	}
+	if via == "" {
+		return errs
+	}
+	gw := net.ParseIP(via)
+	if gw == nil {
+		return append(errs, fieldErrorf("via", "invalid gateway IP address %s", via))
+	}
+	if family != 0 && utils.GetIPFamily(gw) != family {
+		errs = append(errs, fieldErrorf("via", "gateway (%s) and destination are not the same IP family", via))
+	}
+
+	// an on-link gateway is not checked by the kernel, but it needs the device it is connected to
+	if onLink {
+		if dev == "" {
+			errs = append(errs, fieldErrorf("on-link", "on-link gateway %s needs dev", via))
+		}
+		return errs
+	}
+	// the reachability through a vlan of the same config can't be known before it's created, and
+	// a link-local gateway is always reachable through its dev
+	if vlanNames[dev] || (gw.IsLinkLocalUnicast() && dev != "") {
+		return errs
+	}
+	// like the kernel, the gateway has to be directly connected (not reachable through another gateway)
+	routes, err := handle.RouteGet(gw)
+	if err != nil || len(routes) == 0 || routes[0].Gw != nil {
+		return append(errs, fieldErrorf("via", "gateway %s is not reachable, set on-link if it is directly connected", via))
+	}
+	if dev != "" {
+		if link, err := handle.LinkByName(dev); err == nil && routes[0].LinkIndex != link.Attrs().Index {
+			errs = append(errs, fieldErrorf("via", "gateway %s is not reachable through dev %s, set on-link if it is directly connected", via, dev))
+		}
+	}
+	return errs
+}
+
+// Adds the position in the YAML to the field errors, the errors which are not about a field are left as they are.
+// The errors of a part of the config (see Namespaces) get the index of their item in the whole config.
+func (c *ConfigModel) Locate(err error) error {
+	if err == nil || c.node == nil {
+		return err
+	}
+	for _, e := range FlattenErrors(err) {
+		var fieldErr *FieldError
+		if errors.As(e, &fieldErr) && fieldErr.Line == 0 {
+			fieldErr.Index = c.index(fieldErr.Section, fieldErr.Index)
+			if node := findNode(c.node, fieldErr.Section, fieldErr.Index, fieldErr.Field); node != nil {
+				fieldErr.Line, fieldErr.Column = node.Line, node.Column
+			}
+		}
+	}
+	return err
+}
+
+// finds the deepest node of a path like `routes`, 2, `nexthops[1].via`
+func findNode(root *yaml.Node, section string, index int, field string) *yaml.Node {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) != 0 {
+		node = node.Content[0]
+	}
+	keys := []string{}
+	if section != "" {
+		keys = append(keys, section)
+		if index >= 0 {
+			keys = append(keys, strconv.Itoa(index))
+		}
+	}
+	for _, part := range strings.Split(field, ".") {
+		name, rest, found := strings.Cut(part, "[")
+		if name != "" {
+			keys = append(keys, name)
+		}
+		if found {
+			keys = append(keys, strings.TrimSuffix(rest, "]"))
+		}
+	}
+
+	var found *yaml.Node
+	for _, key := range keys {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node, found = next, next
+	}
+	return found
+}
@@ -2,23 +2,50 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"net"
 
 	"github.com/vishvananda/netlink"
 )
 
+// The priorities of the vlan header (PCP), which the QoS maps translate from and to the priorities of the packets
+const MAX_VLAN_PRIORITY = 7
+
 type VlanModel struct {
 	Name     string `yaml:"name"`
 	Link     string `yaml:"link"`
 	ID       int    `yaml:"id"`
 	Protocol string `yaml:"protocol"`
+	// the attributes which are not set are left as the kernel (or someone else) sets them
+	MTU    int    `yaml:"mtu"`
+	MAC    string `yaml:"mac"`
+	TxQLen *int   `yaml:"txqlen"`
+	// the priority of the vlan header to the one of the packet on ingress, and back on egress
+	IngressQosMap map[uint32]uint32 `yaml:"ingress-qos-map"`
+	EgressQosMap  map[uint32]uint32 `yaml:"egress-qos-map"`
+	Gvrp          bool              `yaml:"gvrp"`
+	Mvrp          bool              `yaml:"mvrp"`
+	LooseBinding  bool              `yaml:"loose-binding"`
+	// up (default) or down
+	State string `yaml:"state"`
+	// the network namespace of the vlan (and of its link), the one of the config when it's empty
+	Namespace string `yaml:"namespace"`
 }
 
 func (v *VlanModel) IsEmpty() bool {
 	if v.Name == "" &&
 		v.Link == "" &&
 		v.ID == 0 &&
-		v.Protocol == "" {
+		v.Protocol == "" &&
+		v.MTU == 0 &&
+		v.MAC == "" &&
+		v.TxQLen == nil &&
+		len(v.IngressQosMap) == 0 &&
+		len(v.EgressQosMap) == 0 &&
+		!v.Gvrp &&
+		!v.Mvrp &&
+		!v.LooseBinding &&
+		v.State == "" &&
+		v.Namespace == "" {
 		return true
 	}
 	return false
@@ -26,13 +53,21 @@ func (v *VlanModel) IsEmpty() bool {
 }
 
 func (v *VlanModel) String() string {
-	return fmt.Sprintf("name: %s - link: %s - id: %d - protocol: %s", v.Name, v.Link, v.ID, v.Protocol)
+	return fmt.Sprintf("name: %s - link: %s - id: %d - protocol: %s - mtu: %d - mac: %s - state: %s", v.Name, v.Link, v.ID, v.Protocol, v.MTU, v.MAC, v.State)
+}
+
+func (v *VlanModel) ToNetlink() (interface{}, error) {
+	return v.toNetlink(nodeResolver{})
 }
 
-func (v *VlanModel) ToNetlink() interface{} {
-	parentLink, err := netlink.LinkByName(v.Link)
+func (v *VlanModel) toNetlink(res resolver) (interface{}, error) {
+	handle, err := res.netlink()
 	if err != nil {
-		log.Fatalf("Failed to find parent link: %v", err)
+		return nil, err
+	}
+	parentLink, err := handle.LinkByName(v.Link)
+	if err != nil {
+		return nil, fieldErrorf("link", "failed to find parent link %s: %w", v.Link, err)
 	}
 
 	vlanAttrs := netlink.NewLinkAttrs()
@@ -48,11 +83,75 @@ func (v *VlanModel) ToNetlink() interface{} {
 		if value, exists := netlink.StringToVlanProtocolMap[v.Protocol]; exists {
 			vlan.VlanProtocol = value
 		} else {
-			log.Fatalf("Vlan protocol %s is not valid", v.Protocol)
+			return nil, fieldErrorf("protocol", "vlan protocol %s is not valid", v.Protocol)
 		}
 	} else {
 		vlan.VlanProtocol = netlink.VLAN_PROTOCOL_8021Q
 	}
 
-	return vlan
+	if err := v.setAttributes(vlan); err != nil {
+		return nil, err
+	}
+	return vlan, nil
+}
+
+// Sets the attributes of the vlan which can be changed once it's created. The flags and the QoS maps are always
+// set, so that the ones of the node which are not in the config are removed. The desired state is the up flag.
+func (v *VlanModel) setAttributes(vlan *netlink.Vlan) error {
+	// like the kernel, from the minimum MTU of IPv4 (ETH_MIN_MTU) to IP_MAX_MTU
+	if v.MTU != 0 && (v.MTU < 68 || v.MTU > 65535) {
+		return fieldErrorf("mtu", "mtu %d must be between 68 and 65535", v.MTU)
+	}
+	vlan.MTU = v.MTU
+
+	if v.MAC != "" {
+		mac, err := net.ParseMAC(v.MAC)
+		if err != nil || len(mac) != 6 {
+			return fieldErrorf("mac", "invalid MAC address %s", v.MAC)
+		}
+		if mac[0]&1 != 0 {
+			return fieldErrorf("mac", "MAC address %s is a multicast address", v.MAC)
+		}
+		vlan.HardwareAddr = mac
+	}
+
+	if v.TxQLen != nil {
+		if *v.TxQLen < 0 {
+			return fieldErrorf("txqlen", "txqlen %d can't be negative", *v.TxQLen)
+		}
+		vlan.TxQLen = *v.TxQLen
+	}
+
+	// a mapping to 0 is the default, which the kernel doesn't keep
+	vlan.IngressQosMap = make(map[uint32]uint32)
+	for from, to := range v.IngressQosMap {
+		if from > MAX_VLAN_PRIORITY {
+			return fieldErrorf("ingress-qos-map", "vlan priority %d must be between 0 and %d", from, MAX_VLAN_PRIORITY)
+		}
+		if to != 0 {
+			vlan.IngressQosMap[from] = to
+		}
+	}
+	vlan.EgressQosMap = make(map[uint32]uint32)
+	for from, to := range v.EgressQosMap {
+		if to > MAX_VLAN_PRIORITY {
+			return fieldErrorf("egress-qos-map", "vlan priority %d must be between 0 and %d", to, MAX_VLAN_PRIORITY)
+		}
+		if to != 0 {
+			vlan.EgressQosMap[from] = to
+		}
+	}
+
+	gvrp, mvrp, looseBinding := v.Gvrp, v.Mvrp, v.LooseBinding
+	vlan.Gvrp, vlan.Mvrp, vlan.LooseBinding = &gvrp, &mvrp, &looseBinding
+
+	switch v.State {
+	case "", "up":
+		vlan.Flags |= net.FlagUp
+	case "down":
+		vlan.Flags &^= net.FlagUp
+	default:
+		return fieldErrorf("state", "vlan state %s must be up or down", v.State)
+	}
+	return nil
 }
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The error of a field of a config item, e.g. `routes[2].via`
+type FieldError struct {
+	Section string
+	// index of the item in its section, -1 for sections that are not a list (settings)
+	Index int
+	Field string
+	Err   error
+	// position of the field (or of the item, when the field is not in the YAML) in the config, 0 if unknown
+	Line   int
+	Column int
+}
+
+func (e *FieldError) Path() string {
+	path := e.Section
+	if e.Index >= 0 {
+		path += fmt.Sprintf("[%d]", e.Index)
+	}
+	if e.Field != "" {
+		if path != "" {
+			path += "."
+		}
+		path += e.Field
+	}
+	return path
+}
+
+func (e *FieldError) Error() string {
+	message := e.Err.Error()
+	if path := e.Path(); path != "" {
+		message = fmt.Sprintf("%s: %s", path, message)
+	}
+	if e.Line > 0 {
+		message = fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, message)
+	}
+	return message
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func fieldErrorf(field string, format string, a ...any) *FieldError {
+	return &FieldError{Index: -1, Field: field, Err: fmt.Errorf(format, a...)}
+}
+
+// places the error of an item's field under the item (e.g. `via` of routes[2], or `via` of nexthops[1] of routes[2])
+func itemError(err error, section string, index int) *FieldError {
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) {
+		return &FieldError{Section: section, Index: index, Err: err}
+	}
+	field := fieldErr.Path()
+	return &FieldError{Section: section, Index: index, Field: field, Err: fieldErr.Err}
+}
+
+// places the error under a field of the settings section
+func settingsError(field string, err error) *FieldError {
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		err = fieldErr.Err
+	}
+	return &FieldError{Section: "settings", Index: -1, Field: field, Err: err}
+}
+
+// The error of a config that can not be decoded
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse config: %s", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// The errors of several items, reported together instead of stopping at the first one
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// Returns nil when there is no error, so that an empty Errors is never returned as a non-nil error.
+func JoinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return Errors(errs)
+}
+
+// Flattens (nested) Errors, and other errors wrapping several errors, into a list of single errors
+func FlattenErrors(err error) []error {
+	var errs Errors
+	if multi, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = multi.Unwrap()
+	} else if !errors.As(err, &errs) {
+		return []error{err}
+	}
+	result := []error{}
+	for _, e := range errs {
+		result = append(result, FlattenErrors(e)...)
+	}
+	return result
+}
@@ -0,0 +1,475 @@
+//go:build e2e
+
+package ipruler
+
+// The end-to-end tests sync the configs to a throwaway network namespace, and check the result with `ip`. They
+// need root and iproute2:
+//
+//	go test -tags e2e ./internal/ipruler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// A network namespace with the veth links d0 (10.0.0.2/24, 2001:db8::2/64) and d1 (10.0.1.2/24), whose peers
+// are p0 and p1
+type e2eNode struct {
+	t    *testing.T
+	name string
+}
+
+// Moves the test into a new network namespace, which is deleted at the end of the test. The agent uses the
+// namespace of the thread it runs on, so the test keeps its thread.
+func setupE2ENode(t *testing.T) *e2eNode {
+	if os.Geteuid() != 0 {
+		t.Skip("the end-to-end tests need root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the end-to-end tests need iproute2")
+	}
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("ipruler-e2e-%d", os.Getpid())
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		netns.Set(origin)
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("can't create a network namespace: %s", err)
+	}
+	configPath := utils.IPROUTE2_CONFIG_PATH
+	utils.IPROUTE2_CONFIG_PATH = t.TempDir()
+	t.Cleanup(func() {
+		utils.IPROUTE2_CONFIG_PATH = configPath
+		netns.Set(origin)
+		origin.Close()
+		ns.Close()
+		netns.DeleteNamed(name)
+		runtime.UnlockOSThread()
+	})
+
+	node := &e2eNode{t: t, name: name}
+	node.addLinks()
+	return node
+}
+
+// Creates another network namespace with the same links, which is deleted at the end of the test
+func (n *e2eNode) addNamespace(suffix string) *e2eNode {
+	name := n.name + "-" + suffix
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		n.t.Fatalf("ip netns add %s: %s: %s", name, err, out)
+	}
+	n.t.Cleanup(func() {
+		exec.Command("ip", "netns", "del", name).Run()
+	})
+	namespace := &e2eNode{t: n.t, name: name}
+	namespace.addLinks()
+	return namespace
+}
+
+func (n *e2eNode) addLinks() {
+	n.ip("link set lo up")
+	for _, link := range []string{"d0", "d1"} {
+		n.ip("link add " + link + " type veth peer name p" + link[1:])
+		n.ip("link set " + link + " up")
+		n.ip("link set p" + link[1:] + " up")
+	}
+	n.ip("addr add 10.0.0.2/24 dev d0")
+	n.ip("addr add 2001:db8::2/64 dev d0 nodad")
+	n.ip("addr add 10.0.1.2/24 dev d1")
+}
+
+// runs `ip` in the namespace, and returns the lines of its output with single spaces
+func (n *e2eNode) ip(args string) []string {
+	n.t.Helper()
+	lines, err := n.tryIP(args)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	return lines
+}
+
+func (n *e2eNode) tryIP(args string) ([]string, error) {
+	out, err := exec.Command("ip", append([]string{"-N", "-n", n.name}, strings.Fields(args)...)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ip %s: %s: %s", args, err, out)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func TestE2EWaveSyncAndRemove(t *testing.T) {
+	node := setupE2ENode(t)
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - blue
+tables:
+- name: blue
+  id: 100
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: blue
+- to: 2001:db8:20::/48
+  via: 2001:db8::1
+  table: blue
+- to: 10.21.0.0/16
+  via: 10.0.1.1
+rules:
+- from: 10.0.0.0/24
+  table: blue
+  priority: 32000
+`
+	var c2 string = `
+settings:
+  table-hard-sync:
+  - blue
+tables:
+- name: blue
+  id: 100
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: blue
+rules:
+- from: 10.0.0.0/24
+  table: blue
+  priority: 32001
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	assertEqual(t, "IPv4 routes of table 100", node.ip("-4 route show table 100"), "10.20.0.0/16 via 10.0.0.1 dev d0")
+	assertEqual(t, "IPv6 routes of table 100", node.ip("-6 route show table 100"), "2001:db8:20::/48 via 2001:db8::1 dev d0 metric 1024 pref medium")
+	assertEqual(t, "routes to 10.21.0.0/16", node.ip("-4 route show 10.21.0.0/16"), "10.21.0.0/16 via 10.0.1.1 dev d1")
+	assertEqual(t, "rules of table 100", node.ip("rule show table 100"), "32000: from 10.0.0.0/24 lookup 100")
+
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "IPv4 routes of table 100", node.ip("-4 route show table 100"), "10.20.0.0/16 via 10.0.0.1 dev d0")
+	assertEqual(t, "IPv6 routes of table 100", node.ip("-6 route show table 100"))
+	assertEqual(t, "routes to 10.21.0.0/16", node.ip("-4 route show 10.21.0.0/16"))
+	assertEqual(t, "rules of table 100", node.ip("rule show table 100"), "32001: from 10.0.0.0/24 lookup 100")
+
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "routes of table 100 after remove", node.ip("route show table 100"))
+	assertEqual(t, "rules of table 100 after remove", node.ip("rule show table 100"))
+	if tables := utils.OwnedTables(); len(tables) != 0 {
+		t.Errorf("owned tables after remove: got %v, want none", tables)
+	}
+}
+
+func TestE2EHardSync(t *testing.T) {
+	node := setupE2ENode(t)
+	node.ip("route add 10.30.0.0/16 via 10.0.1.1 table 100")
+	node.ip("route add 10.30.0.0/16 via 10.0.1.1 table 200")
+	node.ip("rule add from 10.9.0.0/16 table 100 pref 31000")
+	node.ip("rule add from 10.9.0.0/16 table 200 pref 31001")
+
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 100
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: 100
+rules:
+- from: 10.0.0.0/24
+  table: 100
+  priority: 32000
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	// the foreign objects of the hard-synced table are removed, the ones of the other tables are left
+	assertEqual(t, "routes of table 100", node.ip("route show table 100"), "10.20.0.0/16 via 10.0.0.1 dev d0")
+	assertEqual(t, "rules of table 100", node.ip("rule show table 100"), "32000: from 10.0.0.0/24 lookup 100")
+	assertEqual(t, "routes of table 200", node.ip("route show table 200"), "10.30.0.0/16 via 10.0.1.1 dev d1")
+	assertEqual(t, "rules of table 200", node.ip("rule show table 200"), "31001: from 10.9.0.0/16 lookup 200")
+}
+
+func TestE2EOwnedOnly(t *testing.T) {
+	node := setupE2ENode(t)
+	node.ip("route add 10.30.0.0/16 via 10.0.1.1 table 100")
+	node.ip("route add 10.31.0.0/16 via 10.0.1.1 table 100 proto 200")
+	node.ip("rule add from 10.9.0.0/16 table 100 pref 30500")
+	node.ip("rule add from 10.9.0.0/16 table 100 pref 31500")
+
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 100
+  owned-only: true
+  route-protocol: 200
+  rule-priority-range: 30000-30999
+  vlan-alias: ipruler
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: 100
+rules:
+- from: 10.0.0.0/24
+  table: 100
+  priority: 30000
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	// only the objects tagged by the agent are removed
+	assertEqual(t, "routes of table 100", node.ip("route show table 100"),
+		"10.20.0.0/16 via 10.0.0.1 dev d0 proto 200", "10.30.0.0/16 via 10.0.1.1 dev d1")
+	assertEqual(t, "rules of table 100", node.ip("rule show table 100"),
+		"30000: from 10.0.0.0/24 lookup 100", "31500: from 10.9.0.0/16 lookup 100")
+}
+
+func TestE2ERollback(t *testing.T) {
+	node := setupE2ENode(t)
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 100
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: 100
+`
+	// the source is not an address of the node, which the kernel rejects
+	var c2 string = `
+settings:
+  table-hard-sync:
+  - 100
+routes:
+- to: 10.21.0.0/16
+  via: 10.0.0.1
+  table: 100
+- to: 10.22.0.0/16
+  via: 10.0.0.1
+  src: 10.9.9.9
+  table: 100
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	err := configLifeCycle.WaveSync([]byte(c2))
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || rollbackErr.RollbackErr != nil || !errors.Is(err, unix.EINVAL) {
+		t.Fatalf("got %v, want EINVAL rolled back", err)
+	}
+	assertEqual(t, "routes of table 100", node.ip("route show table 100"), "10.20.0.0/16 via 10.0.0.1 dev d0")
+}
+
+func TestE2ENamespaces(t *testing.T) {
+	node := setupE2ENode(t)
+	blue := node.addNamespace("blue")
+	blue.ip("route add 10.30.0.0/16 via 10.0.1.1 table 100")
+
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 100
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: 100
+- to: 10.21.0.0/16
+  via: 10.0.0.1
+  table: 100
+  namespace: ` + blue.name + `
+rules:
+- from: 10.0.0.0/24
+  table: 100
+  priority: 32000
+  namespace: ` + blue.name + `
+`
+	var c2 string = `
+settings:
+  table-hard-sync:
+  - 100
+routes:
+- to: 10.20.0.0/16
+  via: 10.0.0.1
+  table: 100
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	assertEqual(t, "routes of table 100", node.ip("route show table 100"), "10.20.0.0/16 via 10.0.0.1 dev d0")
+	assertEqual(t, "rules of table 100", node.ip("rule show table 100"))
+	assertEqual(t, "routes of table 100 in blue", blue.ip("route show table 100"), "10.21.0.0/16 via 10.0.0.1 dev d0")
+	assertEqual(t, "rules of table 100 in blue", blue.ip("rule show table 100"), "32000: from 10.0.0.0/24 lookup 100")
+
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "routes of table 100", node.ip("route show table 100"), "10.20.0.0/16 via 10.0.0.1 dev d0")
+	assertEqual(t, "routes of table 100 in blue", blue.ip("route show table 100"))
+	assertEqual(t, "rules of table 100 in blue", blue.ip("rule show table 100"))
+}
+
+// the addresses of the link, without their lifetimes
+func (n *e2eNode) addresses(link string) []string {
+	n.t.Helper()
+	addrs := []string{}
+	for _, line := range n.ip("address show dev " + link) {
+		if strings.HasPrefix(line, "inet") {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs
+}
+
+func TestE2EAddresses(t *testing.T) {
+	node := setupE2ENode(t)
+	node.ip("address add 10.0.1.9/24 dev d1")
+
+	var c1 string = `
+settings:
+  address-hard-sync:
+  - d1
+addresses:
+- dev: d1
+  cidr: 10.0.1.2/24
+- dev: d1
+  cidr: 10.0.5.2/24
+  label: d1:sec
+  noprefixroute: true
+- dev: d1
+  cidr: 10.0.6.1/32
+  peer: 10.0.6.2/31
+- dev: d1
+  cidr: 2001:db8:1::2/64
+  valid-lft: 3600
+  preferred-lft: 1800
+routes:
+- to: 10.50.0.0/16
+  dev: d1
+  src: 10.0.5.2
+  table: 150
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	// the foreign address of the hard-synced link is removed, the link-local address is left
+	addrs := node.addresses("d1")
+	want := []string{"inet 10.0.1.2/24", "inet 10.0.5.2/24", "inet 10.0.6.1 peer 10.0.6.2/31", "inet6 2001:db8:1::2/64", "inet6 fe80::"}
+	if len(addrs) != len(want) {
+		t.Fatalf("addresses of d1: got %v, want %v", addrs, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(addrs[i], want[i]) {
+			t.Errorf("addresses of d1: got %q, want %q", addrs[i], want[i])
+		}
+	}
+	if !strings.Contains(addrs[1], "d1:sec") || !strings.Contains(addrs[1], "noprefixroute") {
+		t.Errorf("address has no label or noprefixroute: %s", addrs[1])
+	}
+	assertEqual(t, "routes of table 150", node.ip("route show table 150"), "10.50.0.0/16 dev d1 src 10.0.5.2")
+
+	// the addresses of the kernel are the same as the ones of the config
+	plan, err := configLifeCycle.Plan([]byte(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("the synced config has changes: %s", plan)
+	}
+
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	addrs = node.addresses("d1")
+	if len(addrs) != 1 || !strings.HasPrefix(addrs[0], "inet6 fe80::") {
+		t.Errorf("addresses of d1 after remove: %v", addrs)
+	}
+}
+
+func TestE2EVlans(t *testing.T) {
+	node := setupE2ENode(t)
+	if _, err := node.tryIP("link add link d0 name probe type vlan id 4000"); err != nil {
+		t.Skipf("the kernel has no vlans: %s", err)
+	}
+	node.ip("link del probe")
+
+	var c1 string = `
+settings:
+  vlan-alias: ipruler
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+routes:
+- to: 10.10.0.0/16
+  dev: d0.10
+  table: 110
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	link := strings.Join(node.ip("-d link show d0.10"), " ")
+	for _, want := range []string{"d0.10@d0", ",UP", "vlan protocol 802.1Q id 10", "alias ipruler"} {
+		if !strings.Contains(link, want) {
+			t.Errorf("link d0.10 has no %q: %s", want, link)
+		}
+	}
+	assertEqual(t, "routes of table 110", node.ip("route show table 110"), "10.10.0.0/16 dev d0.10")
+
+	// the attributes changed by hand are set again in place
+	var c2 string = `
+settings:
+  vlan-alias: ipruler
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+- name: d0.20
+  link: d0
+  id: 20
+  mtu: 1400
+  egress-qos-map:
+    1: 2
+  gvrp: true
+  state: down
+`
+	waveSync(t, configLifeCycle, c2)
+	node.ip("link set d0.20 mtu 1300 type vlan egress-qos-map 3:4 gvrp off")
+	waveSync(t, configLifeCycle, c2)
+	link = strings.Join(node.ip("-d link show d0.20"), " ")
+	for _, want := range []string{"mtu 1400", "state DOWN", "<REORDER_HDR,GVRP>", "egress-qos-map { 1:2 }"} {
+		if !strings.Contains(link, want) {
+			t.Errorf("link d0.20 has no %q: %s", want, link)
+		}
+	}
+	plan, err := configLifeCycle.Plan([]byte(c2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("the synced config has changes: %s", plan)
+	}
+
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.tryIP("link show d0.10"); err == nil {
+		t.Errorf("vlan d0.10 is not deleted")
+	}
+}
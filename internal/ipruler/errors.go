@@ -1,5 +1,11 @@
 package ipruler
 
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
 // Define a new type for your custom error
 type EmptyConfig struct {
 	Message string
@@ -14,3 +20,62 @@ func CreateEmptyConfigError() error {
 		Message: "The given config is parsed as an empty config. skipped",
 	}
 }
+
+// The error of the kernel on adding, deleting or updating an object
+type SyncError struct {
+	// why the object is synced, e.g. table-hard-sync or sync-removed-config (empty for adds)
+	Reason string
+	Op     string
+	Object string
+	Item   string
+	// the network namespace of the object, empty for the one of the agent
+	Namespace string
+	Err       error
+}
+
+func (e *SyncError) Error() string {
+	message := fmt.Sprintf("Error in %s %s (%s) : %s", e.Op, e.Object, e.Item, e.Err)
+	if e.Namespace != "" {
+		message = fmt.Sprintf("Error in %s %s (%s) in namespace %s : %s", e.Op, e.Object, e.Item, e.Namespace, e.Err)
+	}
+	if errno, ok := e.Errno(); ok {
+		message += fmt.Sprintf(" (errno %d)", errno)
+	}
+	if e.Reason != "" {
+		message = fmt.Sprintf("[%s] %s", e.Reason, message)
+	}
+	return message
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the kernel errno of the error, if there is one
+func (e *SyncError) Errno() (syscall.Errno, bool) {
+	var errno syscall.Errno
+	if errors.As(e.Err, &errno) {
+		return errno, true
+	}
+	return 0, false
+}
+
+// The error of a sync whose changes are rolled back, along with the errors of the changes that could not be undone
+type RollbackError struct {
+	Err         error
+	RollbackErr error
+}
+
+func (e *RollbackError) Error() string {
+	if e.RollbackErr == nil {
+		return fmt.Sprintf("%s (the changes are rolled back)", e.Err)
+	}
+	return fmt.Sprintf("%s; rollback failed: %s", e.Err, e.RollbackErr)
+}
+
+func (e *RollbackError) Unwrap() []error {
+	if e.RollbackErr == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.RollbackErr}
+}
@@ -1,13 +1,14 @@
 package ipruler
 
 import (
+	"fmt"
 	"log"
+	"maps"
 	"os"
-	"syscall"
+	"sort"
 
 	"github.com/plutocholia/ipruler/internal/config"
 	"github.com/plutocholia/ipruler/internal/utils"
-	"github.com/vishvananda/netlink"
 )
 
 const (
@@ -17,67 +18,365 @@ const (
 type ConfigLifeCycle struct {
 	CurrentConfig *config.Config
 	OldConfig     *config.Config
+	// reject the configs with unknown fields, instead of ignoring the fields
+	StrictDecoding bool
+	// only log the changes instead of applying them
+	DryRun bool
+	// the network namespace of the config (its top-level `namespace`), empty for the one of the agent
+	Namespace string
+
+	// the model of CurrentConfig, to resolve its links again when the objects are reconciled
+	model    *config.ConfigModel
+	lastPlan string
+	// the life cycles of the items in other namespaces, by namespace. Each one syncs (and hard-syncs) its own
+	// namespace with the settings of the config.
+	namespaces map[string]*ConfigLifeCycle
+	// the life cycle of items in another namespace, whose tables are written by the life cycle of the config
+	itemsOnly bool
+	// the handle of the namespace, while the changes are planned
+	handle utils.NetlinkHandle
+	// closed when the config moves to another namespace, so that the watcher watches the new one
+	moved chan struct{}
 }
 
 func CreateConfigLifeCycle() *ConfigLifeCycle {
-	return &ConfigLifeCycle{}
+	return &ConfigLifeCycle{StrictDecoding: true}
 }
 
 // Only used in tests (will be removed)
-func (c *ConfigLifeCycle) Update(data []byte) {
-	configModel := config.CreateConfigModel(data)
-	if c.CurrentConfig == nil {
-		c.CurrentConfig = config.CreateConfig(configModel)
-	} else {
-		c.OldConfig = c.CurrentConfig
-		c.CurrentConfig = config.CreateConfig(configModel)
+func (c *ConfigLifeCycle) Update(data []byte) error {
+	configModel, err := config.CreateConfigModel(data, c.StrictDecoding)
+	if err != nil {
+		return err
+	}
+	newConfig, err := config.CreateConfig(configModel)
+	if err != nil {
+		return err
 	}
+	c.OldConfig = c.CurrentConfig
+	c.CurrentConfig = newConfig
+	return nil
 }
 
-// It's equivalent to Update method which does syncs in proper order
+// It's equivalent to Update method which does syncs in proper order. It stops at the first section
+// that fails, which keeps the sections from there on as they were in the previous config. In dry-run
+// mode it only logs the changes it would make.
 func (c *ConfigLifeCycle) WaveSync(data []byte) error {
-	configModel := config.CreateConfigModel(data)
+	if c.DryRun {
+		plan, err := c.Plan(data)
+		if plan != nil {
+			c.logPlan(plan)
+		}
+		return err
+	}
 
-	if configModel.IsEmpty() {
-		return CreateEmptyConfigError()
+	configModel, err := c.parse(data)
+	if err != nil {
+		return err
 	}
+	_, err = c.run(configModel, waveStages, true)
+	return err
+}
 
-	newConfig := c.CreateNewConfig()
+// Computes the changes WaveSync would make for the config, without changing the node or the state of the
+// ConfigLifeCycle. The changes of a section are planned as if the sections before it were applied.
+func (c *ConfigLifeCycle) Plan(data []byte) (*Plan, error) {
+	configModel, err := c.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.planner().run(configModel, waveStages, false)
+}
 
-	newConfig.AddSettings(configModel.Settings)
-	newConfig.AddVlans(configModel.Vlans)
-	c.SyncVlansState()
+// Removes the objects of the current config, in every namespace.
+func (c *ConfigLifeCycle) Remove() error {
+	if c.DryRun {
+		plan, err := c.planner().run(&config.ConfigModel{Namespace: c.Namespace}, removeStages, false)
+		c.logPlan(plan)
+		return err
+	}
+	_, err := c.run(&config.ConfigModel{Namespace: c.Namespace}, removeStages, true)
+	return err
+}
 
-	newConfig.AddRoutes(configModel.Routes)
-	c.SyncRoutesState()
+// a copy of the life cycle and of the ones of its namespaces, to plan changes without changing their state
+func (c *ConfigLifeCycle) planner() *ConfigLifeCycle {
+	planner := &ConfigLifeCycle{CurrentConfig: c.CurrentConfig, Namespace: c.Namespace, namespaces: make(map[string]*ConfigLifeCycle)}
+	for namespace, lc := range c.namespaces {
+		planner.namespaces[namespace] = &ConfigLifeCycle{CurrentConfig: lc.CurrentConfig, Namespace: namespace, itemsOnly: true}
+	}
+	return planner
+}
 
-	newConfig.AddRules(configModel.Rules)
-	c.SyncRulesState()
+// Restores a config which has been applied before (e.g. by a previous run of the agent) as the current config,
+// without syncing it, so that the next sync removes what is no more in the config. The sections that fail are
+// left empty.
+func (c *ConfigLifeCycle) Restore(data []byte) error {
+	configModel, err := config.CreateConfigModel(data, false)
+	if err != nil {
+		return err
+	}
+	c.Namespace = configModel.Namespace
+	c.namespaces = make(map[string]*ConfigLifeCycle)
+	models := configModel.Namespaces()
+	errs := []error{}
+	for _, lc := range c.lifeCycles(models) {
+		model := models[lc.Namespace]
+		restored := &config.Config{Namespace: lc.Namespace}
+		for _, s := range waveStages {
+			if err := s.add(restored, model); err != nil {
+				errs = append(errs, model.Locate(err))
+			}
+		}
+		lc.OldConfig = nil
+		lc.CurrentConfig = restored
+		lc.model = model
+	}
+	return config.JoinErrors(errs)
+}
 
-	return nil
+// parses and validates the config
+func (c *ConfigLifeCycle) parse(data []byte) (*config.ConfigModel, error) {
+	configModel, err := config.CreateConfigModel(data, c.StrictDecoding)
+	if err != nil {
+		return nil, err
+	}
+	if configModel.IsEmpty() {
+		return nil, CreateEmptyConfigError()
+	}
+	if err := configModel.Validate(); err != nil {
+		return nil, err
+	}
+	return configModel, nil
 }
 
-func (c *ConfigLifeCycle) Remove() error {
-	configModel := config.CreateConfigModel(nil)
+// A section of the config, added to the new config and then synced
+type stage struct {
+	name string
+	add  func(newConfig *config.Config, configModel *config.ConfigModel) error
+	plan func(c *ConfigLifeCycle) ([]*Change, error)
+}
 
-	newConfig := c.CreateNewConfig()
+var (
+	tablesStage = stage{
+		name: "tables",
+		add: func(newConfig *config.Config, configModel *config.ConfigModel) error {
+			return newConfig.AddTables(configModel.Tables)
+		},
+		plan: (*ConfigLifeCycle).planTables,
+	}
+	vlansStage = stage{
+		name: "vlans",
+		add: func(newConfig *config.Config, configModel *config.ConfigModel) error {
+			if err := newConfig.AddSettings(configModel.Settings); err != nil {
+				return err
+			}
+			return newConfig.AddVlans(configModel.Vlans)
+		},
+		plan: (*ConfigLifeCycle).planVlans,
+	}
+	// the addresses are removed before the vlans, so address-hard-sync follows the settings of the model (and
+	// removing the config leaves the other addresses of its links alone)
+	addressesStage = stage{
+		name: "addresses",
+		add: func(newConfig *config.Config, configModel *config.ConfigModel) error {
+			if err := newConfig.AddSettings(configModel.Settings); err != nil {
+				return err
+			}
+			return newConfig.AddAddresses(configModel.Addresses)
+		},
+		plan: (*ConfigLifeCycle).planAddresses,
+	}
+	routesStage = stage{
+		name: "routes",
+		add: func(newConfig *config.Config, configModel *config.ConfigModel) error {
+			return newConfig.AddRoutes(configModel.Routes)
+		},
+		plan: (*ConfigLifeCycle).planRoutes,
+	}
+	rulesStage = stage{
+		name: "rules",
+		add: func(newConfig *config.Config, configModel *config.ConfigModel) error {
+			return newConfig.AddRules(configModel.Rules)
+		},
+		plan: (*ConfigLifeCycle).planRules,
+	}
 
-	newConfig.AddRules(configModel.Rules)
-	c.SyncRulesState()
+	// the objects are added in the order they depend on each other, and removed in the reverse order
+	waveStages   = []stage{tablesStage, vlansStage, addressesStage, routesStage, rulesStage}
+	removeStages = []stage{rulesStage, routesStage, addressesStage, vlansStage, tablesStage}
+)
 
-	newConfig.AddRoutes(configModel.Routes)
-	c.SyncRoutesState()
+// Adds the sections of the config model to a new config, and plans (and applies) the changes of each
+// section before the next one, in the namespace of the config and then in the namespaces of its items. The
+// items of a namespace which is no more in the config are removed. It stops at the first section that fails,
+// and then undoes the changes applied so far (in every namespace) and goes back to the previous config.
+func (c *ConfigLifeCycle) run(configModel *config.ConfigModel, stages []stage, apply bool) (*Plan, error) {
+	plan := &Plan{Changes: []*Change{}}
+	tx := &transaction{}
+	restore := c.save()
+	fail := func(err error) (*Plan, error) {
+		restore()
+		if len(tx.applied) == 0 {
+			return plan, err
+		}
+		log.Printf("Error in syncing the config, rolling back %d changes: %s", len(tx.applied), err)
+		return plan, &RollbackError{Err: err, RollbackErr: tx.rollback()}
+	}
 
-	newConfig.AddSettings(configModel.Settings)
-	newConfig.AddVlans(configModel.Vlans)
-	c.SyncVlansState()
+	c.moveTo(configModel.Namespace)
+	models := configModel.Namespaces()
+	for _, lc := range c.lifeCycles(models) {
+		model, exists := models[lc.Namespace]
+		if !exists {
+			// the objects of a namespace which is gone are gone along with it
+			if _, err := utils.NamespaceNetlink(lc.Namespace); err != nil {
+				log.Printf("Namespace %s is gone, forgetting its objects: %s", lc.Namespace, err)
+				delete(c.namespaces, lc.Namespace)
+				continue
+			}
+			if err := lc.runStages(&config.ConfigModel{Namespace: lc.Namespace}, removeStages, tx, plan, apply); err != nil {
+				return fail(err)
+			}
+			delete(c.namespaces, lc.Namespace)
+			continue
+		}
+		if err := lc.runStages(model, stages, tx, plan, apply); err != nil {
+			return fail(err)
+		}
+	}
+	return plan, nil
+}
 
+// syncs the sections of the config model in the namespace of the life cycle, the changes are added to the plan
+func (c *ConfigLifeCycle) runStages(configModel *config.ConfigModel, stages []stage, tx *transaction, plan *Plan, apply bool) error {
+	newConfig := c.CreateNewConfig()
+	newConfig.Namespace = c.Namespace
+	for _, s := range stages {
+		if err := s.add(newConfig, configModel); err != nil {
+			return configModel.Locate(err)
+		}
+		changes, err := c.planIn(s.plan)
+		if err != nil {
+			return err
+		}
+		plan.Changes = append(plan.Changes, changes...)
+		if apply {
+			if err := tx.apply(changes); err != nil {
+				return err
+			}
+		}
+	}
+	c.model = configModel
 	return nil
 }
 
-// Creates new ConfigModel and adds it to the CurrentConfig attr of the ConfigLifeCyle
+// plans the changes of a section in the namespace of the life cycle, they are applied through its handle
+func (c *ConfigLifeCycle) planIn(plan func(c *ConfigLifeCycle) ([]*Change, error)) ([]*Change, error) {
+	handle, err := utils.NamespaceNetlink(c.Namespace)
+	if err != nil {
+		return nil, &SyncError{Op: "opening", Object: "namespace", Item: c.Namespace, Err: err}
+	}
+	c.handle = handle
+	changes, err := plan(c)
+	for _, change := range changes {
+		change.Namespace, change.netlink = c.Namespace, handle
+	}
+	return changes, err
+}
+
+// The life cycle of the config, and the ones of the namespaces of its items (which are created for the namespaces
+// of the models) and of the previous ones, sorted by namespace.
+func (c *ConfigLifeCycle) lifeCycles(models map[string]*config.ConfigModel) []*ConfigLifeCycle {
+	if c.namespaces == nil {
+		c.namespaces = make(map[string]*ConfigLifeCycle)
+	}
+	for namespace := range models {
+		if _, exists := c.namespaces[namespace]; !exists && namespace != c.Namespace {
+			c.namespaces[namespace] = &ConfigLifeCycle{Namespace: namespace, itemsOnly: true}
+		}
+	}
+	namespaces := []string{}
+	for namespace := range c.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	lifeCycles := []*ConfigLifeCycle{c}
+	for _, namespace := range namespaces {
+		lifeCycles = append(lifeCycles, c.namespaces[namespace])
+	}
+	return lifeCycles
+}
+
+// Moves the config to another namespace. The objects in the previous namespace become the ones of a namespace of
+// its items (which are removed unless items are left there), and the objects of the items in the new namespace
+// become the ones of the config.
+func (c *ConfigLifeCycle) moveTo(namespace string) {
+	if namespace == c.Namespace {
+		return
+	}
+	if c.namespaces == nil {
+		c.namespaces = make(map[string]*ConfigLifeCycle)
+	}
+	next := c.namespaces[namespace]
+	delete(c.namespaces, namespace)
+	if c.CurrentConfig != nil {
+		c.namespaces[c.Namespace] = &ConfigLifeCycle{
+			CurrentConfig: c.CurrentConfig,
+			OldConfig:     c.OldConfig,
+			Namespace:     c.Namespace,
+			model:         c.model,
+			itemsOnly:     true,
+		}
+	}
+	c.Namespace = namespace
+	c.CurrentConfig, c.OldConfig, c.model = nil, nil, nil
+	if next != nil {
+		c.CurrentConfig, c.OldConfig, c.model = next.CurrentConfig, next.OldConfig, next.model
+	}
+	if c.moved != nil {
+		close(c.moved)
+		c.moved = nil
+	}
+}
+
+// saves the state of the life cycle and of the ones of its namespaces, and returns the function restoring it
+func (c *ConfigLifeCycle) save() func() {
+	type state struct {
+		current *config.Config
+		old     *config.Config
+		model   *config.ConfigModel
+	}
+	namespace, namespaces := c.Namespace, maps.Clone(c.namespaces)
+	states := map[*ConfigLifeCycle]state{c: {c.CurrentConfig, c.OldConfig, c.model}}
+	for _, lc := range c.namespaces {
+		states[lc] = state{lc.CurrentConfig, lc.OldConfig, lc.model}
+	}
+	return func() {
+		c.Namespace, c.namespaces = namespace, namespaces
+		for lc, s := range states {
+			lc.CurrentConfig, lc.OldConfig, lc.model = s.current, s.old, s.model
+		}
+	}
+}
+
+// logs the plan of dry-run mode, once until it changes
+func (c *ConfigLifeCycle) logPlan(plan *Plan) {
+	if plan.String() == c.lastPlan {
+		return
+	}
+	c.lastPlan = plan.String()
+	log.Printf("[dry-run] Planned changes: %s", plan)
+}
+
+// Creates new Config and adds it to the CurrentConfig attr of the ConfigLifeCyle. The new config starts as
+// a copy of the current one, so that the sections which are never added (after a failure) keep describing
+// what is on the node.
 func (c *ConfigLifeCycle) CreateNewConfig() *config.Config {
 	newConfig := &config.Config{}
+	if c.CurrentConfig != nil {
+		*newConfig = *c.CurrentConfig
+	}
 
 	c.OldConfig = c.CurrentConfig
 	c.CurrentConfig = newConfig
@@ -85,7 +384,35 @@ func (c *ConfigLifeCycle) CreateNewConfig() *config.Config {
 	return newConfig
 }
 
-func (c *ConfigLifeCycle) PersistState() {
+// Writes the script which applies the current config again at boot to PERSIST_PATH
+func (c *ConfigLifeCycle) PersistState() error {
+	content, err := c.persistedScript()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(PERSIST_PATH)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+
+	err = os.Chmod(PERSIST_PATH, 0755)
+	if err != nil {
+		return fmt.Errorf("error making file executable: %w", err)
+	}
+	// log.Println("persisting configurations at ", PERSIST_PATH)
+	return nil
+}
+
+// Returns the script of the current config, with the ip commands of every namespace. Nothing is persisted unless
+// the commands of every namespace are.
+func (c *ConfigLifeCycle) persistedScript() (string, error) {
 	headContent := `#!/bin/bash
 LOCK_FILE="/var/run/networkd-dispatcher-routable.lock" 
 
@@ -102,226 +429,120 @@ echo "Script executed and lock file created."
 `
 
 	mainContent := ``
+	for _, lc := range c.lifeCycles(nil) {
+		commands, err := lc.ipCommands()
+		if err != nil {
+			return "", fmt.Errorf("error persisting the config: %w", err)
+		}
+		mainContent += commands
+	}
+
+	return headContent + mainContent + footerContent, nil
+}
+
+// Returns the ip commands which add the vlans, addresses, routes and rules of the current config of the life cycle,
+// in its namespace. Their links are looked up in the namespace.
+func (c *ConfigLifeCycle) ipCommands() (string, error) {
+	if c.CurrentConfig == nil {
+		return "", nil
+	}
+	handle, err := utils.NamespaceNetlink(c.Namespace)
+	if err != nil {
+		return "", err
+	}
+	commands := []string{}
 
 	// Contert Vlan list to it's corresponding `ip link add` linux command
 	for _, vlan := range c.CurrentConfig.Vlans {
-		mainContent += utils.VlanToIPCommand(vlan) + ";\n"
+		command, err := utils.VlanToIPCommand(handle, vlan)
+		if err != nil {
+			return "", err
+		}
+		commands = append(commands, command)
+	}
+
+	// Convert address list to it's corresponding `ip address add` linux command
+	for _, addr := range c.CurrentConfig.Addresses {
+		command, err := utils.AddrToIPCommand(handle, addr)
+		if err != nil {
+			return "", err
+		}
+		commands = append(commands, command)
 	}
 
 	// Contert route list to it's corresponding `ip route add` linux command
 	for _, route := range c.CurrentConfig.Routes {
-		mainContent += utils.RouteToIPCommand(route) + ";\n"
+		command, err := utils.RouteToIPCommand(handle, route)
+		if err != nil {
+			return "", err
+		}
+		commands = append(commands, command)
 	}
 
 	// Convert rule list to it's corresponding `ip rule add` linux command.
 	for _, rule := range c.CurrentConfig.Rules {
-		mainContent += utils.RuleToIPCommand(rule) + ";\n"
+		commands = append(commands, utils.RuleToIPCommand(rule))
 	}
 
-	content := headContent + mainContent + footerContent
-
-	file, err := os.Create(PERSIST_PATH)
-	if err != nil {
-		log.Fatalln("Error creating file:", err)
-		return
+	content := ""
+	for _, command := range commands {
+		command, err := utils.NamespaceIPCommand(c.Namespace, command)
+		if err != nil {
+			return "", err
+		}
+		content += command + ";\n"
 	}
-	defer file.Close()
+	return content, nil
+}
 
-	_, err = file.WriteString(content)
-	if err != nil {
-		log.Fatalln("Error writing to file:", err)
-		return
-	}
+// The sync functions plan the changes of a section of the current config and apply them.
+func (c *ConfigLifeCycle) SyncTablesState() error {
+	return c.sync((*ConfigLifeCycle).planTables)
+}
 
-	err = os.Chmod(PERSIST_PATH, 0755)
-	if err != nil {
-		log.Fatalln("Error making file executable:", err)
-		return
-	}
-	// log.Println("persisting configurations at ", PERSIST_PATH)
+func (c *ConfigLifeCycle) SyncRulesState() error {
+	return c.sync((*ConfigLifeCycle).planRules)
 }
 
-func (c *ConfigLifeCycle) SyncRulesState() {
-	machineRules, _ := netlink.RuleList(netlink.FAMILY_V4)
-	curSettings := c.CurrentConfig.Settings
-	curRules := c.CurrentConfig.Rules
-	// remove rules base on table-hard-sync
-	if len(curSettings.TableHardSync) != 0 {
-		for _, machineRule := range machineRules {
-			if machineRule.Src != nil && curSettings.TableHardSync[machineRule.Table] {
-				machineRuleExists := false
-				for _, curRule := range curRules {
-					if machineRule.Src.IP.Equal(curRule.Src.IP) && machineRule.Table == curRule.Table {
-						machineRuleExists = true
-						break
-					}
-				}
-				if !machineRuleExists {
-					log.Printf("[table-hard-sync] Rule (%s) does not exist in current config.", machineRule)
-					err := netlink.RuleDel(&machineRule)
-					if err != nil && err != syscall.ENOENT {
-						log.Fatalf("[table-Hard-sync] Error in deleting (%s) : %s", machineRule, err)
-					} else if err == syscall.ENOENT {
-						log.Printf("[table-hard-sync] Rule (%s) has already been deleted.", machineRule)
-					} else {
-						log.Printf("[table-hard-sync] Rule (%s) is deleted.", machineRule)
-					}
-				}
-			}
-		}
-	}
-	// delete removed rules based on old config
-	if c.OldConfig != nil {
-		oldRules := c.OldConfig.Rules
-		for _, oldRule := range oldRules {
-			ruleExists := false
-			for _, curRule := range curRules {
-				if oldRule.Src.IP.Equal(curRule.Src.IP) && oldRule.Table == curRule.Table {
-					ruleExists = true
-					break
-				}
-			}
-			if !ruleExists {
-				log.Printf("[sync-removed-config] Rule (%s) is no more in current config", oldRule)
-				err := netlink.RuleDel(oldRule)
-				if err != nil && err != syscall.ENOENT {
-					log.Fatalf("[sync-removed-config] Error in deleting rule (%s) : %s", oldRule, err)
-				} else if err == syscall.ENOENT {
-					log.Printf("[sync-removed-config] Rule (%s) has already been deleted.", oldRule)
-				} else {
-					log.Printf("[sync-removed-config] Rule (%s) is deleted.", oldRule)
-				}
-			}
-		}
-	}
-	// add rules
-	for _, rule := range curRules {
-		ruleExists := false
-		for _, machineRule := range machineRules {
-			if machineRule.Src != nil && rule.Src.IP.Equal(machineRule.Src.IP) && (machineRule.Table == rule.Table) {
-				ruleExists = true
-				break
-			}
-		}
-		if ruleExists {
-			// log.Printf("rule (%s) exists", rule)
-		} else {
-			log.Printf("Rule (%s) is added", rule)
-			netlink.RuleAdd(rule)
-		}
-	}
+func (c *ConfigLifeCycle) SyncRoutesState() error {
+	return c.sync((*ConfigLifeCycle).planRoutes)
 }
 
-func (c *ConfigLifeCycle) SyncRoutesState() {
-	curRoutes := c.CurrentConfig.Routes
-	curSettings := c.CurrentConfig.Settings
-
-	// remove routes base on table-hard-sync
-	for table := range curSettings.TableHardSync {
-		machineRoutes, _ := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
-		for _, machineRoute := range machineRoutes {
-			routeExists := false
-			for _, route := range curRoutes {
-				if machineRoute.Equal(*route) {
-					routeExists = true
-					break
-				}
-			}
-			if !routeExists {
-				log.Printf("[table-hard-sync] Route (%s) does not exist in current config.", machineRoute)
-				err := netlink.RouteDel(&machineRoute)
-				if err != nil && err != syscall.ESRCH {
-					log.Fatalf("[table-hard-sync] Error in deleting route (%s) : %s", machineRoute, err)
-				} else if err == syscall.ESRCH {
-					log.Printf("[table-hard-sync] Route (%s) has already been deleted.", machineRoute)
-				} else {
-					log.Printf("[table-hard-sync] Route (%s) is deleted.", machineRoute)
-				}
-			}
-		}
-	}
-	// delete removed routes based on old config
-	if c.OldConfig != nil {
-		oldRoutes := c.OldConfig.Routes
-		for _, oldRoute := range oldRoutes {
-			routeExists := false
-			for _, curRoute := range curRoutes {
-				if oldRoute.Equal(*curRoute) {
-					routeExists = true
-					break
-				}
-			}
-			if !routeExists {
-				log.Printf("[sync-removed-config] Route (%s) is no more in current config", oldRoute)
-				err := netlink.RouteDel(oldRoute)
-				if err != nil && err != syscall.ESRCH {
-					log.Fatalf("[sync-removed-config] Error in deleting Route (%s) : %s", oldRoute, err)
-				} else if err == syscall.ESRCH {
-					log.Printf("[sync-removed-config] Route (%s) has already been deleted.", oldRoute)
-				} else {
-					log.Printf("[sync-removed-config] Route (%s) is deleted.", oldRoute)
-				}
-			}
-		}
-	}
-	// add routes
-	for _, route := range curRoutes {
-		err := netlink.RouteAdd(route)
-		if err == syscall.EEXIST {
-			// log.Printf("Route (%s) exists.", route)
-		} else if err != nil {
-			log.Fatal(err)
-		} else {
-			log.Printf("Route (%s) is added", route)
-		}
-	}
+func (c *ConfigLifeCycle) SyncVlansState() error {
+	return c.sync((*ConfigLifeCycle).planVlans)
 }
 
-func (c *ConfigLifeCycle) SyncVlansState() {
-	curVlans := c.CurrentConfig.Vlans
-
-	// delete removed vlans based on old config
-	if c.OldConfig != nil {
-		oldVlans := c.OldConfig.Vlans
-		for _, oldVlan := range oldVlans {
-			vlanExists := false
-			for _, curVlan := range curVlans {
-				if utils.VlanEquality(oldVlan, curVlan) {
-					vlanExists = true
-					break
-				}
-			}
-			if !vlanExists {
-				log.Printf("[sync-removed-config] vlan (%s) is no more in current config", utils.VlanToString(oldVlan))
-				err := netlink.LinkDel(oldVlan)
-				if err != nil && err != syscall.ESRCH {
-					log.Fatalf("[sync-removed-config] Error in deleting Vlan (%s) : %s", utils.VlanToString(oldVlan), err)
-				} else if err == syscall.ESRCH {
-					log.Printf("[sync-removed-config] Vlan (%s) has already been deleted.", utils.VlanToString(oldVlan))
-				} else {
-					log.Printf("[sync-removed-config] Vlan (%s) is deleted.", utils.VlanToString(oldVlan))
-				}
-			}
+func (c *ConfigLifeCycle) SyncAddressesState() error {
+	return c.sync((*ConfigLifeCycle).planAddresses)
+}
+
+// syncs the section in the namespace of the config and in the ones of its items
+func (c *ConfigLifeCycle) sync(plan func(c *ConfigLifeCycle) ([]*Change, error)) error {
+	errs := []error{}
+	for _, lc := range c.lifeCycles(nil) {
+		changes, err := lc.planIn(plan)
+		if err == nil {
+			err = applyChanges(changes)
 		}
-	}
-	// add vlans
-	for _, vlan := range curVlans {
-		err := netlink.LinkAdd(vlan)
-		if err == syscall.EEXIST {
-			// log.Printf("Vlan (%s) exists.", utils.VlanToString(vlan))
-		} else if err != nil {
-			log.Fatal(err)
-		} else {
-			if err := netlink.LinkSetUp(vlan); err != nil {
-				log.Fatalf("Unable to up the %s link", utils.VlanToString(vlan))
-			}
-			log.Printf("Vlan (%s) is added", utils.VlanToString(vlan))
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return config.JoinErrors(errs)
 }
 
-func (c *ConfigLifeCycle) SyncState() {
-	c.SyncVlansState()
-	c.SyncRoutesState()
-	c.SyncRulesState()
+func (c *ConfigLifeCycle) SyncState() error {
+	if err := c.SyncTablesState(); err != nil {
+		return err
+	}
+	if err := c.SyncVlansState(); err != nil {
+		return err
+	}
+	if err := c.SyncAddressesState(); err != nil {
+		return err
+	}
+	if err := c.SyncRoutesState(); err != nil {
+		return err
+	}
+	return c.SyncRulesState()
 }
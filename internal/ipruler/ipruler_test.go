@@ -1,15 +1,141 @@
 package ipruler
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"net"
-	"syscall"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/plutocholia/ipruler/internal/utils"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// Replaces the node with a fake one, which has the link d0 (172.31.201.2/24) and d1 (10.0.1.2/24), and an
+// empty iproute2 configuration directory.
+func setupFakeNode(t *testing.T) *utils.FakeNetlink {
+	fake := newFakeNode(t)
+	node, configPath := utils.Netlink, utils.IPROUTE2_CONFIG_PATH
+	utils.Netlink, utils.IPROUTE2_CONFIG_PATH = fake, t.TempDir()
+	t.Cleanup(func() {
+		utils.Netlink, utils.IPROUTE2_CONFIG_PATH = node, configPath
+	})
+	return fake
+}
+
+// a fake node with the links d0 (172.31.201.2/24, index 2) and d1 (10.0.1.2/24, index 3)
+func newFakeNode(t *testing.T) *utils.FakeNetlink {
+	fake := utils.NewFakeNetlink()
+	cidrs := map[string]string{"d0": "172.31.201.2/24", "d1": "10.0.1.2/24"}
+	for _, name := range []string{"d0", "d1"} {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Flags: net.FlagUp}}
+		addr, _ := netlink.ParseAddr(cidrs[name])
+		if err := fake.LinkAdd(link); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fake
+}
+
+// Adds fake namespaces to the fake node, each one with the links of a fake node. The other namespaces don't exist.
+func setupFakeNamespaces(t *testing.T, names ...string) map[string]*utils.FakeNetlink {
+	fakes := make(map[string]*utils.FakeNetlink)
+	for _, name := range names {
+		fakes[name] = newFakeNode(t)
+	}
+	namespaceNetlink := utils.NamespaceNetlink
+	utils.NamespaceNetlink = func(namespace string) (utils.NetlinkHandle, error) {
+		if namespace == "" {
+			return utils.Netlink, nil
+		}
+		if fake, exists := fakes[namespace]; exists {
+			return fake, nil
+		}
+		return nil, unix.ENOENT
+	}
+	t.Cleanup(func() {
+		utils.NamespaceNetlink = namespaceNetlink
+	})
+	return fakes
+}
+
+func waveSync(t *testing.T, c *ConfigLifeCycle, data string) {
+	t.Helper()
+	if err := c.WaveSync([]byte(data)); err != nil {
+		t.Fatalf("WaveSync: %s", err)
+	}
+}
+
+// the sources of the rules of the table
+func ruleSources(t *testing.T, handle utils.NetlinkHandle, table int) []string {
+	t.Helper()
+	rules, err := handle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{}
+	for _, rule := range rules {
+		if rule.Table == table && rule.Src != nil {
+			sources = append(sources, rule.Src.String())
+		}
+	}
+	return sources
+}
+
+// the destinations of the routes of the table
+func routeDestinations(t *testing.T, handle utils.NetlinkHandle, table int) []string {
+	t.Helper()
+	routes, err := handle.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinations := []string{}
+	for _, route := range routes {
+		destinations = append(destinations, route.Dst.String())
+	}
+	return destinations
+}
+
+// the addresses of the link, with their prefix length
+func linkAddresses(t *testing.T, handle utils.NetlinkHandle, name string) []string {
+	t.Helper()
+	link, err := handle.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := handle.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs := []string{}
+	for _, addr := range addrs {
+		cidrs = append(cidrs, addr.IPNet.String())
+	}
+	return cidrs
+}
+
+func assertEqual(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+			return
+		}
+	}
+}
+
 func TestAddingRules(t *testing.T) {
+	setupFakeNode(t)
 	var c1 string = `
 rules:
 - from: 172.31.201.11/32
@@ -29,19 +155,54 @@ rules:
 `
 
 	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	waveSync(t, configLifeCycle, c2)
 
-	log.Println("adding c1")
-	configLifeCycle.Update([]byte(c1))
-	configLifeCycle.SyncState()
+	assertEqual(t, "rules of table 101", ruleSources(t, utils.Netlink, 101), "172.31.201.11/32")
+	assertEqual(t, "rules of table 102", ruleSources(t, utils.Netlink, 102), "172.31.201.12/32")
+	assertEqual(t, "rules of table 103", ruleSources(t, utils.Netlink, 103), "172.31.201.13/32")
+}
 
-	log.Println("adding c2")
-	configLifeCycle.Update([]byte(c2))
-	log.Println("Current Configuration: ", configLifeCycle.CurrentConfig.String())
-	log.Println("Old Configuration: ", configLifeCycle.OldConfig.String())
-	configLifeCycle.SyncState()
+// a selector-only rule of both families is installed once per family, and stays in sync
+func TestRules_Family(t *testing.T) {
+	setupFakeNode(t)
+	var c1 string = `
+settings:
+  table-hard-sync: [101]
+rules:
+- iif: d1
+  family: all
+  table: 101
+  priority: 1000
+routes:
+- to: 10.10.0.0/16
+  dev: d1
+  table: 101
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	families := []int{}
+	rules, _ := utils.Netlink.RuleList(netlink.FAMILY_ALL)
+	for _, rule := range rules {
+		if rule.Table == 101 && rule.IifName == "d1" {
+			families = append(families, rule.Family)
+		}
+	}
+	if len(families) != 2 || families[0] == families[1] {
+		t.Errorf("families of the rules of table 101: got %v, want an IPv4 and an IPv6 rule", families)
+	}
+	plan, err := configLifeCycle.Plan([]byte(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("the synced config has changes: %s", plan)
+	}
 }
 
 func TestRemovingRules(t *testing.T) {
+	setupFakeNode(t)
 	var c1 string = `
 rules:
 - from: 172.31.201.11/32
@@ -57,22 +218,26 @@ rules:
 `
 
 	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	waveSync(t, configLifeCycle, c2)
 
-	log.Println("adding c1")
-	configLifeCycle.Update([]byte(c1))
-	configLifeCycle.SyncState()
-
-	// log.Println("Sleeping for 10s ...")
-	// time.Sleep(10 * time.Second)
+	assertEqual(t, "rules of table 101", ruleSources(t, utils.Netlink, 101), "172.31.201.11/32")
+	assertEqual(t, "rules of table 102", ruleSources(t, utils.Netlink, 102))
 
-	log.Println("adding c2")
-	configLifeCycle.Update([]byte(c2))
-	log.Println("Current Configuration: ", configLifeCycle.CurrentConfig.String())
-	log.Println("Old Configuration: ", configLifeCycle.OldConfig.String())
-	configLifeCycle.SyncState()
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "rules of table 101 after remove", ruleSources(t, utils.Netlink, 101))
 }
 
 func TestRule_HardConfiguration(t *testing.T) {
+	fake := setupFakeNode(t)
+	foreign := netlink.NewRule()
+	foreign.Src = &net.IPNet{IP: net.ParseIP("172.31.201.99").To4(), Mask: net.CIDRMask(32, 32)}
+	foreign.Table = 102
+	if err := fake.RuleAdd(foreign); err != nil {
+		t.Fatal(err)
+	}
 	var c1 string = `
 settings:
  table-hard-sync:
@@ -86,23 +251,151 @@ rules:
 `
 
 	configLifeCycle := CreateConfigLifeCycle()
-	configLifeCycle.Update([]byte(c1))
-	log.Println(configLifeCycle.CurrentConfig.Settings)
-	configLifeCycle.SyncRulesState()
-	//	log.Println("adding c1")
-	// log.Println(configLifeCycle.CurrentConfig)
-	// SyncRulesState(configLifeCycle)
+	waveSync(t, configLifeCycle, c1)
+
+	assertEqual(t, "rules of table 101", ruleSources(t, utils.Netlink, 101), "172.31.201.11/32")
+	assertEqual(t, "rules of table 102", ruleSources(t, utils.Netlink, 102), "172.31.201.12/32")
+}
+
+// the rules in the rule-priority-range which are not in the config are removed, whatever their table, and the
+// rules outside of it are left alone
+func TestRule_PriorityRange(t *testing.T) {
+	fake := setupFakeNode(t)
+	for priority, src := range map[int]string{1500: "172.31.201.98", 500: "172.31.201.99"} {
+		foreign := netlink.NewRule()
+		foreign.Src = &net.IPNet{IP: net.ParseIP(src).To4(), Mask: net.CIDRMask(32, 32)}
+		foreign.Table, foreign.Priority = 105, priority
+		if err := fake.RuleAdd(foreign); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var c1 string = `
+settings:
+  rule-priority-range: 1000-1999
+rules:
+- from: 172.31.201.11/32
+  table: 101
+  priority: 1000
+- from: 172.31.201.12/32
+  table: 102
+  priority: 0
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	assertEqual(t, "rules of table 105", ruleSources(t, utils.Netlink, 105), "172.31.201.99/32")
+	rules, _ := fake.RuleList(netlink.FAMILY_V4)
+	for _, rule := range rules {
+		if rule.Table == 102 && rule.Priority != 0 {
+			t.Errorf("rule of table 102: got priority %d, want 0", rule.Priority)
+		}
+	}
+	plan, err := configLifeCycle.Plan([]byte(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("the synced config has changes: %s", plan)
+	}
+
+	// a rule added in the range later is removed by the next sync
+	foreign := netlink.NewRule()
+	foreign.Src = &net.IPNet{IP: net.ParseIP("172.31.201.97").To4(), Mask: net.CIDRMask(32, 32)}
+	foreign.Table, foreign.Priority = 101, 1999
+	fake.RuleAdd(foreign)
+	waveSync(t, configLifeCycle, c1)
+	assertEqual(t, "rules of table 101", ruleSources(t, utils.Netlink, 101), "172.31.201.11/32")
+}
+
+// with owned-only, the routes, rules and vlans tagged by the agent are removed once they leave the config, and
+// the other ones are left alone even in the hard-synced tables
+func TestOwnedOnly(t *testing.T) {
+	fake := setupFakeNode(t)
+	_, foreignDst, _ := net.ParseCIDR("10.30.0.0/16")
+	if err := fake.RouteAdd(&netlink.Route{Dst: foreignDst, Gw: net.ParseIP("10.0.1.1"), LinkIndex: 3, Table: 100}); err != nil {
+		t.Fatal(err)
+	}
+	foreignRule := netlink.NewRule()
+	foreignRule.Src, foreignRule.Table, foreignRule.Priority = foreignDst, 100, 31500
+	if err := fake.RuleAdd(foreignRule); err != nil {
+		t.Fatal(err)
+	}
+	foreignVlan := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "d1.30", ParentIndex: 3}, VlanId: 30}
+	if err := fake.LinkAdd(foreignVlan); err != nil {
+		t.Fatal(err)
+	}
+
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 100
+  owned-only: true
+  route-protocol: 200
+  rule-priority-range: 30000-30999
+  vlan-alias: ipruler
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+routes:
+- to: 10.20.0.0/16
+  via: 172.31.201.1
+  table: 100
+- to: 10.21.0.0/16
+  via: 172.31.201.1
+  table: 100
+rules:
+- from: 10.0.0.0/24
+  table: 100
+  priority: 30000
+- from: 10.0.1.0/24
+  table: 100
+  priority: 30001
+`
+	var c2 string = `
+settings:
+  table-hard-sync:
+  - 100
+  owned-only: true
+  route-protocol: 200
+  rule-priority-range: 30000-30999
+  vlan-alias: ipruler
+routes:
+- to: 10.20.0.0/16
+  via: 172.31.201.1
+  table: 100
+rules:
+- from: 10.0.0.0/24
+  table: 100
+  priority: 30000
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	assertEqual(t, "routes of table 100", routeDestinations(t, utils.Netlink, 100), "10.30.0.0/16", "10.20.0.0/16", "10.21.0.0/16")
+	assertEqual(t, "rules of table 100", ruleSources(t, utils.Netlink, 100), "10.0.0.0/24", "10.0.1.0/24", "10.30.0.0/16")
+
+	// a new agent (e.g. restarted without its state) only knows the tagged objects of the node
+	waveSync(t, CreateConfigLifeCycle(), c2)
+	assertEqual(t, "routes of table 100", routeDestinations(t, utils.Netlink, 100), "10.30.0.0/16", "10.20.0.0/16")
+	assertEqual(t, "rules of table 100", ruleSources(t, utils.Netlink, 100), "10.0.0.0/24", "10.30.0.0/16")
+	if _, err := fake.LinkByName("d0.10"); err == nil {
+		t.Errorf("the vlan tagged by the agent is not removed")
+	}
+	if _, err := fake.LinkByName("d1.30"); err != nil {
+		t.Errorf("the foreign vlan is removed")
+	}
 }
 
 func TestRoute_AddAndHardSync(t *testing.T) {
-	testRoute := &netlink.Route{LinkIndex: 4, Gw: net.ParseIP("172.31.201.1"), Dst: &net.IPNet{IP: net.ParseIP("172.31.201.3"), Mask: net.CIDRMask(32, 32)}, Table: 102}
-	err := netlink.RouteAdd(testRoute)
-	if err == syscall.EEXIST {
-		log.Printf("Test Route (%s) exists.", testRoute)
-	} else if err != nil {
-		log.Fatal(err)
-	} else {
-		log.Printf("Test Route (%s) is added", testRoute)
+	fake := setupFakeNode(t)
+	testRoute := &netlink.Route{
+		LinkIndex: 2,
+		Gw:        net.ParseIP("172.31.201.1"),
+		Dst:       &net.IPNet{IP: net.ParseIP("172.31.201.3").To4(), Mask: net.CIDRMask(32, 32)},
+		Table:     102,
+	}
+	if err := fake.RouteAdd(testRoute); err != nil {
+		t.Fatal(err)
 	}
 
 	var c1 string = `
@@ -124,12 +417,13 @@ routes:
   table: 102
 `
 	configLifeCycle := CreateConfigLifeCycle()
-	configLifeCycle.Update([]byte(c1))
-	configLifeCycle.SyncRoutesState()
-	configLifeCycle.PersistState()
+	waveSync(t, configLifeCycle, c1)
+
+	assertEqual(t, "routes of table 102", routeDestinations(t, utils.Netlink, 102), "0.0.0.0/0", "172.31.201.4/32")
 }
 
 func TestRoute_ConfigChange(t *testing.T) {
+	setupFakeNode(t)
 	var c1 string = `
 settings:
   table-hard-sync:
@@ -166,11 +460,887 @@ routes:
   table: 102
 `
 	configLifeCycle := CreateConfigLifeCycle()
-	configLifeCycle.Update([]byte(c1))
-	configLifeCycle.SyncRoutesState()
-	// PersistState(configLifeCycle)
+	waveSync(t, configLifeCycle, c1)
+	assertEqual(t, "routes of table 102", routeDestinations(t, utils.Netlink, 102), "0.0.0.0/0", "172.31.201.4/32")
+
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "routes of table 102 after the change", routeDestinations(t, utils.Netlink, 102), "172.31.201.4/32")
+}
+
+// dry-run plans the changes of a sync or a remove, and leaves the node as it is
+func TestDryRun(t *testing.T) {
+	setupFakeNode(t)
+	var c1 string = `
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+routes:
+- to: 10.10.0.0/16
+  via: 172.31.201.1
+  table: 110
+rules:
+- from: 10.10.0.0/16
+  table: 110
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	configLifeCycle.DryRun = true
+	plan, err := configLifeCycle.Plan([]byte(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 3 {
+		t.Errorf("plan of the config: got %s, want the vlan, route and rule to add", plan)
+	}
+
+	waveSync(t, configLifeCycle, c1)
+	if _, err := utils.Netlink.LinkByName("d0.10"); err == nil {
+		t.Errorf("vlan is created in dry-run mode")
+	}
+	assertEqual(t, "routes of table 110", routeDestinations(t, utils.Netlink, 110))
+	assertEqual(t, "rules of table 110", ruleSources(t, utils.Netlink, 110))
+
+	// the config synced for real is not removed in dry-run mode
+	configLifeCycle.DryRun = false
+	waveSync(t, configLifeCycle, c1)
+	configLifeCycle.DryRun = true
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "routes of table 110 after a dry-run remove", routeDestinations(t, utils.Netlink, 110), "10.10.0.0/16")
+}
+
+func TestVlans(t *testing.T) {
+	setupFakeNode(t)
+	var c1 string = `
+settings:
+  vlan-alias: ipruler
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+routes:
+- to: 10.10.0.0/16
+  dev: d0.10
+  table: 110
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	link, err := utils.Netlink.LinkByName("d0.10")
+	if err != nil {
+		t.Fatalf("vlan is not created: %s", err)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 || link.Attrs().Alias != "ipruler" {
+		t.Errorf("vlan is not up or not tagged: %+v", link.Attrs())
+	}
+	assertEqual(t, "routes of table 110", routeDestinations(t, utils.Netlink, 110), "10.10.0.0/16")
+
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := utils.Netlink.LinkByName("d0.10"); err == nil {
+		t.Errorf("vlan of the previous config is not deleted")
+	}
+	assertEqual(t, "routes of table 110 after remove", routeDestinations(t, utils.Netlink, 110))
+}
+
+// the attributes of a vlan which have drifted are set again in place, a vlan whose id has changed is created
+// again, and a vlan is kept down when the config wants it down
+func TestVlans_Attributes(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+  mtu: 1400
+  mac: 02:00:00:00:00:10
+  txqlen: 500
+  egress-qos-map:
+    1: 2
+    3: 5
+  gvrp: true
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	vlanByName := func() *netlink.Vlan {
+		t.Helper()
+		link, err := fake.LinkByName("d0.10")
+		if err != nil {
+			t.Fatalf("vlan is not created: %s", err)
+		}
+		return link.(*netlink.Vlan)
+	}
+	vlan := vlanByName()
+	if vlan.MTU != 1400 || vlan.HardwareAddr.String() != "02:00:00:00:00:10" || vlan.TxQLen != 500 ||
+		len(vlan.EgressQosMap) != 2 || vlan.EgressQosMap[3] != 5 || !*vlan.Gvrp || vlan.Flags&net.FlagUp == 0 {
+		t.Errorf("vlan doesn't have the attributes of the config: %s", utils.VlanToString(vlan))
+	}
+	index := vlan.Index
+
+	gvrp := false
+	drift := &netlink.Vlan{
+		LinkAttrs:    netlink.LinkAttrs{Name: "d0.10", MTU: 1300, TxQLen: -1},
+		EgressQosMap: map[uint32]uint32{1: 0, 4: 4},
+		Gvrp:         &gvrp,
+	}
+	if err := fake.LinkModify(drift); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := configLifeCycle.Plan([]byte(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Op != "update" {
+		t.Fatalf("plan of the drifted vlan: %s", plan)
+	}
+	waveSync(t, configLifeCycle, c1)
+	vlan = vlanByName()
+	if vlan.Index != index || vlan.MTU != 1400 || !*vlan.Gvrp || len(vlan.EgressQosMap) != 2 || vlan.EgressQosMap[1] != 2 {
+		t.Errorf("vlan is not updated in place: %s", utils.VlanToString(vlan))
+	}
+
+	// a change of the state is applied in place, a change of the id needs a new vlan
+	var c2 string = `
+vlans:
+- name: d0.10
+  link: d0
+  id: 11
+  state: down
+`
+	waveSync(t, configLifeCycle, c2)
+	vlan = vlanByName()
+	if vlan.Index == index || vlan.VlanId != 11 || vlan.Flags&net.FlagUp != 0 {
+		t.Errorf("vlan is not created again down: %s", utils.VlanToString(vlan))
+	}
+	index = vlan.Index
+	waveSync(t, configLifeCycle, c2[:len(c2)-len("  state: down\n")])
+	if vlan = vlanByName(); vlan.Index != index || vlan.Flags&net.FlagUp == 0 {
+		t.Errorf("vlan is not set up in place: %s", utils.VlanToString(vlan))
+	}
+
+	// a vlan of the node which is not the one of the config (e.g. created by hand) is created again
+	plan, err = CreateConfigLifeCycle().Plan([]byte(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 2 || plan.Changes[0].Reason != "vlan-changed" || plan.Changes[1].Op != "add" {
+		t.Errorf("plan of a vlan with another id: %s", plan)
+	}
+}
+
+// the addresses are added before the routes which use them, and address-hard-sync removes the other addresses of
+// the link (but not the link-local ones)
+func TestAddresses(t *testing.T) {
+	fake := setupFakeNode(t)
+	d1, _ := fake.LinkByName("d1")
+	linkLocal, _ := netlink.ParseAddr("fe80::1/64")
+	fake.AddrAdd(d1, linkLocal)
+	var c1 string = `
+settings:
+  address-hard-sync:
+  - d1
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+addresses:
+- dev: d1
+  cidr: 10.0.1.2/24
+- dev: d1
+  cidr: 10.0.2.2/24
+  label: d1:sec
+  noprefixroute: true
+- dev: d0.10
+  cidr: 2001:db8::2/64
+  valid-lft: 3600
+  preferred-lft: 1800
+routes:
+- to: 172.31.210.0/24
+  src: 10.0.2.2
+  dev: d1
+  table: 110
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	assertEqual(t, "addresses of d1", linkAddresses(t, utils.Netlink, "d1"), "10.0.1.2/24", "fe80::1/64", "10.0.2.2/24")
+	assertEqual(t, "addresses of d0.10", linkAddresses(t, utils.Netlink, "d0.10"), "2001:db8::2/64")
+	assertEqual(t, "routes of table 110", routeDestinations(t, utils.Netlink, 110), "172.31.210.0/24")
+	// no route to the network of a noprefixroute address
+	for _, dst := range routeDestinations(t, utils.Netlink, unix.RT_TABLE_MAIN) {
+		if dst == "10.0.2.0/24" {
+			t.Errorf("route to the network of a noprefixroute address")
+		}
+	}
+
+	// a foreign address of a hard-synced link is removed, and a changed address is replaced
+	foreign, _ := netlink.ParseAddr("10.0.3.2/24")
+	fake.AddrAdd(d1, foreign)
+	var c2 string = `
+settings:
+  address-hard-sync:
+  - d1
+addresses:
+- dev: d1
+  cidr: 10.0.1.2/24
+- dev: d1
+  cidr: 10.0.2.2/24
+`
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "addresses of d1 after the config change", linkAddresses(t, utils.Netlink, "d1"), "10.0.1.2/24", "fe80::1/64", "10.0.2.2/24")
+	addrs, _ := fake.AddrList(d1, netlink.FAMILY_V4)
+	if addrs[1].Label != "d1" || addrs[1].Flags&unix.IFA_F_NOPREFIXROUTE != 0 {
+		t.Errorf("address is not replaced: %+v", addrs[1])
+	}
+
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "addresses of d1 after remove", linkAddresses(t, utils.Netlink, "d1"), "fe80::1/64")
+}
+
+// a change which fails undoes the changes made before it, so the node stays in the previous config
+func TestRollback(t *testing.T) {
+	setupFakeNode(t)
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 102
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+`
+	// the source is not an address of the node, which the kernel rejects
+	var c2 string = `
+settings:
+  table-hard-sync:
+  - 102
+routes:
+- to: 172.31.203.0/24
+  via: 172.31.201.1
+  table: 102
+- to: 172.31.204.0/24
+  via: 172.31.201.1
+  src: 172.31.201.99
+  table: 102
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	err := configLifeCycle.WaveSync([]byte(c2))
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || rollbackErr.RollbackErr != nil {
+		t.Fatalf("got %v, want a rolled back error", err)
+	}
+	if !errors.Is(err, unix.EINVAL) {
+		t.Errorf("got %v, want EINVAL", err)
+	}
+	assertEqual(t, "routes of table 102", routeDestinations(t, utils.Netlink, 102), "172.31.202.0/24")
+
+	// the previous config is still the current one
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "routes of table 102 after removing the config", routeDestinations(t, utils.Netlink, 102))
+}
+
+// undoing the delete of a vlan adds back the addresses and routes the kernel removed along with it, even the
+// ones which are not in the config
+func TestRollback_Vlan(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+addresses:
+- dev: d0.10
+  cidr: 10.10.1.2/24
+routes:
+- to: 10.10.0.0/16
+  dev: d0.10
+  src: 10.10.1.2
+  table: 110
+`
+	// the vlan is deleted before the route which the kernel rejects
+	var c2 string = `
+routes:
+- to: 172.31.204.0/24
+  via: 172.31.201.1
+  src: 172.31.201.99
+  table: 102
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	link, err := fake.LinkByName("d0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dst, _ := net.ParseCIDR("10.11.0.0/16")
+	if err := fake.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Table: 120}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = configLifeCycle.WaveSync([]byte(c2))
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || rollbackErr.RollbackErr != nil {
+		t.Fatalf("got %v, want a rolled back error", err)
+	}
+	restored, err := fake.LinkByName("d0.10")
+	if err != nil {
+		t.Fatalf("vlan is not created again: %s", err)
+	}
+	if restored.Attrs().Index != link.Attrs().Index {
+		t.Errorf("vlan is created again with the index %d, want %d", restored.Attrs().Index, link.Attrs().Index)
+	}
+	assertEqual(t, "addresses of d0.10", linkAddresses(t, fake, "d0.10"), "10.10.1.2/24")
+	assertEqual(t, "routes of table 110", routeDestinations(t, fake, 110), "10.10.0.0/16")
+	assertEqual(t, "routes of table 120", routeDestinations(t, fake, 120), "10.11.0.0/16")
+	assertEqual(t, "routes of table 102", routeDestinations(t, fake, 102))
+}
+
+func TestReconcile(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+rules:
+- from: 172.31.201.11/32
+  table: 101
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 101
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	route := configLifeCycle.CurrentConfig.Routes[0]
+	if err := fake.RouteDel(route); err != nil {
+		t.Fatal(err)
+	}
+	if err := configLifeCycle.Reconcile(map[string]bool{"routes": true}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "routes of table 101", routeDestinations(t, utils.Netlink, 101), "172.31.202.0/24")
+}
+
+// The watcher sets an owned vlan which is set down up again, and installs the routes of the config the kernel
+// flushed along with it. Once a link is operational again, only the routes of the config through it are installed
+// again, and the links which are not in the config are left down.
+func TestWatch_VlanUpAndRoutes(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+settings:
+  vlan-alias: ipruler
+vlans:
+- name: d0.10
+  link: d0
+  id: 10
+addresses:
+- dev: d0.10
+  cidr: 10.10.1.2/24
+routes:
+- to: 10.10.0.0/16
+  dev: d0.10
+  table: 110
+- to: 172.31.210.0/24
+  via: 10.0.1.1
+  table: 111
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	d1, _ := fake.LinkByName("d1")
+	foreignVlan := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "d1.20", ParentIndex: d1.Attrs().Index, Flags: net.FlagUp}, VlanId: 20}
+	if err := fake.LinkAdd(foreignVlan); err != nil {
+		t.Fatal(err)
+	}
+	_, dst, _ := net.ParseCIDR("172.31.211.0/24")
+	if err := fake.RouteAdd(&netlink.Route{LinkIndex: d1.Attrs().Index, Dst: dst, Gw: net.ParseIP("10.0.1.1"), Table: 111}); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	exec := func(f func()) {
+		lock.Lock()
+		defer lock.Unlock()
+		f()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go configLifeCycle.Watch(exec, done)
+	// waits until the link is up again and the routes of the tables are the wanted ones
+	waitFor := func(name string, tables map[int][]string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * WATCH_DEBOUNCE)
+		for {
+			lock.Lock()
+			link, err := fake.LinkByName(name)
+			synced := err == nil && link.Attrs().Flags&net.FlagUp != 0
+			for table, want := range tables {
+				got := routeDestinations(t, fake, table)
+				synced = synced && len(got) == len(want) && (len(want) == 0 || got[0] == want[0])
+			}
+			lock.Unlock()
+			if synced {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("link %s is not up with the routes of the config: %v", name, link)
+			}
+			time.Sleep(WATCH_DEBOUNCE / 5)
+		}
+	}
+
+	time.Sleep(2 * WATCH_DEBOUNCE)
+	vlan, _ := fake.LinkByName("d0.10")
+	fake.LinkSetDown(vlan)
+	fake.LinkSetDown(foreignVlan)
+	assertEqual(t, "routes of table 110 of the vlan which is down", routeDestinations(t, fake, 110))
+	waitFor("d0.10", map[int][]string{110: {"10.10.0.0/16"}})
+
+	// the foreign route through d1 is flushed along with the link, and not installed again
+	fake.LinkSetDown(d1)
+	fake.LinkSetUp(d1)
+	waitFor("d1", map[int][]string{111: {"172.31.210.0/24"}})
+	time.Sleep(2 * WATCH_DEBOUNCE)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assertEqual(t, "routes of table 111", routeDestinations(t, fake, 111), "172.31.210.0/24")
+	if link, _ := fake.LinkByName("d1.20"); link.Attrs().Flags&net.FlagUp != 0 {
+		t.Errorf("the vlan which is not in the config is set up")
+	}
+}
+
+// the watcher installs the routes flushed along with a link which goes down, once the link is up again
+func TestWatch(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 101
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	var lock sync.Mutex
+	exec := func(f func()) {
+		lock.Lock()
+		defer lock.Unlock()
+		f()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go configLifeCycle.Watch(exec, done)
+
+	d0, _ := fake.LinkByName("d0")
+	time.Sleep(2 * WATCH_DEBOUNCE)
+	fake.LinkSetDown(d0)
+	fake.LinkSetUp(d0)
+
+	deadline := time.Now().Add(10 * WATCH_DEBOUNCE)
+	for {
+		lock.Lock()
+		routes := routeDestinations(t, utils.Netlink, 101)
+		lock.Unlock()
+		if len(routes) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routes of table 101: got %v, want the route of the config", routes)
+		}
+		time.Sleep(WATCH_DEBOUNCE / 5)
+	}
+}
+
+// the watcher adds an address of the config which is deleted again, and removes an address which is added to a
+// hard-synced link
+func TestWatch_Addresses(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+settings:
+  address-hard-sync:
+  - d1
+addresses:
+- dev: d1
+  cidr: 10.0.1.2/24
+- dev: d1
+  cidr: 10.0.2.2/24
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	addr := configLifeCycle.CurrentConfig.Addresses[1]
+
+	var lock sync.Mutex
+	exec := func(f func()) {
+		lock.Lock()
+		defer lock.Unlock()
+		f()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go configLifeCycle.Watch(exec, done)
+
+	d1, _ := fake.LinkByName("d1")
+	time.Sleep(2 * WATCH_DEBOUNCE)
+	fake.AddrDel(d1, addr)
+	foreign, _ := netlink.ParseAddr("10.0.3.2/24")
+	fake.AddrAdd(d1, foreign)
+
+	deadline := time.Now().Add(10 * WATCH_DEBOUNCE)
+	for {
+		lock.Lock()
+		addrs := linkAddresses(t, utils.Netlink, "d1")
+		lock.Unlock()
+		if len(addrs) == 2 && addrs[1] == "10.0.2.2/24" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("addresses of d1: got %v, want the addresses of the config", addrs)
+		}
+		time.Sleep(WATCH_DEBOUNCE / 5)
+	}
+}
+
+// a burst of notifications doesn't hold the config once for each of them, they're sorted out and the foreign
+// routes of a hard-synced table are removed in a single call of exec
+func TestWatch_Batched(t *testing.T) {
+	fake := setupFakeNode(t)
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 101
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 101
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	var lock sync.Mutex
+	calls := 0
+	exec := func(f func()) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		f()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go configLifeCycle.Watch(exec, done)
+
+	d0, _ := fake.LinkByName("d0")
+	time.Sleep(2 * WATCH_DEBOUNCE)
+	lock.Lock()
+	calls = 0
+	lock.Unlock()
+	for i := 0; i < 50; i++ {
+		_, dst, _ := net.ParseCIDR(fmt.Sprintf("10.50.%d.0/24", i))
+		if err := fake.RouteAdd(&netlink.Route{LinkIndex: d0.Attrs().Index, Dst: dst, Table: 101}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(3 * WATCH_DEBOUNCE)
+	lock.Lock()
+	defer lock.Unlock()
+	// once for the notifications, and once for the ones of the routes it removes
+	if calls != 2 {
+		t.Errorf("exec is called %d times for the notifications, want twice", calls)
+	}
+	assertEqual(t, "routes of table 101", routeDestinations(t, utils.Netlink, 101), "172.31.202.0/24")
+}
+
+// The persisted script adds the items of every namespace there with `ip -n`, and looks up their links in their
+// namespace. A namespace given by a path can't be persisted, and nothing is persisted then.
+func TestPersistState(t *testing.T) {
+	setupFakeNode(t)
+	fakes := setupFakeNamespaces(t, "blue", "/run/netns/red")
+	// a link which only blue has, after the ones of the fake node
+	b0 := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "b0", Flags: net.FlagUp}}
+	if err := fakes["blue"].LinkAdd(b0); err != nil {
+		t.Fatal(err)
+	}
+	var c1 string = `
+vlans:
+- name: b0.10
+  link: b0
+  id: 10
+  namespace: blue
+addresses:
+- dev: b0
+  cidr: 10.4.0.2/24
+  namespace: blue
+routes:
+- to: 172.31.205.0/24
+  dev: b0
+  table: 102
+  namespace: blue
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+rules:
+- from: 172.31.201.11/32
+  table: 102
+  namespace: blue
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	script, err := configLifeCycle.persistedScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{
+		"ip -n blue link add link b0 name b0.10 type vlan id 10; ip -n blue link set b0.10 up;\n",
+		"ip -n blue address add 10.4.0.2/24 dev b0;\n",
+		"ip -n blue route add to 172.31.205.0/24 table 102 dev b0 proto boot scope global;\n",
+		"ip -n blue rule add from 172.31.201.11/32 table 102;\n",
+		"\nip route add to 172.31.202.0/24 via 172.31.201.1 table 102 dev d0 proto boot scope global;\n",
+	} {
+		if !strings.Contains(script, command) {
+			t.Errorf("script without %q:\n%s", command, script)
+		}
+	}
+
+	// the links of the namespace of the config are looked up there as well
+	var c2 string = `
+namespace: blue
+routes:
+- to: 172.31.206.0/24
+  dev: b0
+  table: 102
+`
+	waveSync(t, configLifeCycle, c2)
+	if script, err := configLifeCycle.persistedScript(); err != nil || !strings.Contains(script, "\nip -n blue route add to 172.31.206.0/24 table 102 dev b0 ") {
+		t.Errorf("script of the namespace of the config: %s, %v", script, err)
+	}
+
+	var c3 string = `
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+- to: 172.31.203.0/24
+  via: 172.31.201.1
+  table: 102
+  namespace: /run/netns/red
+`
+	waveSync(t, configLifeCycle, c3)
+	if script, err := configLifeCycle.persistedScript(); err == nil {
+		t.Errorf("script of a namespace given by a path: %s", script)
+	}
+}
+
+// the items of another namespace are synced there with the settings of the config, and removed from there once
+// they are no more in the config
+func TestNamespaces(t *testing.T) {
+	setupFakeNode(t)
+	blue := setupFakeNamespaces(t, "blue")["blue"]
+	foreign := &netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("172.31.209.0").To4(), Mask: net.CIDRMask(24, 32)}, LinkIndex: 2, Table: 102}
+	if err := blue.RouteAdd(foreign); err != nil {
+		t.Fatal(err)
+	}
+	var c1 string = `
+settings:
+  table-hard-sync:
+  - 102
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+- to: 172.31.203.0/24
+  via: 172.31.201.1
+  table: 102
+  namespace: blue
+rules:
+- from: 172.31.201.11/32
+  table: 102
+  namespace: blue
+`
+	var c2 string = `
+settings:
+  table-hard-sync:
+  - 102
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	assertEqual(t, "routes of table 102", routeDestinations(t, utils.Netlink, 102), "172.31.202.0/24")
+	assertEqual(t, "routes of table 102 in blue", routeDestinations(t, blue, 102), "172.31.203.0/24")
+	assertEqual(t, "rules of table 102", ruleSources(t, utils.Netlink, 102))
+	assertEqual(t, "rules of table 102 in blue", ruleSources(t, blue, 102), "172.31.201.11/32")
 
-	configLifeCycle.Update([]byte(c2))
-	configLifeCycle.SyncRoutesState()
-	// PersistState(configLifeCycle)
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "routes of table 102 after the change", routeDestinations(t, utils.Netlink, 102), "172.31.202.0/24")
+	assertEqual(t, "routes of table 102 in blue after the change", routeDestinations(t, blue, 102))
+	assertEqual(t, "rules of table 102 in blue after the change", ruleSources(t, blue, 102))
+}
+
+// the objects of the config move along with the namespace of the config, and a failure in a namespace rolls back
+// the changes made in the others
+func TestNamespaces_MoveAndRollback(t *testing.T) {
+	setupFakeNode(t)
+	fakes := setupFakeNamespaces(t, "blue", "green")
+	var c1 string = `
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+`
+	var c2 string = `
+namespace: blue
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+`
+	// the source is not an address of green
+	var c3 string = `
+namespace: blue
+routes:
+- to: 172.31.203.0/24
+  via: 172.31.201.1
+  table: 102
+- to: 172.31.204.0/24
+  via: 172.31.201.1
+  src: 172.31.201.99
+  table: 102
+  namespace: green
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "routes of table 102", routeDestinations(t, utils.Netlink, 102))
+	assertEqual(t, "routes of table 102 in blue", routeDestinations(t, fakes["blue"], 102), "172.31.202.0/24")
+
+	err := configLifeCycle.WaveSync([]byte(c3))
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || rollbackErr.RollbackErr != nil || !errors.Is(err, unix.EINVAL) {
+		t.Fatalf("got %v, want EINVAL rolled back", err)
+	}
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) || syncErr.Namespace != "green" {
+		t.Errorf("got %v, want the error of namespace green", err)
+	}
+	assertEqual(t, "routes of table 102 in blue", routeDestinations(t, fakes["blue"], 102), "172.31.202.0/24")
+	assertEqual(t, "routes of table 102 in green", routeDestinations(t, fakes["green"], 102))
+
+	if err := configLifeCycle.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "routes of table 102 in blue after remove", routeDestinations(t, fakes["blue"], 102))
+}
+
+// the objects of a namespace which is deleted are forgotten
+func TestNamespaces_Deleted(t *testing.T) {
+	setupFakeNode(t)
+	fakes := setupFakeNamespaces(t, "blue")
+	var c1 string = `
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+  namespace: blue
+`
+	var c2 string = `
+routes:
+- to: 172.31.203.0/24
+  via: 172.31.201.1
+  table: 102
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+	delete(fakes, "blue")
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "routes of table 102", routeDestinations(t, utils.Netlink, 102), "172.31.203.0/24")
+	if len(configLifeCycle.namespaces) != 0 {
+		t.Errorf("the namespace is not forgotten: %v", configLifeCycle.namespaces)
+	}
+}
+
+// a restored config removes the objects of its namespaces which are no more in the next config
+func TestNamespaces_Restore(t *testing.T) {
+	setupFakeNode(t)
+	blue := setupFakeNamespaces(t, "blue")["blue"]
+	var c1 string = `
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 102
+  namespace: blue
+`
+	var c2 string = `
+routes:
+- to: 172.31.203.0/24
+  via: 172.31.201.1
+  table: 102
+`
+	waveSync(t, CreateConfigLifeCycle(), c1)
+	configLifeCycle := CreateConfigLifeCycle()
+	if err := configLifeCycle.Restore([]byte(c1)); err != nil {
+		t.Fatal(err)
+	}
+	waveSync(t, configLifeCycle, c2)
+	assertEqual(t, "routes of table 102 in blue", routeDestinations(t, blue, 102))
+}
+
+// the watcher watches the namespace the config moves to
+func TestWatch_Moved(t *testing.T) {
+	setupFakeNode(t)
+	blue := setupFakeNamespaces(t, "blue")["blue"]
+	var c1 string = `
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 101
+`
+	var c2 string = `
+namespace: blue
+routes:
+- to: 172.31.202.0/24
+  via: 172.31.201.1
+  table: 101
+`
+	configLifeCycle := CreateConfigLifeCycle()
+	waveSync(t, configLifeCycle, c1)
+
+	var lock sync.Mutex
+	exec := func(f func()) {
+		lock.Lock()
+		defer lock.Unlock()
+		f()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go configLifeCycle.KeepWatching(exec, done)
+	time.Sleep(2 * WATCH_DEBOUNCE)
+	exec(func() { waveSync(t, configLifeCycle, c2) })
+
+	d0, _ := blue.LinkByName("d0")
+	time.Sleep(2 * WATCH_DEBOUNCE)
+	blue.LinkSetDown(d0)
+	blue.LinkSetUp(d0)
+
+	deadline := time.Now().Add(10 * WATCH_DEBOUNCE)
+	for {
+		lock.Lock()
+		routes := routeDestinations(t, blue, 101)
+		lock.Unlock()
+		if len(routes) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routes of table 101 in blue: got %v, want the route of the config", routes)
+		}
+		time.Sleep(WATCH_DEBOUNCE / 5)
+	}
 }
@@ -0,0 +1,671 @@
+package ipruler
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"syscall"
+
+	"github.com/plutocholia/ipruler/internal/config"
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// A change the agent makes to the node
+type Change struct {
+	// add, delete, update (the alias and attributes of a vlan), up or down (a vlan) or write (the tables)
+	Op string `json:"op"`
+	// tables, vlan, address, route or rule
+	Object string `json:"object"`
+	// why an object is deleted, e.g. table-hard-sync, address-hard-sync or sync-removed-config (empty for the objects of the config)
+	Reason string `json:"reason,omitempty"`
+	Item   string `json:"item"`
+	// the network namespace of the object, empty for the one of the agent
+	Namespace string `json:"namespace,omitempty"`
+
+	tables map[string]int
+	vlan   *netlink.Vlan
+	addr   *netlink.Addr
+	route  *netlink.Route
+	rule   *netlink.Rule
+
+	// the state an update or write changes, to undo it
+	prevTables map[string]int
+	prevVlan   *netlink.Vlan
+	// the addresses and routes of a deleted vlan (which the kernel removes along with it), to undo the delete
+	vlanAddrs  []netlink.Addr
+	vlanRoutes []netlink.Route
+	// the handle of the namespace the change is applied in
+	netlink utils.NetlinkHandle
+}
+
+func (ch *Change) String() string {
+	result := fmt.Sprintf("%s %s (%s)", ch.Op, ch.Object, ch.Item)
+	if ch.Reason != "" {
+		result = fmt.Sprintf("[%s] %s", ch.Reason, result)
+	}
+	if ch.Namespace != "" {
+		result += " in namespace " + ch.Namespace
+	}
+	return result
+}
+
+// The changes of a sync, in the order they are applied
+type Plan struct {
+	Changes []*Change `json:"changes"`
+}
+
+func (p *Plan) String() string {
+	if len(p.Changes) == 0 {
+		return "no changes"
+	}
+	result := ""
+	for _, change := range p.Changes {
+		result += "\n\t" + change.String()
+	}
+	return result
+}
+
+func writeTablesChange(tables map[string]int) *Change {
+	return &Change{Op: "write", Object: "tables", Item: fmt.Sprint(tables), tables: tables, prevTables: utils.OwnedTables()}
+}
+
+func vlanChange(op string, reason string, vlan *netlink.Vlan) *Change {
+	return &Change{Op: op, Object: "vlan", Reason: reason, Item: utils.VlanToString(vlan), vlan: vlan}
+}
+
+// Returns the change that deletes the vlan, which is the link of the node. It keeps the index of the link, and
+// its addresses and routes except the ones the kernel adds on its own, so that undoing the delete adds them back.
+func (c *ConfigLifeCycle) vlanDeleteChange(reason string, vlan *netlink.Vlan, link netlink.Link) (*Change, error) {
+	deleted := *vlan
+	deleted.Index = link.Attrs().Index
+	change := vlanChange("delete", reason, &deleted)
+
+	addrs, err := c.handle.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, &SyncError{Reason: reason, Op: "listing", Object: "addresses", Item: vlan.Name, Err: err}
+	}
+	for _, addr := range addrs {
+		if utils.GetIPFamily(addr.IP) == netlink.FAMILY_V6 && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		change.vlanAddrs = append(change.vlanAddrs, addr)
+	}
+	for _, family := range utils.IPFamilies {
+		routes, err := c.handle.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, &SyncError{Reason: reason, Op: "listing", Object: "routes", Item: vlan.Name, Err: err}
+		}
+		for _, route := range routes {
+			through := route.LinkIndex == deleted.Index
+			for _, nexthop := range route.MultiPath {
+				through = through || nexthop.LinkIndex == deleted.Index
+			}
+			if through && route.Protocol != unix.RTPROT_KERNEL {
+				change.vlanRoutes = append(change.vlanRoutes, route)
+			}
+		}
+	}
+	return change, nil
+}
+
+// Returns the change that updates the alias and attributes of the machine vlan to the ones of the config vlan.
+// Only the attributes the config sets are changed, and the mappings of the QoS maps which are not in the config
+// are deleted (mapped to 0).
+func vlanUpdateChange(vlan *netlink.Vlan, machineVlan *netlink.Vlan) *Change {
+	update, prev := &netlink.Vlan{LinkAttrs: netlink.NewLinkAttrs()}, &netlink.Vlan{LinkAttrs: netlink.NewLinkAttrs()}
+	for _, v := range []*netlink.Vlan{update, prev} {
+		v.Name, v.Index, v.ParentIndex = machineVlan.Name, machineVlan.Index, machineVlan.ParentIndex
+		v.VlanId, v.VlanProtocol = machineVlan.VlanId, machineVlan.VlanProtocol
+	}
+	update.Alias, prev.Alias = cmp.Or(vlan.Alias, machineVlan.Alias), machineVlan.Alias
+	if vlan.MTU > 0 {
+		update.MTU, prev.MTU = vlan.MTU, machineVlan.MTU
+	}
+	if vlan.TxQLen >= 0 {
+		update.TxQLen, prev.TxQLen = vlan.TxQLen, machineVlan.TxQLen
+	}
+	if vlan.HardwareAddr != nil {
+		update.HardwareAddr, prev.HardwareAddr = vlan.HardwareAddr, machineVlan.HardwareAddr
+	}
+	if vlan.Gvrp != nil {
+		update.Gvrp, prev.Gvrp = vlan.Gvrp, machineVlan.Gvrp
+	}
+	if vlan.Mvrp != nil {
+		update.Mvrp, prev.Mvrp = vlan.Mvrp, machineVlan.Mvrp
+	}
+	if vlan.LooseBinding != nil {
+		update.LooseBinding, prev.LooseBinding = vlan.LooseBinding, machineVlan.LooseBinding
+	}
+	if vlan.IngressQosMap != nil {
+		update.IngressQosMap, prev.IngressQosMap = qosMapUpdate(vlan.IngressQosMap, machineVlan.IngressQosMap), qosMapUpdate(machineVlan.IngressQosMap, vlan.IngressQosMap)
+	}
+	if vlan.EgressQosMap != nil {
+		update.EgressQosMap, prev.EgressQosMap = qosMapUpdate(vlan.EgressQosMap, machineVlan.EgressQosMap), qosMapUpdate(machineVlan.EgressQosMap, vlan.EgressQosMap)
+	}
+
+	change := vlanChange("update", "", update)
+	change.prevVlan = prev
+	return change
+}
+
+// the mappings of qosMap, and the ones of the other map deleted
+func qosMapUpdate(qosMap map[uint32]uint32, other map[uint32]uint32) map[uint32]uint32 {
+	update := maps.Clone(qosMap)
+	if update == nil {
+		update = map[uint32]uint32{}
+	}
+	for from := range other {
+		if _, exists := update[from]; !exists {
+			update[from] = 0
+		}
+	}
+	return update
+}
+
+func addrChange(op string, reason string, addr *netlink.Addr) *Change {
+	return &Change{Op: op, Object: "address", Reason: reason, Item: utils.AddrToString(addr), addr: addr}
+}
+
+func routeChange(op string, reason string, route *netlink.Route) *Change {
+	return &Change{Op: op, Object: "route", Reason: reason, Item: route.String(), route: route}
+}
+
+func ruleChange(op string, reason string, rule *netlink.Rule) *Change {
+	return &Change{Op: op, Object: "rule", Reason: reason, Item: rule.String(), rule: rule}
+}
+
+// Plans writing the tables of the current config to the rt_tables.d file owned by the agent. The tables of the
+// node are written once, by the life cycle of the config.
+func (c *ConfigLifeCycle) planTables() ([]*Change, error) {
+	if c.itemsOnly || !utils.OwnedTablesChanged(c.CurrentConfig.Tables) {
+		return nil, nil
+	}
+	return []*Change{writeTablesChange(c.CurrentConfig.Tables)}, nil
+}
+
+// The plan functions compare the config with the node, the deletes of a plan come before its adds.
+func (c *ConfigLifeCycle) planVlans() ([]*Change, error) {
+	deletes := []*Change{}
+	adds := []*Change{}
+	deleted := make(map[string]bool)
+	curVlans := c.CurrentConfig.Vlans
+	curSettings := c.CurrentConfig.Settings
+
+	// delete removed vlans based on old config
+	if c.OldConfig != nil {
+		for _, oldVlan := range c.OldConfig.Vlans {
+			vlanExists := false
+			for _, curVlan := range curVlans {
+				if utils.VlanEquality(oldVlan, curVlan) {
+					vlanExists = true
+					break
+				}
+			}
+			if link, err := c.handle.LinkByName(oldVlan.Name); !vlanExists && err == nil && !deleted[oldVlan.Name] {
+				change, err := c.vlanDeleteChange("sync-removed-config", oldVlan, link)
+				if err != nil {
+					return nil, err
+				}
+				deletes = append(deletes, change)
+				deleted[oldVlan.Name] = true
+			}
+		}
+	}
+	// remove the vlans tagged with the vlan-alias of the agent
+	if curSettings.OwnedOnly {
+		machineLinks, err := c.handle.LinkList()
+		if err != nil {
+			return nil, &SyncError{Reason: "owned-only", Op: "listing", Object: "links", Item: "all", Err: err}
+		}
+		for _, machineLink := range machineLinks {
+			machineVlan, ok := machineLink.(*netlink.Vlan)
+			if !ok || machineVlan.Alias != curSettings.VlanAlias || deleted[machineVlan.Name] {
+				continue
+			}
+			vlanExists := false
+			for _, curVlan := range curVlans {
+				if machineVlan.Name == curVlan.Name {
+					vlanExists = true
+					break
+				}
+			}
+			if !vlanExists {
+				change, err := c.vlanDeleteChange("owned-only", machineVlan, machineVlan)
+				if err != nil {
+					return nil, err
+				}
+				deletes = append(deletes, change)
+				deleted[machineVlan.Name] = true
+			}
+		}
+	}
+	// add vlans, create again the ones whose id, protocol or link has changed, update the alias (e.g. a vlan
+	// created before the vlan-alias was set is tagged as owned by the agent) and the attributes which have drifted
+	// in place, and set them up or down as the config wants
+	for _, vlan := range curVlans {
+		link, err := c.handle.LinkByName(vlan.Name)
+		if err != nil || deleted[vlan.Name] {
+			adds = append(adds, vlanChange("add", "", vlan))
+			continue
+		}
+		machineVlan, ok := link.(*netlink.Vlan)
+		if !ok {
+			return nil, &SyncError{Op: "adding", Object: "vlan", Item: utils.VlanToString(vlan), Err: fmt.Errorf("link %s exists and is not a vlan", vlan.Name)}
+		}
+		if !utils.VlanEquality(vlan, machineVlan) {
+			change, err := c.vlanDeleteChange("vlan-changed", machineVlan, machineVlan)
+			if err != nil {
+				return nil, err
+			}
+			deletes = append(deletes, change)
+			deleted[vlan.Name] = true
+			adds = append(adds, vlanChange("add", "", vlan))
+			continue
+		}
+		if (vlan.Alias != "" && machineVlan.Alias != vlan.Alias) || !utils.VlanAttributesEqual(vlan, machineVlan) {
+			adds = append(adds, vlanUpdateChange(vlan, machineVlan))
+		}
+		if up := vlan.Flags&net.FlagUp != 0; up && machineVlan.Flags&net.FlagUp == 0 {
+			adds = append(adds, vlanChange("up", "", vlan))
+		} else if !up && machineVlan.Flags&net.FlagUp != 0 {
+			adds = append(adds, vlanChange("down", "", vlan))
+		}
+	}
+	return append(deletes, adds...), nil
+}
+
+// The addresses of the hard-synced links which are not in the config are removed, except the IPv6 link-local
+// addresses the kernel adds to every link.
+func (c *ConfigLifeCycle) planAddresses() ([]*Change, error) {
+	deletes := []*Change{}
+	adds := []*Change{}
+	curAddrs := c.CurrentConfig.Addresses
+	curSettings := c.CurrentConfig.Settings
+
+	machineAddrs, err := c.handle.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, &SyncError{Op: "listing", Object: "addresses", Item: "all", Err: err}
+	}
+	deleted := make([]bool, len(machineAddrs))
+	inConfig := func(machineAddr *netlink.Addr) bool {
+		for _, addr := range curAddrs {
+			if utils.AddrEquality(machineAddr, addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the hard-synced links which are not in this namespace are left to the other namespaces of the config
+	hardSynced := make(map[int]bool)
+	for dev := range curSettings.AddressHardSync {
+		if link, err := c.handle.LinkByName(dev); err == nil {
+			hardSynced[link.Attrs().Index] = true
+		}
+	}
+	for i := range machineAddrs {
+		machineAddr := &machineAddrs[i]
+		if !hardSynced[machineAddr.LinkIndex] || inConfig(machineAddr) {
+			continue
+		}
+		if utils.GetIPFamily(machineAddr.IP) == netlink.FAMILY_V6 && machineAddr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		deletes = append(deletes, addrChange("delete", "address-hard-sync", machineAddr))
+		deleted[i] = true
+	}
+	// delete removed addresses based on old config
+	if c.OldConfig != nil {
+		for _, oldAddr := range c.OldConfig.Addresses {
+			addrExists := false
+			for _, curAddr := range curAddrs {
+				if utils.AddrEquality(oldAddr, curAddr) {
+					addrExists = true
+					break
+				}
+			}
+			if addrExists {
+				continue
+			}
+			for i := range machineAddrs {
+				if !deleted[i] && utils.AddrEquality(&machineAddrs[i], oldAddr) {
+					deletes = append(deletes, addrChange("delete", "sync-removed-config", &machineAddrs[i]))
+					deleted[i] = true
+					break
+				}
+			}
+		}
+	}
+	// add addresses
+	for _, addr := range curAddrs {
+		addrExists := false
+		for i := range machineAddrs {
+			if !deleted[i] && utils.AddrEquality(&machineAddrs[i], addr) {
+				addrExists = true
+				break
+			}
+		}
+		if !addrExists {
+			adds = append(adds, addrChange("add", "", addr))
+		}
+	}
+	return append(deletes, adds...), nil
+}
+
+func (c *ConfigLifeCycle) planRoutes() ([]*Change, error) {
+	deletes := []*Change{}
+	adds := []*Change{}
+	curRoutes := c.CurrentConfig.Routes
+	curSettings := c.CurrentConfig.Settings
+
+	// the routes of every table (each family has its own set of tables)
+	machineRoutes := []netlink.Route{}
+	for _, family := range utils.IPFamilies {
+		familyRoutes, err := c.handle.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, &SyncError{Op: "listing", Object: "routes", Item: "all", Err: err}
+		}
+		machineRoutes = append(machineRoutes, familyRoutes...)
+	}
+	deleted := make([]bool, len(machineRoutes))
+	inConfig := func(machineRoute *netlink.Route) bool {
+		for _, route := range curRoutes {
+			if utils.RouteEquality(machineRoute, route) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := range machineRoutes {
+		machineRoute := &machineRoutes[i]
+		// with owned-only, the routes tagged with the route-protocol of the agent are removed from every
+		// table, and table-hard-sync only removes those routes
+		reason := ""
+		if curSettings.OwnedOnly && int(machineRoute.Protocol) == curSettings.RouteProtocol {
+			reason = "owned-only"
+		} else if curSettings.TableHardSync[machineRoute.Table] && !curSettings.OwnedOnly {
+			reason = "table-hard-sync"
+		}
+		if reason != "" && !inConfig(machineRoute) {
+			deletes = append(deletes, routeChange("delete", reason, machineRoute))
+			deleted[i] = true
+		}
+	}
+	// delete removed routes based on old config
+	if c.OldConfig != nil {
+		for _, oldRoute := range c.OldConfig.Routes {
+			routeExists := false
+			for _, curRoute := range curRoutes {
+				if utils.RouteEquality(oldRoute, curRoute) {
+					routeExists = true
+					break
+				}
+			}
+			if routeExists {
+				continue
+			}
+			for i := range machineRoutes {
+				if !deleted[i] && utils.RouteEquality(&machineRoutes[i], oldRoute) {
+					deletes = append(deletes, routeChange("delete", "sync-removed-config", &machineRoutes[i]))
+					deleted[i] = true
+					break
+				}
+			}
+		}
+	}
+	// add routes
+	for _, route := range curRoutes {
+		routeExists := false
+		for i := range machineRoutes {
+			if !deleted[i] && utils.RouteEquality(&machineRoutes[i], route) {
+				routeExists = true
+				break
+			}
+		}
+		if !routeExists {
+			adds = append(adds, routeChange("add", "", route))
+		}
+	}
+	return append(deletes, adds...), nil
+}
+
+func (c *ConfigLifeCycle) planRules() ([]*Change, error) {
+	deletes := []*Change{}
+	adds := []*Change{}
+	curRules := c.CurrentConfig.Rules
+	curSettings := c.CurrentConfig.Settings
+
+	machineRules, err := c.handle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, &SyncError{Op: "listing", Object: "rules", Item: "all", Err: err}
+	}
+	deleted := make([]bool, len(machineRules))
+
+	// remove rules base on table-hard-sync and the owned rule-priority-range (with owned-only, table-hard-sync
+	// only removes the rules inside the rule-priority-range)
+	for i := range machineRules {
+		machineRule := &machineRules[i]
+		if utils.IsDefaultRule(machineRule) {
+			continue
+		}
+		reason := ""
+		if curSettings.RulePriorityRange.Contains(machineRule.Priority) {
+			reason = "rule-priority-range"
+		} else if curSettings.TableHardSync[machineRule.Table] && !curSettings.OwnedOnly {
+			reason = "table-hard-sync"
+		}
+		if reason == "" {
+			continue
+		}
+		machineRuleExists := false
+		for _, curRule := range curRules {
+			if utils.RuleEquality(machineRule, curRule) {
+				machineRuleExists = true
+				break
+			}
+		}
+		if !machineRuleExists {
+			deletes = append(deletes, ruleChange("delete", reason, machineRule))
+			deleted[i] = true
+		}
+	}
+	// delete removed rules based on old config
+	if c.OldConfig != nil {
+		for _, oldRule := range c.OldConfig.Rules {
+			ruleExists := false
+			for _, curRule := range curRules {
+				// a changed priority makes it a different rule (unlike comparing with the machine rules)
+				if utils.RuleEquality(oldRule, curRule) && oldRule.Priority == curRule.Priority {
+					ruleExists = true
+					break
+				}
+			}
+			if ruleExists {
+				continue
+			}
+			for i := range machineRules {
+				if !deleted[i] && utils.RuleEquality(&machineRules[i], oldRule) {
+					deletes = append(deletes, ruleChange("delete", "sync-removed-config", &machineRules[i]))
+					deleted[i] = true
+					break
+				}
+			}
+		}
+	}
+	// add rules
+	for _, rule := range curRules {
+		ruleExists := false
+		for i := range machineRules {
+			if !deleted[i] && utils.RuleEquality(&machineRules[i], rule) {
+				ruleExists = true
+				break
+			}
+		}
+		if !ruleExists {
+			adds = append(adds, ruleChange("add", "", rule))
+		}
+	}
+	return append(deletes, adds...), nil
+}
+
+// Applies the changes, it goes on with the other changes when a change fails, and returns the errors of all of them.
+func applyChanges(changes []*Change) error {
+	return (&transaction{}).apply(changes)
+}
+
+// A transaction records the changes which are applied, so that they can be undone when the sync fails
+type transaction struct {
+	applied []*Change
+}
+
+func (t *transaction) apply(changes []*Change) error {
+	errs := []error{}
+	for _, change := range changes {
+		applied, err := change.apply()
+		if applied {
+			t.applied = append(t.applied, change)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return config.JoinErrors(errs)
+}
+
+// Undoes the applied changes in reverse order, it goes on with the other changes when undoing a change fails.
+func (t *transaction) rollback() error {
+	errs := []error{}
+	for i := len(t.applied) - 1; i >= 0; i-- {
+		if _, err := t.applied[i].undo().apply(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.applied = nil
+	return config.JoinErrors(errs)
+}
+
+// Returns the change that undoes the change
+func (ch *Change) undo() *Change {
+	undo := *ch
+	undo.Reason = "rollback"
+	switch ch.Op {
+	case "add":
+		undo.Op = "delete"
+	case "delete":
+		undo.Op = "add"
+	case "up":
+		undo.Op = "down"
+	case "down":
+		undo.Op = "up"
+	case "update":
+		undo.vlan, undo.prevVlan = ch.prevVlan, ch.vlan
+		undo.Item = utils.VlanToString(ch.prevVlan)
+	case "write":
+		undo.tables = ch.prevTables
+		undo.Item = fmt.Sprint(ch.prevTables)
+	}
+	return &undo
+}
+
+// Applies the change and reports whether it has changed the node. An object which is already there (on adds)
+// or already gone (on deletes) is not an error.
+func (ch *Change) apply() (bool, error) {
+	var err error
+	switch {
+	case ch.Op == "write":
+		_, err = utils.WriteOwnedTables(ch.tables)
+	case ch.Op == "update":
+		// LinkModify can't clear the alias
+		vlan := *ch.vlan
+		vlan.Alias = ""
+		if err = ch.netlink.LinkModify(&vlan); err == nil && ch.vlan.Alias != ch.prevVlan.Alias {
+			err = ch.netlink.LinkSetAlias(ch.vlan, ch.vlan.Alias)
+		}
+	case ch.Op == "up":
+		err = ch.netlink.LinkSetUp(ch.vlan)
+	case ch.Op == "down":
+		err = ch.netlink.LinkSetDown(ch.vlan)
+	case ch.Op == "add" && ch.vlan != nil:
+		if err = ch.netlink.LinkAdd(ch.vlan); err == nil && ch.vlan.Flags&net.FlagUp != 0 {
+			if err = ch.netlink.LinkSetUp(ch.vlan); err != nil {
+				// the vlan is added, even though it is down
+				return true, ch.syncError(err)
+			}
+		}
+		if err == nil {
+			if err = ch.addVlanObjects(); err != nil {
+				return true, ch.syncError(err)
+			}
+		}
+	case ch.addr != nil:
+		err = ch.applyAddr()
+	case ch.Op == "add" && ch.route != nil:
+		err = ch.netlink.RouteAdd(ch.route)
+	case ch.Op == "add" && ch.rule != nil:
+		err = ch.netlink.RuleAdd(ch.rule)
+	case ch.vlan != nil:
+		err = ch.netlink.LinkDel(ch.vlan)
+	case ch.route != nil:
+		err = ch.netlink.RouteDel(ch.route)
+	case ch.rule != nil:
+		err = ch.netlink.RuleDel(ch.rule)
+	}
+
+	if ch.Op == "add" && err == syscall.EEXIST {
+		return false, nil
+	} else if ch.Op == "delete" && (err == syscall.ENOENT || err == syscall.ESRCH || err == syscall.ENODEV || err == syscall.EADDRNOTAVAIL) {
+		log.Printf("[%s] %s (%s) has already been deleted.", ch.Reason, ch.Object, ch.Item)
+		return false, nil
+	} else if err != nil {
+		return false, ch.syncError(err)
+	}
+	log.Printf("Applied: %s", ch)
+	return true, nil
+}
+
+// adds back the addresses and routes of a deleted vlan, which is added again with its index
+func (ch *Change) addVlanObjects() error {
+	for i := range ch.vlanAddrs {
+		if err := ch.netlink.AddrAdd(ch.vlan, &ch.vlanAddrs[i]); err != nil && err != syscall.EEXIST {
+			return err
+		}
+	}
+	for i := range ch.vlanRoutes {
+		if err := ch.netlink.RouteAdd(&ch.vlanRoutes[i]); err != nil && err != syscall.EEXIST {
+			return err
+		}
+	}
+	return nil
+}
+
+// adds or deletes the address on its link, a link which doesn't exist is ENODEV
+func (ch *Change) applyAddr() error {
+	link, err := ch.netlink.LinkByIndex(ch.addr.LinkIndex)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return syscall.ENODEV
+	} else if err != nil {
+		return err
+	}
+	if ch.Op == "add" {
+		return ch.netlink.AddrAdd(link, ch.addr)
+	}
+	return ch.netlink.AddrDel(link, ch.addr)
+}
+
+func (ch *Change) syncError(err error) error {
+	return &SyncError{Reason: ch.Reason, Op: changeVerbs[ch.Op], Object: ch.Object, Item: ch.Item, Namespace: ch.Namespace, Err: err}
+}
+
+var changeVerbs = map[string]string{
+	"add":    "adding",
+	"delete": "deleting",
+	"update": "updating",
+	"up":     "setting up",
+	"down":   "setting down",
+	"write":  "writing",
+}
@@ -0,0 +1,461 @@
+package ipruler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/plutocholia/ipruler/internal/config"
+	"github.com/plutocholia/ipruler/internal/utils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// how long the watcher waits for more changes before it reconciles them together
+	WATCH_DEBOUNCE = 500 * time.Millisecond
+	// how long the watcher waits before it subscribes again after a subscription fails
+	WATCH_RETRY_INTERVAL = 5 * time.Second
+)
+
+// Syncs the given sections (vlans, addresses, routes or rules) of the current config again, e.g. after someone else has
+// changed the objects of the config. Unlike WaveSync, the config is not parsed again and the objects of the
+// previous config are not removed again. The links of the sections are resolved again, as a recreated link
+// has a new index. Only the items in the namespace of the config are reconciled.
+func (c *ConfigLifeCycle) Reconcile(sections map[string]bool) error {
+	if c.CurrentConfig == nil || c.model == nil || c.DryRun {
+		return nil
+	}
+	reconciled := *c.CurrentConfig
+	planner := &ConfigLifeCycle{CurrentConfig: &reconciled, Namespace: c.Namespace}
+	errs := []error{}
+	for _, s := range waveStages {
+		if !sections[s.name] {
+			continue
+		}
+		if err := s.add(&reconciled, c.model); err != nil {
+			errs = append(errs, c.model.Locate(err))
+			continue
+		}
+		changes, err := planner.planIn(s.plan)
+		if err == nil {
+			err = applyChanges(changes)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.CurrentConfig = &reconciled
+	return config.JoinErrors(errs)
+}
+
+// Runs a function with exclusive access to the ConfigLifeCycle (e.g. holding a lock, or on the goroutine which
+// owns it), and returns once it's done
+type Executor func(f func())
+
+// The error of the watcher when the config moves to another namespace
+var errMoved = errors.New("the config has moved to another namespace")
+
+// Keeps watching the node until done is closed, and subscribes again when a subscription fails or the config
+// moves to another namespace.
+func (c *ConfigLifeCycle) KeepWatching(exec Executor, done <-chan struct{}) {
+	for {
+		err := c.Watch(exec, done)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errMoved) {
+			continue
+		}
+		log.Printf("Error in watching the node, subscribing again in %s: %s", WATCH_RETRY_INTERVAL, err)
+		select {
+		case <-done:
+			return
+		case <-time.After(WATCH_RETRY_INTERVAL):
+		}
+	}
+}
+
+// Watches the notifications of links, addresses, routes and rules, and reconciles the sections of the current
+// config whose objects are changed by someone else: an object of the config which disappears (along with the
+// links and addresses it depends on), or a foreign object which appears where the agent owns every object
+// (table-hard-sync, rule-priority-range and owned-only). The notifications are collected without blocking, and
+// WATCH_DEBOUNCE after the first one they're sorted out and reconciled together, in a single call of exec (the
+// config is only read or synced through exec). It watches the namespace of the config,
+// the items in other namespaces are only synced again by the next sync. It returns when done is closed, or with
+// an error when a subscription fails or the config moves to another namespace.
+func (c *ConfigLifeCycle) Watch(exec Executor, done <-chan struct{}) error {
+	var namespace string
+	var moved chan struct{}
+	exec(func() {
+		if c.moved == nil {
+			c.moved = make(chan struct{})
+		}
+		namespace, moved = c.Namespace, c.moved
+	})
+	handle, err := utils.NamespaceNetlink(namespace)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	links := make(chan netlink.LinkUpdate, 64)
+	if err := handle.LinkSubscribe(links, stop); err != nil {
+		return err
+	}
+	defer drain(links)
+	addrs := make(chan netlink.AddrUpdate, 64)
+	if err := handle.AddrSubscribe(addrs, stop); err != nil {
+		return err
+	}
+	defer drain(addrs)
+	routes := make(chan netlink.RouteUpdate, 64)
+	if err := handle.RouteSubscribe(routes, stop); err != nil {
+		return err
+	}
+	defer drain(routes)
+	rules := make(chan utils.RuleUpdate, 64)
+	if err := handle.RuleSubscribe(rules, stop); err != nil {
+		return err
+	}
+	defer drain(rules)
+
+	// the handle is not used by the watcher and the syncs at the same time
+	var operational map[int]bool
+	exec(func() { operational, err = operationalLinks(handle) })
+	if err != nil {
+		return err
+	}
+
+	// the changes made before subscribing are not notified, everything is reconciled once
+	sections := map[string]bool{"vlans": true, "addresses": true, "routes": true, "rules": true}
+	updates := newWatchUpdates()
+	timer := time.NewTimer(WATCH_DEBOUNCE)
+	defer timer.Stop()
+	armed := true
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-moved:
+			return errMoved
+		case update, ok := <-links:
+			if !ok {
+				return errors.New("link subscription is closed")
+			}
+			updates.links = append(updates.links, update)
+		case update, ok := <-addrs:
+			if !ok {
+				return errors.New("address subscription is closed")
+			}
+			updates.addrs[fmt.Sprint(update.LinkIndex, update.LinkAddress.String())] = update
+		case update, ok := <-routes:
+			if !ok {
+				return errors.New("route subscription is closed")
+			}
+			updates.routes[utils.PrintFullRoute(&update.Route)] = update
+		case update, ok := <-rules:
+			if !ok {
+				return errors.New("rule subscription is closed")
+			}
+			updates.rules[utils.RuleToIPCommand(&update.Rule)] = update
+		case <-timer.C:
+			exec(func() {
+				for _, section := range c.changedSections(updates, operational) {
+					sections[section] = true
+				}
+				if c.CurrentConfig != nil && len(sections) != 0 {
+					log.Printf("Reconciling %v after changes on the node", sectionNames(sections))
+					if err := c.Reconcile(sections); err != nil {
+						log.Printf("Error in reconciling the config: %s", err)
+					}
+				}
+			})
+			sections, updates, armed = map[string]bool{}, newWatchUpdates(), false
+			continue
+		}
+
+		if !armed {
+			timer.Reset(WATCH_DEBOUNCE)
+			armed = true
+		}
+	}
+}
+
+// The notifications received since the last reconcile. The links keep every notification, as going down and up
+// again in between matters, the other objects only keep their last one.
+type watchUpdates struct {
+	links  []netlink.LinkUpdate
+	addrs  map[string]netlink.AddrUpdate
+	routes map[string]netlink.RouteUpdate
+	rules  map[string]utils.RuleUpdate
+}
+
+func newWatchUpdates() *watchUpdates {
+	return &watchUpdates{
+		addrs:  make(map[string]netlink.AddrUpdate),
+		routes: make(map[string]netlink.RouteUpdate),
+		rules:  make(map[string]utils.RuleUpdate),
+	}
+}
+
+// returns the sections the notifications are about, the links are sorted out first as they keep operational
+// up to date
+func (c *ConfigLifeCycle) changedSections(updates *watchUpdates, operational map[int]bool) []string {
+	sections := []string{}
+	for i := range updates.links {
+		sections = append(sections, c.linkChanged(&updates.links[i], operational)...)
+	}
+	for _, update := range updates.addrs {
+		sections = append(sections, c.addrChanged(&update)...)
+	}
+	for _, update := range updates.routes {
+		sections = append(sections, c.routeChanged(&update)...)
+	}
+	for _, update := range updates.rules {
+		sections = append(sections, c.ruleChanged(&update)...)
+	}
+	return sections
+}
+
+// reads the notifications left after the watcher returns, until the subscription closes the channel
+func drain[T any](ch <-chan T) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
+
+func sectionNames(sections map[string]bool) []string {
+	names := []string{}
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The functions below return the sections a change on the node is about, if it's about the current config.
+
+// A vlan of the config or its parent which is deleted needs the vlans and the addresses and routes on them to be
+// synced again, and a vlan of the config which is set up or down against the config, or whose attributes are
+// changed, needs to be synced again. A link which is created again gets
+// the addresses of the config again. The kernel flushes the routes through a link which goes down, they are
+// installed again as soon as the link is operational. operational keeps whether each link is operational, to
+// notice when it becomes operational again.
+func (c *ConfigLifeCycle) linkChanged(update *netlink.LinkUpdate, operational map[int]bool) []string {
+	attrs := update.Attrs()
+	wasOperational, known := operational[attrs.Index]
+	isOperational := update.Header.Type == unix.RTM_NEWLINK && linkOperational(attrs)
+	if update.Header.Type == unix.RTM_DELLINK {
+		delete(operational, attrs.Index)
+	} else {
+		operational[attrs.Index] = isOperational
+	}
+	if c.CurrentConfig == nil {
+		return nil
+	}
+
+	var desired *netlink.Vlan
+	isParent := false
+	for _, vlan := range c.CurrentConfig.Vlans {
+		if vlan.Name == attrs.Name {
+			desired = vlan
+		}
+		isParent = isParent || vlan.ParentIndex == attrs.Index
+	}
+	isVlan := desired != nil
+	usesAddresses := c.addressesUseLink(attrs.Index, attrs.Name)
+	if !isVlan && !isParent && !usesAddresses && !c.routesUseLink(attrs.Index, attrs.Name) {
+		return nil
+	}
+
+	sections := []string{}
+	switch {
+	case update.Header.Type == unix.RTM_DELLINK:
+		if isVlan || isParent {
+			sections = append(sections, "vlans")
+		}
+		if usesAddresses {
+			sections = append(sections, "addresses")
+		}
+		return append(sections, "routes")
+	case !known && usesAddresses:
+		log.Printf("Link %s is created, adding its addresses again", attrs.Name)
+		sections = append(sections, "addresses")
+		if isOperational {
+			sections = append(sections, "routes")
+		}
+		return sections
+	case isOperational && !wasOperational:
+		log.Printf("Link %s is operational, installing the routes through it again", attrs.Name)
+		return []string{"routes"}
+	case isVlan && attrs.Flags&net.FlagUp == 0 && desired.Flags&net.FlagUp != 0:
+		log.Printf("Vlan %s is set down, setting it up again", attrs.Name)
+		return []string{"vlans"}
+	case isVlan && attrs.Flags&net.FlagUp != 0 && desired.Flags&net.FlagUp == 0:
+		log.Printf("Vlan %s is set up, setting it down again", attrs.Name)
+		return []string{"vlans"}
+	case isVlan && vlanChanged(desired, update.Link):
+		log.Printf("Vlan %s has changed, setting its attributes again", attrs.Name)
+		return []string{"vlans"}
+	}
+	return nil
+}
+
+// whether the link has another alias or attributes than the vlan of the config
+func vlanChanged(desired *netlink.Vlan, link netlink.Link) bool {
+	vlan, ok := link.(*netlink.Vlan)
+	return ok && ((desired.Alias != "" && vlan.Alias != desired.Alias) || !utils.VlanAttributesEqual(desired, vlan))
+}
+
+// A link is operational when it's up and has a carrier (links which don't report their state, like
+// loopback, are operational once they're up).
+func linkOperational(attrs *netlink.LinkAttrs) bool {
+	return attrs.Flags&net.FlagUp != 0 && (attrs.OperState == netlink.OperUp || attrs.OperState == netlink.OperUnknown)
+}
+
+// returns whether each link of the node is operational
+func operationalLinks(handle utils.NetlinkHandle) (map[int]bool, error) {
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	operational := make(map[int]bool)
+	for _, link := range links {
+		operational[link.Attrs().Index] = linkOperational(link.Attrs())
+	}
+	return operational, nil
+}
+
+// An address of the config which is removed is added again, and an address which is added while links are
+// address-hard-synced is removed when it's on one of them (the IPv6 link-local addresses the kernel adds are
+// kept). Routes through a link are flushed when one of its addresses is removed, and their gateways can become
+// reachable when an address is added.
+func (c *ConfigLifeCycle) addrChanged(update *netlink.AddrUpdate) []string {
+	if c.CurrentConfig == nil {
+		return nil
+	}
+	inConfig := false
+	for _, addr := range c.CurrentConfig.Addresses {
+		if addr.LinkIndex == update.LinkIndex && addr.IP.Equal(update.LinkAddress.IP) {
+			inConfig = true
+			break
+		}
+	}
+	ip := update.LinkAddress.IP
+	kernelAddr := utils.GetIPFamily(ip) == netlink.FAMILY_V6 && ip.IsLinkLocalUnicast()
+	sections := []string{}
+	if !update.NewAddr && inConfig {
+		sections = append(sections, "addresses")
+	} else if update.NewAddr && !inConfig && !kernelAddr && len(c.CurrentConfig.Settings.AddressHardSync) != 0 {
+		sections = append(sections, "addresses")
+	}
+	if c.routesUseLink(update.LinkIndex, "") {
+		sections = append(sections, "routes")
+	}
+	return sections
+}
+
+func (c *ConfigLifeCycle) routeChanged(update *netlink.RouteUpdate) []string {
+	if c.CurrentConfig == nil {
+		return nil
+	}
+	inConfig := false
+	for _, route := range c.CurrentConfig.Routes {
+		if utils.RouteEquality(&update.Route, route) {
+			inConfig = true
+			break
+		}
+	}
+	settings := c.CurrentConfig.Settings
+	if update.Type == unix.RTM_DELROUTE && inConfig {
+		return []string{"routes"}
+	}
+	if update.Type == unix.RTM_NEWROUTE && !inConfig {
+		if settings.OwnedOnly && int(update.Route.Protocol) == settings.RouteProtocol {
+			return []string{"routes"}
+		} else if !settings.OwnedOnly && settings.TableHardSync[update.Route.Table] {
+			return []string{"routes"}
+		}
+	}
+	return nil
+}
+
+func (c *ConfigLifeCycle) ruleChanged(update *utils.RuleUpdate) []string {
+	if c.CurrentConfig == nil || utils.IsDefaultRule(&update.Rule) {
+		return nil
+	}
+	inConfig := false
+	for _, rule := range c.CurrentConfig.Rules {
+		if utils.RuleEquality(&update.Rule, rule) {
+			inConfig = true
+			break
+		}
+	}
+	settings := c.CurrentConfig.Settings
+	if update.Type == unix.RTM_DELRULE && inConfig {
+		return []string{"rules"}
+	}
+	if update.Type == unix.RTM_NEWRULE && !inConfig {
+		if settings.RulePriorityRange.Contains(update.Rule.Priority) {
+			return []string{"rules"}
+		} else if !settings.OwnedOnly && settings.TableHardSync[update.Rule.Table] {
+			return []string{"rules"}
+		}
+	}
+	return nil
+}
+
+// whether addresses of the current config are on the link, the name of the link matches the devs of the config
+// when the link is created again
+func (c *ConfigLifeCycle) addressesUseLink(index int, name string) bool {
+	for _, addr := range c.CurrentConfig.Addresses {
+		if addr.LinkIndex == index {
+			return true
+		}
+	}
+	if c.model == nil {
+		return false
+	}
+	for _, addr := range c.model.Addresses {
+		if addr.Dev == name {
+			return true
+		}
+	}
+	return false
+}
+
+// whether routes of the current config go through the link, the name of the link matches the devs of the
+// config when the link is recreated (and has a new index)
+func (c *ConfigLifeCycle) routesUseLink(index int, name string) bool {
+	for _, route := range c.CurrentConfig.Routes {
+		if route.LinkIndex == index {
+			return true
+		}
+		for _, nexthop := range route.MultiPath {
+			if nexthop.LinkIndex == index {
+				return true
+			}
+		}
+	}
+	if name == "" || c.model == nil {
+		return false
+	}
+	for _, route := range c.model.Routes {
+		if route.Dev == name {
+			return true
+		}
+		for _, nexthop := range route.Nexthops {
+			if nexthop.Dev == name {
+				return true
+			}
+		}
+	}
+	return false
+}
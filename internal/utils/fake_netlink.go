@@ -0,0 +1,812 @@
+package utils
+
+import (
+	"maps"
+	"math"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// FakeNetlink is an in-memory NetlinkHandle for tests. It models the links (along with their addresses), routes
+// and rules of a network namespace, and fails like the kernel does:
+//   - adding a link, route or rule which exists fails with EEXIST,
+//   - deleting a route which doesn't exist fails with ESRCH, a rule with ENOENT, and an address with EADDRNOTAVAIL,
+//   - a link which doesn't exist is ENODEV, and a gateway which is not directly connected is ENETUNREACH.
+//
+// Like the kernel, the routes through a link are flushed when the link is deleted or set down, the vlans of a
+// link are deleted along with it, and the subscribers are notified of every change. A link has an MTU of 1500 by
+// default, and a vlan takes the MTU and the MAC of its link, and can't have a larger MTU (ERANGE).
+type FakeNetlink struct {
+	mu        sync.Mutex
+	links     []netlink.Link
+	addrs     map[int][]netlink.Addr
+	routes    []netlink.Route
+	rules     []netlink.Rule
+	lastIndex int
+
+	linkSubscribers  map[chan<- netlink.LinkUpdate]bool
+	addrSubscribers  map[chan<- netlink.AddrUpdate]bool
+	routeSubscribers map[chan<- netlink.RouteUpdate]bool
+	ruleSubscribers  map[chan<- RuleUpdate]bool
+}
+
+// NewFakeNetlink returns the fake of a fresh network namespace, with the loopback and the default rules.
+func NewFakeNetlink() *FakeNetlink {
+	f := &FakeNetlink{
+		addrs:            make(map[int][]netlink.Addr),
+		linkSubscribers:  make(map[chan<- netlink.LinkUpdate]bool),
+		addrSubscribers:  make(map[chan<- netlink.AddrUpdate]bool),
+		routeSubscribers: make(map[chan<- netlink.RouteUpdate]bool),
+		ruleSubscribers:  make(map[chan<- RuleUpdate]bool),
+	}
+	lo := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, OperState: netlink.OperUnknown}}
+	f.LinkAdd(lo)
+	for _, family := range IPFamilies {
+		for priority, table := range defaultRules {
+			if family == netlink.FAMILY_V6 && table == unix.RT_TABLE_DEFAULT {
+				continue
+			}
+			rule := netlink.NewRule()
+			rule.Family, rule.Priority, rule.Table, rule.Type = family, priority, table, unix.FR_ACT_TO_TBL
+			f.RuleAdd(rule)
+		}
+	}
+	return f
+}
+
+// copies the link, so that the caller can't change the link of the fake
+func copyLink(link netlink.Link) netlink.Link {
+	value := reflect.ValueOf(link).Elem()
+	copied := reflect.New(value.Type())
+	copied.Elem().Set(value)
+	copiedLink := copied.Interface().(netlink.Link)
+	copiedLink.Attrs().HardwareAddr = slices.Clone(copiedLink.Attrs().HardwareAddr)
+	if vlan, ok := copiedLink.(*netlink.Vlan); ok {
+		vlan.IngressQosMap, vlan.EgressQosMap = maps.Clone(vlan.IngressQosMap), maps.Clone(vlan.EgressQosMap)
+		for _, flag := range []**bool{&vlan.ReorderHdr, &vlan.Gvrp, &vlan.LooseBinding, &vlan.Mvrp, &vlan.BridgeBinding} {
+			if *flag != nil {
+				value := **flag
+				*flag = &value
+			}
+		}
+	}
+	return copiedLink
+}
+
+// the vlan flags of the kernel, a vlan reorders its headers by default
+func setVlanDefaults(vlan *netlink.Vlan, parent netlink.Link) {
+	if vlan.MTU == 0 {
+		vlan.MTU = parent.Attrs().MTU
+	}
+	if vlan.HardwareAddr == nil {
+		vlan.HardwareAddr = slices.Clone(parent.Attrs().HardwareAddr)
+	}
+	if vlan.ReorderHdr == nil {
+		reorderHdr := true
+		vlan.ReorderHdr = &reorderHdr
+	}
+	for _, flag := range []**bool{&vlan.Gvrp, &vlan.LooseBinding, &vlan.Mvrp, &vlan.BridgeBinding} {
+		if *flag == nil {
+			*flag = new(bool)
+		}
+	}
+	vlan.IngressQosMap, vlan.EgressQosMap = qosMapWithout0(vlan.IngressQosMap), qosMapWithout0(vlan.EgressQosMap)
+}
+
+// the kernel keeps no mapping to 0, which is the default
+func qosMapWithout0(qosMap map[uint32]uint32) map[uint32]uint32 {
+	kept := map[uint32]uint32{}
+	for from, to := range qosMap {
+		if to != 0 {
+			kept[from] = to
+		}
+	}
+	return kept
+}
+
+// returns the position of the link, found by index or by name when it has no index (like netlink does)
+func (f *FakeNetlink) findLink(link netlink.Link) (int, error) {
+	for i, l := range f.links {
+		if (link.Attrs().Index != 0 && l.Attrs().Index == link.Attrs().Index) ||
+			(link.Attrs().Index == 0 && l.Attrs().Name == link.Attrs().Name) {
+			return i, nil
+		}
+	}
+	return -1, unix.ENODEV
+}
+
+func (f *FakeNetlink) linkByIndex(index int) netlink.Link {
+	for _, l := range f.links {
+		if l.Attrs().Index == index {
+			return l
+		}
+	}
+	return nil
+}
+
+func (f *FakeNetlink) LinkList() ([]netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	links := make([]netlink.Link, 0, len(f.links))
+	for _, link := range f.links {
+		links = append(links, copyLink(link))
+	}
+	return links, nil
+}
+
+func (f *FakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, link := range f.links {
+		if link.Attrs().Name == name {
+			return copyLink(link), nil
+		}
+	}
+	return nil, unix.ENODEV
+}
+
+func (f *FakeNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if link := f.linkByIndex(index); link != nil {
+		return copyLink(link), nil
+	}
+	return nil, unix.ENODEV
+}
+
+// Adds the link and sets its index, like netlink.LinkAdd. The link is up when its flags have net.FlagUp.
+func (f *FakeNetlink) LinkAdd(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs := link.Attrs()
+	if attrs.Name == "" {
+		return unix.EINVAL
+	}
+	for _, l := range f.links {
+		if l.Attrs().Name == attrs.Name || (attrs.Index != 0 && l.Attrs().Index == attrs.Index) {
+			return unix.EEXIST
+		}
+	}
+	added := copyLink(link)
+	if added.Attrs().TxQLen < 0 {
+		added.Attrs().TxQLen = 0
+	}
+	if vlan, ok := added.(*netlink.Vlan); ok {
+		parent := f.linkByIndex(attrs.ParentIndex)
+		if parent == nil {
+			return unix.ENODEV
+		}
+		for _, l := range f.links {
+			if other, ok := l.(*netlink.Vlan); ok && other.ParentIndex == attrs.ParentIndex && other.VlanId == vlan.VlanId {
+				return unix.EEXIST
+			}
+		}
+		setVlanDefaults(vlan, parent)
+		if vlan.MTU > parent.Attrs().MTU {
+			return unix.ERANGE
+		}
+	} else if added.Attrs().MTU == 0 {
+		added.Attrs().MTU = 1500
+	}
+
+	if attrs.Index == 0 {
+		attrs.Index = f.lastIndex + 1
+	}
+	if attrs.Index > f.lastIndex {
+		f.lastIndex = attrs.Index
+	}
+	added.Attrs().Index = attrs.Index
+	added.Attrs().Flags &= net.FlagUp | net.FlagLoopback
+	if added.Attrs().OperState == netlink.OperUnknown && added.Attrs().Flags&net.FlagLoopback == 0 {
+		added.Attrs().OperState = netlink.OperDown
+		if added.Attrs().Flags&net.FlagUp != 0 {
+			added.Attrs().OperState = netlink.OperUp
+		}
+	}
+	f.links = append(f.links, added)
+	f.notifyLink(unix.RTM_NEWLINK, added)
+	return nil
+}
+
+// Deletes the link along with its vlans, addresses and the routes through them.
+func (f *FakeNetlink) LinkDel(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	f.deleteLink(f.links[i])
+	return nil
+}
+
+func (f *FakeNetlink) deleteLink(link netlink.Link) {
+	index := link.Attrs().Index
+	vlans := []netlink.Link{}
+	for _, l := range f.links {
+		if vlan, ok := l.(*netlink.Vlan); ok && vlan.ParentIndex == index {
+			vlans = append(vlans, vlan)
+		}
+	}
+	for _, vlan := range vlans {
+		f.deleteLink(vlan)
+	}
+	f.flushRoutes(index, nil)
+	delete(f.addrs, index)
+	for i, l := range f.links {
+		if l.Attrs().Index == index {
+			f.links = append(f.links[:i], f.links[i+1:]...)
+			break
+		}
+	}
+	f.notifyLink(unix.RTM_DELLINK, link)
+}
+
+// Sets the link up, and adds the routes of its addresses again.
+func (f *FakeNetlink) LinkSetUp(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	attrs := f.links[i].Attrs()
+	if attrs.Flags&net.FlagUp != 0 {
+		return nil
+	}
+	attrs.Flags |= net.FlagUp
+	attrs.OperState = netlink.OperUp
+	f.notifyLink(unix.RTM_NEWLINK, f.links[i])
+	for _, addr := range f.addrs[attrs.Index] {
+		f.addConnectedRoute(attrs.Index, addr)
+	}
+	return nil
+}
+
+// Sets the link down, and flushes the routes through it.
+func (f *FakeNetlink) LinkSetDown(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	attrs := f.links[i].Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return nil
+	}
+	attrs.Flags &^= net.FlagUp
+	attrs.OperState = netlink.OperDown
+	f.notifyLink(unix.RTM_NEWLINK, f.links[i])
+	f.flushRoutes(attrs.Index, nil)
+	return nil
+}
+
+func (f *FakeNetlink) LinkSetAlias(link netlink.Link, alias string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	f.links[i].Attrs().Alias = alias
+	f.notifyLink(unix.RTM_NEWLINK, f.links[i])
+	return nil
+}
+
+// Changes the MTU, txqlen, MAC and alias of the link, sets it up when its flags have net.FlagUp, and changes the
+// flags and QoS mappings of a vlan (a mapping to 0 is deleted), like netlink.LinkModify.
+func (f *FakeNetlink) LinkModify(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	modified := copyLink(f.links[i])
+	attrs, changes := modified.Attrs(), link.Attrs()
+	if changes.MTU > 0 {
+		attrs.MTU = changes.MTU
+	}
+	if changes.TxQLen >= 0 {
+		attrs.TxQLen = changes.TxQLen
+	}
+	if changes.HardwareAddr != nil {
+		attrs.HardwareAddr = slices.Clone(changes.HardwareAddr)
+	}
+	if changes.Alias != "" {
+		attrs.Alias = changes.Alias
+	}
+	if vlan, ok := modified.(*netlink.Vlan); ok {
+		if vlan.MTU > f.linkByIndex(vlan.ParentIndex).Attrs().MTU {
+			return unix.ERANGE
+		}
+		if vlanChanges, ok := link.(*netlink.Vlan); ok {
+			for _, flag := range []struct{ flag, change *bool }{
+				{vlan.ReorderHdr, vlanChanges.ReorderHdr}, {vlan.Gvrp, vlanChanges.Gvrp}, {vlan.LooseBinding, vlanChanges.LooseBinding},
+				{vlan.Mvrp, vlanChanges.Mvrp}, {vlan.BridgeBinding, vlanChanges.BridgeBinding},
+			} {
+				if flag.change != nil {
+					*flag.flag = *flag.change
+				}
+			}
+			for _, qosMap := range []struct{ qosMap, changes map[uint32]uint32 }{
+				{vlan.IngressQosMap, vlanChanges.IngressQosMap}, {vlan.EgressQosMap, vlanChanges.EgressQosMap},
+			} {
+				maps.Copy(qosMap.qosMap, qosMap.changes)
+				maps.DeleteFunc(qosMap.qosMap, func(_, to uint32) bool { return to == 0 })
+			}
+		}
+	}
+	f.links[i] = modified
+	f.notifyLink(unix.RTM_NEWLINK, modified)
+
+	if changes.Flags&net.FlagUp != 0 && attrs.Flags&net.FlagUp == 0 {
+		attrs.Flags |= net.FlagUp
+		attrs.OperState = netlink.OperUp
+		f.notifyLink(unix.RTM_NEWLINK, modified)
+		for _, addr := range f.addrs[attrs.Index] {
+			f.addConnectedRoute(attrs.Index, addr)
+		}
+	}
+	return nil
+}
+
+// AddrList returns the addresses of the link, or of every link when link is nil.
+func (f *FakeNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	indexes := []int{}
+	if link == nil {
+		for _, l := range f.links {
+			indexes = append(indexes, l.Attrs().Index)
+		}
+	} else {
+		i, err := f.findLink(link)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, f.links[i].Attrs().Index)
+	}
+	addrs := []netlink.Addr{}
+	for _, index := range indexes {
+		for _, addr := range f.addrs[index] {
+			if family == netlink.FAMILY_ALL || GetIPFamily(addr.IP) == family {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// AddrAdd adds the address to the link, along with the route to its network when the link is up (unless the
+// address has IFA_F_NOPREFIXROUTE). Like the kernel, an IPv4 address is labeled with the name of its link by
+// default, and the scope of an IPv6 address follows from its type.
+func (f *FakeNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	index := f.links[i].Attrs().Index
+	for _, a := range f.addrs[index] {
+		if a.IP.Equal(addr.IP) {
+			return unix.EEXIST
+		}
+	}
+	added := *addr
+	added.LinkIndex = index
+	if GetIPFamily(added.IP) == netlink.FAMILY_V4 && added.Label == "" {
+		added.Label = f.links[i].Attrs().Name
+	}
+	if GetIPFamily(added.IP) == netlink.FAMILY_V6 {
+		added.Scope = int(netlink.SCOPE_UNIVERSE)
+		if added.IP.IsLinkLocalUnicast() {
+			added.Scope = int(netlink.SCOPE_LINK)
+		} else if added.IP.IsLoopback() {
+			added.Scope = int(netlink.SCOPE_HOST)
+		}
+	}
+	if added.ValidLft == 0 || added.ValidLft == math.MaxUint32 {
+		added.Flags |= unix.IFA_F_PERMANENT
+	}
+	f.addrs[index] = append(f.addrs[index], added)
+	f.notifyAddr(index, added, true)
+	if f.links[i].Attrs().Flags&net.FlagUp != 0 {
+		f.addConnectedRoute(index, added)
+	}
+	return nil
+}
+
+// AddrDel removes the address from the link, along with the routes which use it.
+func (f *FakeNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, err := f.findLink(link)
+	if err != nil {
+		return err
+	}
+	index := f.links[i].Attrs().Index
+	for j, a := range f.addrs[index] {
+		if a.IP.Equal(addr.IP) {
+			f.addrs[index] = append(f.addrs[index][:j], f.addrs[index][j+1:]...)
+			f.notifyAddr(index, a, false)
+			f.flushRoutes(index, a.IPNet)
+			return nil
+		}
+	}
+	return unix.EADDRNOTAVAIL
+}
+
+// adds the route the kernel adds for the network of an address
+func (f *FakeNetlink) addConnectedRoute(index int, addr netlink.Addr) {
+	if addr.Flags&unix.IFA_F_NOPREFIXROUTE != 0 {
+		return
+	}
+	network := addr.IPNet
+	if addr.Peer != nil {
+		network = addr.Peer
+	}
+	route := netlink.Route{
+		LinkIndex: index,
+		Dst:       &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask},
+		Protocol:  unix.RTPROT_KERNEL,
+		Scope:     netlink.SCOPE_LINK,
+		Src:       addr.IP,
+		Family:    GetIPFamily(addr.IP),
+		Table:     unix.RT_TABLE_MAIN,
+		Type:      unix.RTN_UNICAST,
+	}
+	if route.Family == netlink.FAMILY_V6 {
+		route.Scope, route.Src, route.Priority = netlink.SCOPE_UNIVERSE, nil, 256
+	}
+	f.routes = append(f.routes, route)
+	f.notifyRoute(unix.RTM_NEWROUTE, &route)
+}
+
+// removes the routes through the link, or only the ones through the network when it's given
+func (f *FakeNetlink) flushRoutes(index int, network *net.IPNet) {
+	kept := f.routes[:0]
+	flushed := []netlink.Route{}
+	for _, route := range f.routes {
+		through := route.LinkIndex == index
+		for _, nexthop := range route.MultiPath {
+			through = through || nexthop.LinkIndex == index
+		}
+		if through && network != nil {
+			through = (route.Src != nil && network.Contains(route.Src)) ||
+				(route.Protocol == unix.RTPROT_KERNEL && IPNetEqual(route.Dst, &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask})) ||
+				(route.Gw != nil && network.Contains(route.Gw))
+		}
+		if through {
+			flushed = append(flushed, route)
+		} else {
+			kept = append(kept, route)
+		}
+	}
+	f.routes = kept
+	for i := range flushed {
+		f.notifyRoute(unix.RTM_DELROUTE, &flushed[i])
+	}
+}
+
+// fills in what the kernel sets when it's not given
+func normalizeRoute(route *netlink.Route) netlink.Route {
+	normalized := *route
+	if normalized.Family == 0 {
+		normalized.Family = netlink.FAMILY_V4
+		if route.Dst != nil {
+			normalized.Family = GetIPFamily(route.Dst.IP)
+		} else if route.Gw != nil {
+			normalized.Family = GetIPFamily(route.Gw)
+		}
+	}
+	if normalized.Dst == nil {
+		normalized.Dst = ZeroIPNet(normalized.Family)
+	}
+	if normalized.Table == 0 {
+		normalized.Table = unix.RT_TABLE_MAIN
+	}
+	if normalized.Type == 0 {
+		normalized.Type = unix.RTN_UNICAST
+	}
+	if normalized.Protocol == 0 {
+		normalized.Protocol = unix.RTPROT_BOOT
+	}
+	if normalized.Priority == 0 && normalized.Family == netlink.FAMILY_V6 {
+		normalized.Priority = 1024
+	}
+	return normalized
+}
+
+// the error of the kernel when the nexthop can't be used
+func (f *FakeNetlink) checkNexthop(index int, gw net.IP, flags int) error {
+	link := f.linkByIndex(index)
+	if link == nil {
+		return unix.ENODEV
+	}
+	if gw == nil || flags&unix.RTNH_F_ONLINK != 0 || gw.IsLinkLocalUnicast() {
+		return nil
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return unix.ENETDOWN
+	}
+	for _, addr := range f.addrs[index] {
+		if addr.IPNet.Contains(gw) {
+			return nil
+		}
+	}
+	return unix.ENETUNREACH
+}
+
+func (f *FakeNetlink) RouteAdd(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	added := normalizeRoute(route)
+	if RouteTypeHasNexthop(added.Type) {
+		if len(added.MultiPath) == 0 {
+			if err := f.checkNexthop(added.LinkIndex, added.Gw, added.Flags); err != nil {
+				return err
+			}
+		}
+		for _, nexthop := range added.MultiPath {
+			if err := f.checkNexthop(nexthop.LinkIndex, nexthop.Gw, nexthop.Flags); err != nil {
+				return err
+			}
+		}
+	}
+	if added.Src != nil && !f.hasAddr(added.Src) {
+		return unix.EINVAL
+	}
+	for _, r := range f.routes {
+		if r.Family == added.Family && r.Table == added.Table && IPNetEqual(r.Dst, added.Dst) &&
+			r.Tos == added.Tos && r.Priority == added.Priority {
+			return unix.EEXIST
+		}
+	}
+	f.routes = append(f.routes, added)
+	f.notifyRoute(unix.RTM_NEWROUTE, &added)
+	return nil
+}
+
+func (f *FakeNetlink) hasAddr(ip net.IP) bool {
+	for _, addrs := range f.addrs {
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Deletes the first route with the destination and table of the given route, which also matches the attributes
+// which are given (priority, protocol, type, gateway and link), like the kernel does.
+func (f *FakeNetlink) RouteDel(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	filter := normalizeRoute(route)
+	for i, r := range f.routes {
+		if r.Family != filter.Family || r.Table != filter.Table || !IPNetEqual(r.Dst, filter.Dst) || r.Tos != filter.Tos ||
+			(route.Priority != 0 && r.Priority != route.Priority) ||
+			(route.Protocol != 0 && r.Protocol != route.Protocol) ||
+			(route.Type != 0 && r.Type != route.Type) ||
+			(route.Gw != nil && !r.Gw.Equal(route.Gw)) ||
+			(route.LinkIndex != 0 && r.LinkIndex != route.LinkIndex) {
+			continue
+		}
+		f.routes = append(f.routes[:i], f.routes[i+1:]...)
+		f.notifyRoute(unix.RTM_DELROUTE, &r)
+		return nil
+	}
+	return unix.ESRCH
+}
+
+// Lists the routes of the family (every family when it's 0), filtered by table, link and protocol. Like netlink,
+// only the main table is listed when the table is not filtered, and every table with unix.RT_TABLE_UNSPEC.
+func (f *FakeNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	routes := []netlink.Route{}
+	for _, r := range f.routes {
+		if family != netlink.FAMILY_ALL && r.Family != family {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_TABLE == 0 && r.Table != unix.RT_TABLE_MAIN {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != unix.RT_TABLE_UNSPEC && r.Table != filter.Table {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_PROTOCOL != 0 && r.Protocol != filter.Protocol {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// Returns the route of the main table with the longest prefix containing the destination, like `ip route get`.
+func (f *FakeNetlink) RouteGet(destination net.IP) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var best *netlink.Route
+	bestOnes := -1
+	for i, r := range f.routes {
+		if r.Table != unix.RT_TABLE_MAIN || r.Type != unix.RTN_UNICAST || r.Family != GetIPFamily(destination) || !r.Dst.Contains(destination) {
+			continue
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones > bestOnes {
+			best, bestOnes = &f.routes[i], ones
+		}
+	}
+	if best == nil {
+		return nil, unix.ENETUNREACH
+	}
+	bits := 8 * len(destination.To16())
+	if best.Family == netlink.FAMILY_V4 {
+		bits = 32
+	}
+	return []netlink.Route{{
+		LinkIndex: best.LinkIndex,
+		Dst:       &net.IPNet{IP: destination, Mask: net.CIDRMask(bits, bits)},
+		Gw:        best.Gw,
+		Src:       best.Src,
+		Family:    best.Family,
+		Table:     unix.RT_TABLE_MAIN,
+		Type:      unix.RTN_UNICAST,
+	}}, nil
+}
+
+func (f *FakeNetlink) RuleList(family int) ([]netlink.Rule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := []netlink.Rule{}
+	for _, r := range f.rules {
+		if family == netlink.FAMILY_ALL || r.Family == family {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// the family of a rule is taken from its selectors when it's not given
+func normalizeRule(rule *netlink.Rule) netlink.Rule {
+	normalized := *rule
+	if normalized.Family == 0 {
+		normalized.Family = netlink.FAMILY_V4
+		if rule.Src != nil {
+			normalized.Family = GetIPFamily(rule.Src.IP)
+		} else if rule.Dst != nil {
+			normalized.Family = GetIPFamily(rule.Dst.IP)
+		}
+	}
+	return normalized
+}
+
+// Adds the rule, a rule without a priority is added before the first rule after the local one like the kernel
+// does.
+func (f *FakeNetlink) RuleAdd(rule *netlink.Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	added := normalizeRule(rule)
+	if added.Priority < 0 {
+		added.Priority = 0
+		for _, r := range f.rules {
+			if r.Family == added.Family && r.Priority > 0 && (added.Priority == 0 || r.Priority-1 < added.Priority) {
+				added.Priority = r.Priority - 1
+			}
+		}
+	}
+	for _, r := range f.rules {
+		if RuleEquality(&r, &added) {
+			return unix.EEXIST
+		}
+	}
+	// the rules are kept in the order of their priorities, like the kernel lists them
+	i := len(f.rules)
+	for j, r := range f.rules {
+		if r.Priority > added.Priority {
+			i = j
+			break
+		}
+	}
+	f.rules = append(f.rules[:i], append([]netlink.Rule{added}, f.rules[i:]...)...)
+	f.notifyRule(unix.RTM_NEWRULE, &added)
+	return nil
+}
+
+// Deletes the first rule equal to the given one, a rule without a priority matches every priority.
+func (f *FakeNetlink) RuleDel(rule *netlink.Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	filter := normalizeRule(rule)
+	for i, r := range f.rules {
+		if RuleEquality(&r, &filter) {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			f.notifyRule(unix.RTM_DELRULE, &r)
+			return nil
+		}
+	}
+	return unix.ENOENT
+}
+
+func (f *FakeNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	subscribe(&f.mu, f.linkSubscribers, ch, done)
+	return nil
+}
+
+func (f *FakeNetlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	subscribe(&f.mu, f.addrSubscribers, ch, done)
+	return nil
+}
+
+func (f *FakeNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	subscribe(&f.mu, f.routeSubscribers, ch, done)
+	return nil
+}
+
+func (f *FakeNetlink) RuleSubscribe(ch chan<- RuleUpdate, done <-chan struct{}) error {
+	subscribe(&f.mu, f.ruleSubscribers, ch, done)
+	return nil
+}
+
+func (f *FakeNetlink) notifyLink(msgType uint16, link netlink.Link) {
+	update := netlink.LinkUpdate{Link: copyLink(link)}
+	update.Header.Type = msgType
+	update.Index = int32(link.Attrs().Index)
+	notify(f.linkSubscribers, update)
+}
+
+func (f *FakeNetlink) notifyAddr(index int, addr netlink.Addr, added bool) {
+	notify(f.addrSubscribers, netlink.AddrUpdate{LinkAddress: *addr.IPNet, LinkIndex: index, NewAddr: added})
+}
+
+func (f *FakeNetlink) notifyRoute(msgType uint16, route *netlink.Route) {
+	notify(f.routeSubscribers, netlink.RouteUpdate{Type: msgType, Route: *route})
+}
+
+func (f *FakeNetlink) notifyRule(msgType uint16, rule *netlink.Rule) {
+	notify(f.ruleSubscribers, RuleUpdate{Type: msgType, Rule: *rule})
+}
+
+// the channel is closed once done is closed, like the subscriptions of netlink
+func subscribe[T any](mu *sync.Mutex, subscribers map[chan<- T]bool, ch chan<- T, done <-chan struct{}) {
+	mu.Lock()
+	subscribers[ch] = true
+	mu.Unlock()
+	if done == nil {
+		return
+	}
+	go func() {
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		if subscribers[ch] {
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}()
+}
+
+// a subscriber which doesn't keep up loses its subscription, like the kernel drops the notifications (ENOBUFS)
+// and netlink closes the channel
+func notify[T any](subscribers map[chan<- T]bool, update T) {
+	for ch := range subscribers {
+		select {
+		case ch <- update:
+		default:
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
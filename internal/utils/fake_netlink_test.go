@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFakeNetlinkErrors(t *testing.T) {
+	fake := NewFakeNetlink()
+	d0 := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "d0", Flags: net.FlagUp}}
+	if err := fake.LinkAdd(d0); err != nil || d0.Index == 0 {
+		t.Fatalf("LinkAdd(d0) = %v, index %d", err, d0.Index)
+	}
+	addr, _ := netlink.ParseAddr("10.0.0.2/24")
+	if err := fake.AddrAdd(d0, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	_, dst, _ := net.ParseCIDR("10.20.0.0/16")
+	route := &netlink.Route{Dst: dst, Gw: net.ParseIP("10.0.0.1"), LinkIndex: d0.Index, Table: 100}
+	unreachable := &netlink.Route{Dst: dst, Gw: net.ParseIP("10.9.0.1"), LinkIndex: d0.Index, Table: 101}
+	rule := netlink.NewRule()
+	rule.Src, rule.Table, rule.Priority = dst, 100, 1000
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"add link", func() error { return fake.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "d0"}}) }, unix.EEXIST},
+		{"add vlan of missing link", func() error {
+			return fake.LinkAdd(&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "v1", ParentIndex: 99}, VlanId: 1})
+		}, unix.ENODEV},
+		{"add route", func() error { return fake.RouteAdd(route) }, nil},
+		{"add route again", func() error { return fake.RouteAdd(route) }, unix.EEXIST},
+		{"add unreachable route", func() error { return fake.RouteAdd(unreachable) }, unix.ENETUNREACH},
+		{"delete route", func() error { return fake.RouteDel(route) }, nil},
+		{"delete route again", func() error { return fake.RouteDel(route) }, unix.ESRCH},
+		{"add rule", func() error { return fake.RuleAdd(rule) }, nil},
+		{"add rule again", func() error { return fake.RuleAdd(rule) }, unix.EEXIST},
+		{"delete rule", func() error { return fake.RuleDel(rule) }, nil},
+		{"delete rule again", func() error { return fake.RuleDel(rule) }, unix.ENOENT},
+		{"delete link", func() error { return fake.LinkDel(d0) }, nil},
+		{"delete link again", func() error { return fake.LinkDel(d0) }, unix.ENODEV},
+	}
+	for _, test := range tests {
+		if err := test.call(); err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestFakeNetlinkFlushesRoutes(t *testing.T) {
+	fake := NewFakeNetlink()
+	d0 := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "d0", Flags: net.FlagUp}}
+	fake.LinkAdd(d0)
+	addr, _ := netlink.ParseAddr("10.0.0.2/24")
+	fake.AddrAdd(d0, addr)
+	vlan := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "d0.10", ParentIndex: d0.Index}, VlanId: 10}
+	fake.LinkAdd(vlan)
+
+	_, dst, _ := net.ParseCIDR("10.20.0.0/16")
+	if err := fake.RouteAdd(&netlink.Route{Dst: dst, Gw: net.ParseIP("10.0.0.1"), LinkIndex: d0.Index}); err != nil {
+		t.Fatal(err)
+	}
+	if routes, _ := fake.RouteGet(net.ParseIP("10.20.1.1")); len(routes) != 1 || !routes[0].Gw.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("RouteGet(10.20.1.1) = %v", routes)
+	}
+
+	fake.LinkSetDown(d0)
+	if routes, _ := fake.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{}, 0); len(routes) != 0 {
+		t.Errorf("routes through a link which is down: %v", routes)
+	}
+	fake.LinkSetUp(d0)
+	if routes, _ := fake.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{}, 0); len(routes) != 1 || routes[0].Protocol != unix.RTPROT_KERNEL {
+		t.Errorf("only the route of the address is added again: %v", routes)
+	}
+
+	fake.LinkDel(d0)
+	if _, err := fake.LinkByName("d0.10"); err == nil {
+		t.Errorf("the vlan is not deleted along with its link")
+	}
+}
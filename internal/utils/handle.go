@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// NetlinkHandle is the access of the agent to the links, addresses, routes and rules of the kernel. Its methods behave like
+// the netlink functions of the same name, including the errors of the kernel (e.g. EEXIST when an object which
+// exists is added).
+type NetlinkHandle interface {
+	LinkList() ([]netlink.Link, error)
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetAlias(link netlink.Link, alias string) error
+	// changes the attributes of a link in place, found by index or by name
+	LinkModify(link netlink.Link) error
+
+	// the addresses of every link when link is nil
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteGet(destination net.IP) ([]netlink.Route, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+
+	// the rules keep their action (netlink.Rule.Type), and l3mdev rules can be added
+	RuleList(family int) ([]netlink.Rule, error)
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+
+	// the channels are closed when done is closed or the subscription fails
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+	AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error
+	RuleSubscribe(ch chan<- RuleUpdate, done <-chan struct{}) error
+}
+
+// Netlink is the handle every access to the kernel goes through, the network namespace of the agent by default.
+// Tests replace it with a FakeNetlink.
+var Netlink NetlinkHandle = &kernelNetlink{Handle: &netlink.Handle{}, ns: netns.None()}
+
+// NamespaceNetlink returns the handle of a network namespace, given by its name (`ip netns`), the path of its
+// file (e.g. /proc/<pid>/ns/net or /var/run/netns/<name>) or the pid of a process in it. An empty namespace is
+// the one of the agent, whose handle is Netlink. Tests replace it to give each namespace a FakeNetlink.
+var NamespaceNetlink func(namespace string) (NetlinkHandle, error) = namespaceNetlink
+
+// the handles of the namespaces, which are kept open as long as their namespace is the same
+var namespaceHandles = struct {
+	sync.Mutex
+	handles map[string]*kernelNetlink
+}{handles: map[string]*kernelNetlink{}}
+
+func namespaceNetlink(namespace string) (NetlinkHandle, error) {
+	if namespace == "" {
+		return Netlink, nil
+	}
+	ns, err := openNamespace(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("network namespace %s: %w", namespace, err)
+	}
+
+	namespaceHandles.Lock()
+	defer namespaceHandles.Unlock()
+	if handle, exists := namespaceHandles.handles[namespace]; exists {
+		if handle.ns.Equal(ns) {
+			ns.Close()
+			return handle, nil
+		}
+		// the namespace is deleted and created again (e.g. a pid reused, or a sandbox recreated with the same name)
+		handle.close()
+		delete(namespaceHandles.handles, namespace)
+	}
+	handle, err := newKernelNetlink(ns)
+	if err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("network namespace %s: %w", namespace, err)
+	}
+	namespaceHandles.handles[namespace] = handle
+	return handle, nil
+}
+
+func openNamespace(namespace string) (netns.NsHandle, error) {
+	if pid, err := strconv.Atoi(namespace); err == nil {
+		return netns.GetFromPid(pid)
+	}
+	if strings.Contains(namespace, "/") {
+		return netns.GetFromPath(namespace)
+	}
+	return netns.GetFromName(namespace)
+}
+
+// the kernel of a network namespace
+type kernelNetlink struct {
+	*netlink.Handle
+	// netns.None() for the namespace of the agent, whose requests use a socket of the current thread
+	ns netns.NsHandle
+	// the sockets of the requests netlink.Handle has no method for, nil for the namespace of the agent
+	sockets map[int]*nl.SocketHandle
+}
+
+func newKernelNetlink(ns netns.NsHandle) (*kernelNetlink, error) {
+	handle, err := netlink.NewHandleAt(ns, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := nl.GetNetlinkSocketAt(ns, netns.None(), unix.NETLINK_ROUTE)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	sockets := map[int]*nl.SocketHandle{unix.NETLINK_ROUTE: {Socket: socket}}
+	return &kernelNetlink{Handle: handle, ns: ns, sockets: sockets}, nil
+}
+
+func (k *kernelNetlink) close() {
+	k.Handle.Close()
+	for _, socket := range k.sockets {
+		socket.Close()
+	}
+	k.ns.Close()
+}
+
+func (k *kernelNetlink) RuleList(family int) ([]netlink.Rule, error) {
+	return ruleList(k.sockets, family)
+}
+
+func (k *kernelNetlink) RuleAdd(rule *netlink.Rule) error {
+	if IsL3mdevRule(rule) {
+		return l3mdevRuleAdd(k.sockets, rule)
+	}
+	return k.Handle.RuleAdd(rule)
+}
+
+func (k *kernelNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribeWithOptions(ch, done, netlink.LinkSubscribeOptions{Namespace: &k.ns})
+}
+
+func (k *kernelNetlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return netlink.AddrSubscribeWithOptions(ch, done, netlink.AddrSubscribeOptions{Namespace: &k.ns})
+}
+
+func (k *kernelNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribeWithOptions(ch, done, netlink.RouteSubscribeOptions{Namespace: &k.ns})
+}
+
+func (k *kernelNetlink) RuleSubscribe(ch chan<- RuleUpdate, done <-chan struct{}) error {
+	return ruleSubscribe(k.ns, ch, done)
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// the iproute2 configuration directory, tests point it to a temporary directory
+var IPROUTE2_CONFIG_PATH = "/etc/iproute2"
+
+// rt_tables.d file owned by the agent, holding the tables of the `tables` section of the config
+const OWNED_RT_TABLES_FILE = "ipruler.conf"
+
+// Tables iproute2 knows without any rt_tables file
+var ReservedRouteTables map[string]int = map[string]int{
+	"unspec":  unix.RT_TABLE_UNSPEC,
+	"default": unix.RT_TABLE_DEFAULT,
+	"main":    unix.RT_TABLE_MAIN,
+	"local":   unix.RT_TABLE_LOCAL,
+}
+
+// Reads an iproute2 `id name` file (e.g. rt_tables), comments and malformed lines are skipped like iproute2 does.
+// names keeps the first name of each id, when it's given.
+func readIDNameFile(path string, values map[string]int, names map[int]string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil {
+			continue
+		}
+		values[fields[1]] = int(id)
+		if _, exists := names[int(id)]; names != nil && !exists {
+			names[int(id)] = fields[1]
+		}
+	}
+}
+
+// the parsed iproute2 configurations, which are read again once one of their files changes
+var idNameCache = struct {
+	sync.Mutex
+	entries map[string]idNameEntry
+}{entries: make(map[string]idNameEntry)}
+
+type idNameEntry struct {
+	stamps string
+	values map[string]int
+	// the first name of each id, in the order of the files and their lines
+	names map[int]string
+}
+
+// the paths, modification times and sizes of the files which exist, it changes when any of the files changes
+func fileStamps(files []string) string {
+	stamps := ""
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			stamps += fmt.Sprintf("%s %d %d\n", file, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return stamps
+}
+
+// reads `<name>` and `<name>.d/*.conf` of the iproute2 configuration directory, except the skipped file. The files
+// are only parsed again when they have changed since the last read.
+func readIDNameConfig(name string, skip string) map[string]int {
+	return maps.Clone(loadIDNameConfig(name, skip).values)
+}
+
+// returns the first name of each id of the iproute2 configuration, like readIDNameConfig
+func readIDNames(name string) map[int]string {
+	return maps.Clone(loadIDNameConfig(name, "").names)
+}
+
+func loadIDNameConfig(name string, skip string) idNameEntry {
+	files := []string{filepath.Join(IPROUTE2_CONFIG_PATH, name)}
+	dropIns, _ := filepath.Glob(filepath.Join(IPROUTE2_CONFIG_PATH, name+".d", "*.conf"))
+	sort.Strings(dropIns)
+	for _, file := range dropIns {
+		if filepath.Base(file) != skip {
+			files = append(files, file)
+		}
+	}
+	stamps := fileStamps(files)
+	key := files[0] + ":" + skip
+
+	idNameCache.Lock()
+	defer idNameCache.Unlock()
+	if entry, exists := idNameCache.entries[key]; exists && entry.stamps == stamps {
+		return entry
+	}
+	entry := idNameEntry{stamps: stamps, values: make(map[string]int), names: make(map[int]string)}
+	for _, file := range files {
+		readIDNameFile(file, entry.values, entry.names)
+	}
+	idNameCache.entries[key] = entry
+	return entry
+}
+
+// RouteTables returns the named tables of rt_tables and rt_tables.d, along with the reserved ones.
+func RouteTables() map[string]int {
+	tables := readIDNameConfig("rt_tables", "")
+	for name, id := range ReservedRouteTables {
+		tables[name] = id
+	}
+	return tables
+}
+
+// ForeignRouteTables returns the named tables like RouteTables, without the tables owned by the agent.
+func ForeignRouteTables() map[string]int {
+	tables := readIDNameConfig("rt_tables", OWNED_RT_TABLES_FILE)
+	for name, id := range ReservedRouteTables {
+		tables[name] = id
+	}
+	return tables
+}
+
+// GetTableID resolves a table given by id or by name.
+func GetTableID(table string) (int, bool) {
+	if id, err := strconv.ParseUint(table, 10, 32); err == nil {
+		return int(id), true
+	}
+	id, exists := RouteTables()[table]
+	return id, exists
+}
+
+func ownedTablesPath() string {
+	return filepath.Join(IPROUTE2_CONFIG_PATH, "rt_tables.d", OWNED_RT_TABLES_FILE)
+}
+
+func ownedTablesContent(tables map[string]int) string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return tables[names[i]] < tables[names[j]] })
+
+	content := "# Managed by ipruler-agent, changes will be overwritten.\n"
+	for _, name := range names {
+		content += fmt.Sprintf("%d\t%s\n", tables[name], name)
+	}
+	return content
+}
+
+// OwnedTables returns the tables of the agent's rt_tables.d file.
+func OwnedTables() map[string]int {
+	tables := make(map[string]int)
+	readIDNameFile(ownedTablesPath(), tables, nil)
+	return tables
+}
+
+// OwnedTablesChanged reports whether WriteOwnedTables would change the agent's rt_tables.d file.
+func OwnedTablesChanged(tables map[string]int) bool {
+	current, err := os.ReadFile(ownedTablesPath())
+	if len(tables) == 0 {
+		return err == nil
+	}
+	return err != nil || string(current) != ownedTablesContent(tables)
+}
+
+// WriteOwnedTables writes the given tables to the agent's rt_tables.d file, or removes the file when there are
+// no tables. It reports whether the file has been changed.
+func WriteOwnedTables(tables map[string]int) (bool, error) {
+	if !OwnedTablesChanged(tables) {
+		return false, nil
+	}
+	// the file can be written again within the resolution of its modification time
+	defer func() {
+		idNameCache.Lock()
+		clear(idNameCache.entries)
+		idNameCache.Unlock()
+	}()
+	path := ownedTablesPath()
+	if len(tables) == 0 {
+		return true, os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(path, []byte(ownedTablesContent(tables)), 0644)
+}
+
+// RouteProtocolIDs returns the protocols of rt_protos and rt_protos.d, along with the ones iproute2 always knows.
+func RouteProtocolIDs() map[string]int {
+	protocols := readIDNameConfig("rt_protos", "")
+	for name, id := range RouteProtocols {
+		protocols[name] = id
+	}
+	return protocols
+}
+
+// GetRouteProtocol resolves a route protocol given by id (0-255) or by name.
+func GetRouteProtocol(protocol string) (int, bool) {
+	if id, err := strconv.ParseUint(protocol, 0, 8); err == nil {
+		return int(id), true
+	}
+	id, exists := RouteProtocolIDs()[protocol]
+	return id, exists && id >= 0 && id <= 255
+}
+
+// GetRouteProtocolName returns the name of a route protocol, or its id when it has no name. The names iproute2
+// always knows come first, then the first name of rt_protos and rt_protos.d.
+func GetRouteProtocolName(id int) string {
+	if name, exists := routeProtocolNames[id]; exists {
+		return name
+	}
+	if name, exists := readIDNames("rt_protos")[id]; exists {
+		return name
+	}
+	return strconv.Itoa(id)
+}
+
+var routeProtocolNames = reverseMap(RouteProtocols)
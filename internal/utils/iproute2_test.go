@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the rt_tables files are only parsed again once one of them changes
+func TestRouteTablesCache(t *testing.T) {
+	configPath := IPROUTE2_CONFIG_PATH
+	IPROUTE2_CONFIG_PATH = t.TempDir()
+	t.Cleanup(func() { IPROUTE2_CONFIG_PATH = configPath })
+
+	path := filepath.Join(IPROUTE2_CONFIG_PATH, "rt_tables")
+	stamp := time.Now().Add(-time.Hour)
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("100 tenant-a\n", stamp)
+	if id, exists := GetTableID("tenant-a"); !exists || id != 100 {
+		t.Fatalf("GetTableID(tenant-a) = %d, %t", id, exists)
+	}
+
+	// the same size and modification time, the cached tables are used
+	write("100 tenant-b\n", stamp)
+	if id, exists := GetTableID("tenant-a"); !exists || id != 100 {
+		t.Errorf("GetTableID(tenant-a) of the unchanged file = %d, %t", id, exists)
+	}
+
+	write("100 tenant-b\n", stamp.Add(time.Second))
+	if _, exists := GetTableID("tenant-a"); exists {
+		t.Errorf("table tenant-a of the changed file is still cached")
+	}
+	if id, exists := GetTableID("tenant-b"); !exists || id != 100 {
+		t.Errorf("GetTableID(tenant-b) = %d, %t", id, exists)
+	}
+
+	// the owned file is read as soon as it's written, and the tables of the callers are their own
+	if _, err := WriteOwnedTables(map[string]int{"tenant-c": 300}); err != nil {
+		t.Fatal(err)
+	}
+	tables := RouteTables()
+	if tables["tenant-c"] != 300 {
+		t.Errorf("tables after WriteOwnedTables: %v", tables)
+	}
+	delete(tables, "tenant-c")
+	if id, exists := GetTableID("tenant-c"); !exists || id != 300 {
+		t.Errorf("GetTableID(tenant-c) = %d, %t", id, exists)
+	}
+}
+
+// the name of a protocol with several names is the first one of the files, the names iproute2 knows come first
+func TestGetRouteProtocolName(t *testing.T) {
+	configPath := IPROUTE2_CONFIG_PATH
+	IPROUTE2_CONFIG_PATH = t.TempDir()
+	t.Cleanup(func() { IPROUTE2_CONFIG_PATH = configPath })
+
+	if err := os.WriteFile(filepath.Join(IPROUTE2_CONFIG_PATH, "rt_protos"), []byte("200 ipruler\n200 agent\n4 static-too\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(IPROUTE2_CONFIG_PATH, "rt_protos.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(IPROUTE2_CONFIG_PATH, "rt_protos.d", "a.conf"), []byte("200 tenant\n201 tenant-b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 20 {
+		for id, want := range map[int]string{200: "ipruler", 201: "tenant-b", 4: "static", 202: "202"} {
+			if name := GetRouteProtocolName(id); name != want {
+				t.Fatalf("GetRouteProtocolName(%d) = %s, want %s", id, name, want)
+			}
+		}
+	}
+	for _, name := range []string{"ipruler", "agent", "tenant"} {
+		if id, exists := GetRouteProtocol(name); !exists || id != 200 {
+			t.Errorf("GetRouteProtocol(%s) = %d, %t", name, id, exists)
+		}
+	}
+}
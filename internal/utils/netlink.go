@@ -1,18 +1,44 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
-	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
 )
 
+// Protocols iproute2 knows without any rt_protos file, more can be defined in rt_protos and rt_protos.d
 var RouteProtocols map[string]int = map[string]int{
-	"kernel": unix.RTPROT_KERNEL,
-	"boot":   unix.RTPROT_BOOT,
-	"static": unix.RTPROT_STATIC,
+	"unspec":     unix.RTPROT_UNSPEC,
+	"redirect":   unix.RTPROT_REDIRECT,
+	"kernel":     unix.RTPROT_KERNEL,
+	"boot":       unix.RTPROT_BOOT,
+	"static":     unix.RTPROT_STATIC,
+	"gated":      unix.RTPROT_GATED,
+	"ra":         unix.RTPROT_RA,
+	"mrt":        unix.RTPROT_MRT,
+	"zebra":      unix.RTPROT_ZEBRA,
+	"bird":       unix.RTPROT_BIRD,
+	"dnrouted":   unix.RTPROT_DNROUTED,
+	"xorp":       unix.RTPROT_XORP,
+	"ntk":        unix.RTPROT_NTK,
+	"dhcp":       unix.RTPROT_DHCP,
+	"mrouted":    unix.RTPROT_MROUTED,
+	"keepalived": unix.RTPROT_KEEPALIVED,
+	"babel":      unix.RTPROT_BABEL,
+	"openr":      unix.RTPROT_OPENR,
+	"bgp":        unix.RTPROT_BGP,
+	"isis":       unix.RTPROT_ISIS,
+	"ospf":       unix.RTPROT_OSPF,
+	"rip":        unix.RTPROT_RIP,
+	"eigrp":      unix.RTPROT_EIGRP,
 }
 
 var RouteFlags map[string]int = map[string]int{
@@ -26,6 +52,42 @@ var RouteScopes map[string]int = map[string]int{
 	"host":   unix.RT_SCOPE_HOST,
 }
 
+var RouteTypes map[string]int = map[string]int{
+	"unicast":     unix.RTN_UNICAST,
+	"local":       unix.RTN_LOCAL,
+	"broadcast":   unix.RTN_BROADCAST,
+	"anycast":     unix.RTN_ANYCAST,
+	"blackhole":   unix.RTN_BLACKHOLE,
+	"unreachable": unix.RTN_UNREACHABLE,
+	"prohibit":    unix.RTN_PROHIBIT,
+	"throw":       unix.RTN_THROW,
+}
+
+var RuleActions map[string]int = map[string]int{
+	"table":       nl.FR_ACT_TO_TBL,
+	"goto":        nl.FR_ACT_GOTO,
+	"nop":         nl.FR_ACT_NOP,
+	"blackhole":   nl.FR_ACT_BLACKHOLE,
+	"unreachable": nl.FR_ACT_UNREACHABLE,
+	"prohibit":    nl.FR_ACT_PROHIBIT,
+}
+
+var IPProtocols map[string]int = map[string]int{
+	"icmp":      unix.IPPROTO_ICMP,
+	"igmp":      unix.IPPROTO_IGMP,
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"gre":       unix.IPPROTO_GRE,
+	"esp":       unix.IPPROTO_ESP,
+	"ah":        unix.IPPROTO_AH,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	"sctp":      unix.IPPROTO_SCTP,
+	"udplite":   unix.IPPROTO_UDPLITE,
+}
+
+// IP families the agent manages, in the order they are synced.
+var IPFamilies []int = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
 func reverseMap(m map[string]int) map[int]string {
 	n := make(map[int]string, len(m))
 	for k, v := range m {
@@ -34,32 +96,163 @@ func reverseMap(m map[string]int) map[int]string {
 	return n
 }
 
+// Blackhole, unreachable, prohibit and throw routes don't forward packets, so they have no gateway or device.
+func RouteTypeHasNexthop(routeType int) bool {
+	switch routeType {
+	case unix.RTN_BLACKHOLE, unix.RTN_UNREACHABLE, unix.RTN_PROHIBIT, unix.RTN_THROW:
+		return false
+	}
+	return true
+}
+
+// GetIPFamily returns the netlink family (FAMILY_V4 or FAMILY_V6) of the given ip.
+func GetIPFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// ZeroIPNet returns the `default` destination (0.0.0.0/0 or ::/0) of the given family,
+// which is how netlink reports default routes.
+func ZeroIPNet(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+	}
+	return &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 8*net.IPv4len)}
+}
+
+func IPNetEqual(n1 *net.IPNet, n2 *net.IPNet) bool {
+	if n1 == nil || n2 == nil {
+		return n1 == n2
+	}
+	ones1, bits1 := n1.Mask.Size()
+	ones2, bits2 := n2.Mask.Size()
+	return ones1 == ones2 && bits1 == bits2 && n1.IP.Equal(n2.IP)
+}
+
+// Returns the ip commands (separated by `; `) run in the namespace with `ip -n`, they're left as they are in the
+// namespace of the agent (empty). `ip -n` only knows the namespaces named by `ip netns`, not the ones given by a
+// path or a pid.
+func NamespaceIPCommand(namespace string, commands string) (string, error) {
+	if namespace == "" {
+		return commands, nil
+	}
+	if _, err := strconv.Atoi(namespace); err == nil || strings.Contains(namespace, "/") {
+		return "", fmt.Errorf("namespace %s has no name for ip -n", namespace)
+	}
+	parts := strings.Split(commands, "; ")
+	for i, part := range parts {
+		parts[i] = "ip -n " + namespace + strings.TrimPrefix(part, "ip")
+	}
+	return strings.Join(parts, "; "), nil
+}
+
+func ipCommand(family int, object string) string {
+	if family == netlink.FAMILY_V6 {
+		return fmt.Sprintf("ip -6 %s", object)
+	}
+	return fmt.Sprintf("ip %s", object)
+}
+
 func RuleToIPCommand(r *netlink.Rule) string {
-	return fmt.Sprintf("ip rule add from %s table %d", r.Src.IP.String(), r.Table)
+	content := ipCommand(r.Family, "rule") + " add"
+
+	if r.Invert {
+		content += " not"
+	}
+	if r.Src != nil {
+		content += fmt.Sprintf(" from %s", r.Src)
+	} else {
+		content += " from all"
+	}
+	if r.Dst != nil {
+		content += fmt.Sprintf(" to %s", r.Dst)
+	}
+	if r.Tos != 0 {
+		content += fmt.Sprintf(" tos 0x%02x", r.Tos)
+	}
+	if r.Mask != nil {
+		content += fmt.Sprintf(" fwmark 0x%x/0x%x", r.Mark, *r.Mask)
+	} else if r.Mark != 0 {
+		content += fmt.Sprintf(" fwmark 0x%x", r.Mark)
+	}
+	if r.IifName != "" {
+		content += fmt.Sprintf(" iif %s", r.IifName)
+	}
+	if r.OifName != "" {
+		content += fmt.Sprintf(" oif %s", r.OifName)
+	}
+	if r.IPProto != 0 {
+		if name, exists := reverseMap(IPProtocols)[r.IPProto]; exists {
+			content += fmt.Sprintf(" ipproto %s", name)
+		} else {
+			content += fmt.Sprintf(" ipproto %d", r.IPProto)
+		}
+	}
+	if r.Sport != nil {
+		content += fmt.Sprintf(" sport %d-%d", r.Sport.Start, r.Sport.End)
+	}
+	if r.Dport != nil {
+		content += fmt.Sprintf(" dport %d-%d", r.Dport.Start, r.Dport.End)
+	}
+	if r.UIDRange != nil {
+		content += fmt.Sprintf(" uidrange %d-%d", r.UIDRange.Start, r.UIDRange.End)
+	}
+	switch action := ruleAction(r); {
+	case IsL3mdevRule(r):
+		content += " l3mdev"
+	case action == nl.FR_ACT_TO_TBL:
+		content += fmt.Sprintf(" table %d", r.Table)
+	case action == nl.FR_ACT_GOTO:
+		content += fmt.Sprintf(" goto %d", r.Goto)
+	default:
+		content += fmt.Sprintf(" %s", reverseMap(RuleActions)[action])
+	}
+	if r.SuppressPrefixlen >= 0 {
+		content += fmt.Sprintf(" suppress_prefixlength %d", r.SuppressPrefixlen)
+	}
+	if r.SuppressIfgroup >= 0 {
+		content += fmt.Sprintf(" suppress_ifgroup %d", r.SuppressIfgroup)
+	}
+	if r.Priority >= 0 {
+		content += fmt.Sprintf(" priority %d", r.Priority)
+	}
+
+	return content
 }
 
-func RouteToIPCommand(r *netlink.Route) string {
-	content := "ip route add"
+// Returns the `ip route add` command of the route, its links are looked up through the handle of its namespace
+func RouteToIPCommand(handle NetlinkHandle, r *netlink.Route) (string, error) {
+	content := ipCommand(r.Family, "route") + " add"
+	if r.Type != unix.RTN_UNICAST {
+		content += fmt.Sprintf(" %s", reverseMap(RouteTypes)[r.Type])
+	}
 
 	scope := reverseMap(RouteScopes)[int(r.Scope)]
-	protocol := reverseMap(RouteProtocols)[r.Protocol]
+	protocol := GetRouteProtocolName(int(r.Protocol))
 	flag := reverseMap(RouteFlags)[r.Flags]
 
-	dev := ""
-	links, err := netlink.LinkList()
+	links, err := handle.LinkList()
 	if err != nil {
-		log.Fatalf("Failed to list links: %v", err)
+		return "", fmt.Errorf("failed to list links: %w", err)
 	}
+	names := make(map[int]string)
 	for _, link := range links {
-		if link.Attrs().Index == r.LinkIndex {
-			dev = link.Attrs().Name
-			break
+		names[link.Attrs().Index] = link.Attrs().Name
+	}
+	linkName := func(index int) (string, error) {
+		if name, exists := names[index]; exists {
+			return name, nil
 		}
+		return "", fmt.Errorf("link %d of route %s does not exist", index, r.Dst)
 	}
 
 	to := "default"
 	if r.Dst != nil {
-		to = r.Dst.String()
+		if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+			to = r.Dst.String()
+		}
 	}
 
 	content += fmt.Sprintf(" to %s", to)
@@ -69,32 +262,171 @@ func RouteToIPCommand(r *netlink.Route) string {
 	if r.Table != 0 {
 		content += fmt.Sprintf(" table %d", r.Table)
 	}
-	content += fmt.Sprintf(" dev %s", dev)
+	if r.Priority != 0 {
+		content += fmt.Sprintf(" metric %d", r.Priority)
+	}
+	if len(r.MultiPath) == 0 && RouteTypeHasNexthop(r.Type) {
+		name, err := linkName(r.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		content += fmt.Sprintf(" dev %s", name)
+	}
+	if r.Src != nil {
+		content += fmt.Sprintf(" src %s", r.Src)
+	}
+	if r.MTU != 0 {
+		content += fmt.Sprintf(" mtu %d", r.MTU)
+	}
+	if r.AdvMSS != 0 {
+		content += fmt.Sprintf(" advmss %d", r.AdvMSS)
+	}
+	if r.Hoplimit != 0 {
+		content += fmt.Sprintf(" hoplimit %d", r.Hoplimit)
+	}
+	if r.InitCwnd != 0 {
+		content += fmt.Sprintf(" initcwnd %d", r.InitCwnd)
+	}
+	if r.InitRwnd != 0 {
+		content += fmt.Sprintf(" initrwnd %d", r.InitRwnd)
+	}
+	if r.Realm != 0 {
+		content += fmt.Sprintf(" realm %d", r.Realm)
+	}
 	content += fmt.Sprintf(" proto %s", protocol)
 	content += fmt.Sprintf(" scope %s", scope)
 	if flag != "" {
 		content += fmt.Sprintf(" %s", flag)
 	}
+	for _, nexthop := range r.MultiPath {
+		content += " nexthop"
+		if nexthop.Gw != nil {
+			content += fmt.Sprintf(" via %s", nexthop.Gw)
+		}
+		name, err := linkName(nexthop.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		content += fmt.Sprintf(" dev %s weight %d", name, nexthop.Hops+1)
+		if nexthopFlag := reverseMap(RouteFlags)[nexthop.Flags]; nexthopFlag != "" {
+			content += fmt.Sprintf(" %s", nexthopFlag)
+		}
+	}
 
-	return content
+	return content, nil
 }
 
-func VlanToIPCommand(v *netlink.Vlan) string {
+// Returns the `ip link add` command of the vlan, its parent is looked up through the handle of its namespace
+func VlanToIPCommand(handle NetlinkHandle, v *netlink.Vlan) (string, error) {
 	// Example: ip link add link eth2 name eth2.104 type vlan id 104; ip link set eth2.104 up;
 	content := "ip link add"
 
-	parentLink, _ := netlink.LinkByIndex(v.ParentIndex)
+	parentLink, err := handle.LinkByIndex(v.ParentIndex)
+	if err != nil {
+		return "", fmt.Errorf("parent link %d of vlan %s: %w", v.ParentIndex, v.Name, err)
+	}
 	content += fmt.Sprintf(" link %s", parentLink.Attrs().Name)
 
 	content += fmt.Sprintf(" name %s", v.Name)
 
-	content += "type vlan"
+	if v.MTU > 0 {
+		content += fmt.Sprintf(" mtu %d", v.MTU)
+	}
+	if v.HardwareAddr != nil {
+		content += fmt.Sprintf(" address %s", v.HardwareAddr)
+	}
+	if v.TxQLen >= 0 {
+		content += fmt.Sprintf(" txqueuelen %d", v.TxQLen)
+	}
+
+	content += " type vlan"
 
 	content += fmt.Sprintf(" id %d", v.VlanId)
 
-	content += fmt.Sprintf("; ip link set %s up", v.Name)
+	if v.VlanProtocol != netlink.VLAN_PROTOCOL_UNKNOWN && v.VlanProtocol != netlink.VLAN_PROTOCOL_8021Q {
+		content += fmt.Sprintf(" protocol %s", v.VlanProtocol)
+	}
+	for _, flag := range vlanFlags(v) {
+		content += fmt.Sprintf(" %s on", strings.ReplaceAll(flag, "-", "_"))
+	}
+	if len(v.IngressQosMap) != 0 {
+		content += " ingress-qos-map " + qosMapToString(v.IngressQosMap)
+	}
+	if len(v.EgressQosMap) != 0 {
+		content += " egress-qos-map " + qosMapToString(v.EgressQosMap)
+	}
 
-	return content
+	if v.Flags&net.FlagUp != 0 {
+		content += fmt.Sprintf("; ip link set %s up", v.Name)
+	}
+
+	return content, nil
+}
+
+// the vlan flags which are set, by their name in the config
+func vlanFlags(v *netlink.Vlan) []string {
+	flags := []string{}
+	for _, flag := range []struct {
+		name  string
+		value *bool
+	}{{"gvrp", v.Gvrp}, {"mvrp", v.Mvrp}, {"loose-binding", v.LooseBinding}} {
+		if flag.value != nil && *flag.value {
+			flags = append(flags, flag.name)
+		}
+	}
+	return flags
+}
+
+// the mappings sorted by the priority they map from, like `ip link` (e.g. 0:1 3:5)
+func qosMapToString(qosMap map[uint32]uint32) string {
+	froms := []uint32{}
+	for from := range qosMap {
+		froms = append(froms, from)
+	}
+	sort.Slice(froms, func(i, j int) bool { return froms[i] < froms[j] })
+	mappings := []string{}
+	for _, from := range froms {
+		mappings = append(mappings, fmt.Sprintf("%d:%d", from, qosMap[from]))
+	}
+	return strings.Join(mappings, " ")
+}
+
+// Returns the `ip address add` command of the address, its link is looked up through the handle of its namespace
+func AddrToIPCommand(handle NetlinkHandle, a *netlink.Addr) (string, error) {
+	// Example: ip address add 10.0.0.5/24 dev eth2 label eth2:1 valid_lft 3600 preferred_lft 1800 noprefixroute
+	content := ipCommand(GetIPFamily(a.IP), "address") + " add"
+
+	link, err := handle.LinkByIndex(a.LinkIndex)
+	if err != nil {
+		return "", fmt.Errorf("link %d of address %s: %w", a.LinkIndex, a.IPNet, err)
+	}
+	content += fmt.Sprintf(" %s", a.IPNet)
+	if a.Peer != nil {
+		content += fmt.Sprintf(" peer %s", a.Peer)
+	}
+	content += fmt.Sprintf(" dev %s", link.Attrs().Name)
+
+	if a.Label != "" && a.Label != link.Attrs().Name {
+		content += fmt.Sprintf(" label %s", a.Label)
+	}
+	if a.Scope != 0 && GetIPFamily(a.IP) == netlink.FAMILY_V4 {
+		content += fmt.Sprintf(" scope %s", reverseMap(RouteScopes)[a.Scope])
+	}
+	if a.ValidLft != 0 || a.PreferedLft != 0 {
+		content += fmt.Sprintf(" valid_lft %s preferred_lft %s", lifetimeToString(a.ValidLft), lifetimeToString(a.PreferedLft))
+	}
+	if a.Flags&unix.IFA_F_NOPREFIXROUTE != 0 {
+		content += " noprefixroute"
+	}
+
+	return content, nil
+}
+
+func lifetimeToString(lifetime int) string {
+	if lifetime == math.MaxUint32 {
+		return "forever"
+	}
+	return fmt.Sprint(lifetime)
 }
 
 func PrintFullRoute(r *netlink.Route) string {
@@ -136,29 +468,187 @@ func PrintFullRoute(r *netlink.Route) string {
 	return fmt.Sprintf("{%s}", strings.Join(elems, " "))
 }
 
-// custom netlink.route equality check (not used)
+// custom netlink.route equality check, the nexthops of multipath routes are compared regardless of their order
+// and the metrics that netlink.Route.Equal ignores are compared as well.
 func RouteEquality(r *netlink.Route, x *netlink.Route) bool {
-	if r.Gw.Equal(x.Gw) && r.Table == x.Table {
-		if (r.Dst == nil && x.Dst == nil) ||
-			(r.Dst != nil && x.Dst != nil && r.Dst.IP.Equal(x.Dst.IP)) {
-			return true
+	rWithoutNexthops, xWithoutNexthops := *r, *x
+	rWithoutNexthops.MultiPath, xWithoutNexthops.MultiPath = nil, nil
+	// the kernel reports IPv6 routes without a device (e.g. blackhole) on the loopback device
+	if !RouteTypeHasNexthop(r.Type) {
+		rWithoutNexthops.LinkIndex, xWithoutNexthops.LinkIndex = 0, 0
+	}
+	return rWithoutNexthops.Equal(xWithoutNexthops) &&
+		NexthopsEquality(r.MultiPath, x.MultiPath) &&
+		r.MTU == x.MTU &&
+		r.AdvMSS == x.AdvMSS &&
+		r.InitCwnd == x.InitCwnd &&
+		r.InitRwnd == x.InitRwnd
+}
+
+// The kernel sets these flags on nexthops of links that are down, they are not part of the configuration
+const nexthopStateFlags = unix.RTNH_F_DEAD | unix.RTNH_F_LINKDOWN
+
+func NexthopEquality(n *netlink.NexthopInfo, x *netlink.NexthopInfo) bool {
+	return n.LinkIndex == x.LinkIndex &&
+		n.Hops == x.Hops &&
+		n.Gw.Equal(x.Gw) &&
+		n.Flags&^nexthopStateFlags == x.Flags&^nexthopStateFlags
+}
+
+func NexthopsEquality(n []*netlink.NexthopInfo, x []*netlink.NexthopInfo) bool {
+	if len(n) != len(x) {
+		return false
+	}
+	matched := make([]bool, len(x))
+	for _, nexthop := range n {
+		found := false
+		for i := range x {
+			if !matched[i] && NexthopEquality(nexthop, x[i]) {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
+func uint32PtrEqual(a *uint32, b *uint32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func portRangeEqual(a *netlink.RulePortRange, b *netlink.RulePortRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func uidRangeEqual(a *netlink.RuleUIDRange, b *netlink.RuleUIDRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// The action of the rule, netlink sets `to table` on rules added without one
+func ruleAction(r *netlink.Rule) int {
+	if r.Type == unix.RTN_UNSPEC {
+		return nl.FR_ACT_TO_TBL
+	}
+	return int(r.Type)
+}
+
+// Note: Priority is only compared when both rules define one, since rules without priority get one from the kernel
+func RuleEquality(r1 *netlink.Rule, r2 *netlink.Rule) bool {
+	return (r1.Priority < 0 || r2.Priority < 0 || r1.Priority == r2.Priority) &&
+		r1.Family == r2.Family &&
+		ruleAction(r1) == ruleAction(r2) &&
+		r1.Table == r2.Table &&
+		r1.Goto == r2.Goto &&
+		r1.SuppressPrefixlen == r2.SuppressPrefixlen &&
+		r1.SuppressIfgroup == r2.SuppressIfgroup &&
+		IPNetEqual(r1.Src, r2.Src) &&
+		IPNetEqual(r1.Dst, r2.Dst) &&
+		r1.Mark == r2.Mark &&
+		uint32PtrEqual(r1.Mask, r2.Mask) &&
+		r1.IifName == r2.IifName &&
+		r1.OifName == r2.OifName &&
+		r1.Tos == r2.Tos &&
+		r1.IPProto == r2.IPProto &&
+		portRangeEqual(r1.Sport, r2.Sport) &&
+		portRangeEqual(r1.Dport, r2.Dport) &&
+		uidRangeEqual(r1.UIDRange, r2.UIDRange) &&
+		r1.Invert == r2.Invert
+}
+
+// whether the vlans are the same link, the attributes the kernel can't change without creating the vlan again
 func VlanEquality(v1 *netlink.Vlan, v2 *netlink.Vlan) bool {
 	// Note: Equality on LinkAttrs.Index makes logical fault due to increamental behavior of this param
 	return v1.VlanId == v2.VlanId &&
 		v1.VlanProtocol == v2.VlanProtocol &&
 		v1.LinkAttrs.ParentIndex == v2.LinkAttrs.ParentIndex &&
-		v1.LinkAttrs.Name == v2.LinkAttrs.Name &&
-		v1.LinkAttrs.MTU == v2.LinkAttrs.MTU &&
-		v1.LinkAttrs.TxQLen == v2.LinkAttrs.TxQLen
+		v1.LinkAttrs.Name == v2.LinkAttrs.Name
+}
+
+// whether the vlan has the attributes of the desired one that can be changed in place (MTU, MAC, txqlen, flags
+// and QoS maps). The ones the desired vlan doesn't set (0 MTU, negative txqlen, nil MAC, flags or maps) are not
+// compared. The admin state and the alias are compared on their own.
+func VlanAttributesEqual(desired *netlink.Vlan, vlan *netlink.Vlan) bool {
+	return (desired.MTU == 0 || desired.MTU == vlan.MTU) &&
+		(desired.TxQLen < 0 || desired.TxQLen == vlan.TxQLen) &&
+		(desired.HardwareAddr == nil || bytes.Equal(desired.HardwareAddr, vlan.HardwareAddr)) &&
+		vlanFlagEqual(desired.Gvrp, vlan.Gvrp) &&
+		vlanFlagEqual(desired.Mvrp, vlan.Mvrp) &&
+		vlanFlagEqual(desired.LooseBinding, vlan.LooseBinding) &&
+		qosMapEqual(desired.IngressQosMap, vlan.IngressQosMap) &&
+		qosMapEqual(desired.EgressQosMap, vlan.EgressQosMap)
+}
+
+func vlanFlagEqual(desired *bool, flag *bool) bool {
+	return desired == nil || *desired == (flag != nil && *flag)
+}
+
+// the kernel doesn't keep the mappings to 0, which is the default
+func qosMapEqual(desired map[uint32]uint32, qosMap map[uint32]uint32) bool {
+	if desired == nil {
+		return true
+	}
+	for from, to := range desired {
+		if qosMap[from] != to {
+			return false
+		}
+	}
+	for from, to := range qosMap {
+		if desired[from] != to {
+			return false
+		}
+	}
+	return true
+}
+
+// custom netlink.Addr equality check, which compares the attributes the kernel keeps for an address on its link
+// except the lifetimes, as they count down. The kernel derives the scope of an IPv6 address from its type.
+func AddrEquality(a1 *netlink.Addr, a2 *netlink.Addr) bool {
+	scopeEqual := a1.Scope == a2.Scope || GetIPFamily(a1.IP) == netlink.FAMILY_V6
+	return a1.LinkIndex == a2.LinkIndex &&
+		IPNetEqual(a1.IPNet, a2.IPNet) &&
+		IPNetEqual(a1.Peer, a2.Peer) &&
+		a1.Label == a2.Label &&
+		scopeEqual &&
+		(a1.Flags^a2.Flags)&unix.IFA_F_NOPREFIXROUTE == 0
+}
+
+func AddrToString(a *netlink.Addr) string {
+	content := fmt.Sprintf("Ifindex: %d, address: %s, peer: %s, label: %s, scope: %d, noprefixroute: %t",
+		a.LinkIndex, a.IPNet, a.Peer, a.Label, a.Scope, a.Flags&unix.IFA_F_NOPREFIXROUTE != 0)
+	if a.ValidLft != 0 || a.PreferedLft != 0 {
+		content += fmt.Sprintf(", valid_lft: %s, preferred_lft: %s", lifetimeToString(a.ValidLft), lifetimeToString(a.PreferedLft))
+	}
+	return content
 }
 
 func VlanToString(v *netlink.Vlan) string {
-	return fmt.Sprintf("link: (%s), id: %d, proto: %s", LinkAttrsToString(&v.LinkAttrs), v.VlanId, v.VlanProtocol)
+	content := fmt.Sprintf("link: (%s), id: %d, proto: %s", LinkAttrsToString(&v.LinkAttrs), v.VlanId, v.VlanProtocol)
+	if v.HardwareAddr != nil {
+		content += fmt.Sprintf(", mac: %s", v.HardwareAddr)
+	}
+	if flags := vlanFlags(v); len(flags) != 0 {
+		content += fmt.Sprintf(", flags: %s", strings.Join(flags, " "))
+	}
+	if len(v.IngressQosMap) != 0 {
+		content += fmt.Sprintf(", ingress-qos-map: %s", qosMapToString(v.IngressQosMap))
+	}
+	if len(v.EgressQosMap) != 0 {
+		content += fmt.Sprintf(", egress-qos-map: %s", qosMapToString(v.EgressQosMap))
+	}
+	return content
 }
 
 func LinkAttrsToString(l *netlink.LinkAttrs) string {
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestRuleToIPCommand(t *testing.T) {
+	_, src, _ := net.ParseCIDR("2001:db8::/64")
+	mask := uint32(0xff)
+
+	table := netlink.NewRule()
+	table.Family = netlink.FAMILY_V6
+	table.Src = src
+	table.Table = 254
+	table.Priority = 1000
+	table.SuppressPrefixlen = 0
+	table.Type = nl.FR_ACT_TO_TBL
+
+	blackhole := netlink.NewRule()
+	blackhole.Family = netlink.FAMILY_V4
+	blackhole.Mark = 0x10
+	blackhole.Mask = &mask
+	blackhole.Invert = true
+	blackhole.Type = nl.FR_ACT_BLACKHOLE
+
+	jump := netlink.NewRule()
+	jump.Family = netlink.FAMILY_V4
+	jump.IifName = "eth0"
+	jump.Dport = netlink.NewRulePortRange(80, 80)
+	jump.IPProto = 6
+	jump.Goto = 1500
+	jump.Type = nl.FR_ACT_GOTO
+
+	l3mdev := netlink.NewRule()
+	l3mdev.Family = netlink.FAMILY_V4
+	l3mdev.OifName = "vrf-blue"
+	l3mdev.Type = nl.FR_ACT_TO_TBL
+
+	cases := map[*netlink.Rule]string{
+		table:     "ip -6 rule add from 2001:db8::/64 table 254 suppress_prefixlength 0 priority 1000",
+		blackhole: "ip rule add not from all fwmark 0x10/0xff blackhole",
+		jump:      "ip rule add from all iif eth0 ipproto tcp dport 80-80 goto 1500",
+		l3mdev:    "ip rule add from all oif vrf-blue l3mdev",
+	}
+	for rule, expected := range cases {
+		if command := RuleToIPCommand(rule); command != expected {
+			t.Errorf("expected (%s), got (%s)", expected, command)
+		}
+	}
+}
+
+// the links of the commands are looked up through the given handle, a link which doesn't exist is an error
+func TestIPCommandsLinks(t *testing.T) {
+	fake := NewFakeNetlink()
+	d0 := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "d0"}}
+	if err := fake.LinkAdd(d0); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("10.0.0.5/24")
+	addr.LinkIndex = d0.Index
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	route := &netlink.Route{LinkIndex: d0.Index, Dst: dst, Table: 100, Type: unix.RTN_UNICAST, Protocol: unix.RTPROT_STATIC}
+	vlan := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "d0.10", ParentIndex: d0.Index, TxQLen: -1}, VlanId: 10}
+
+	if command, err := VlanToIPCommand(fake, vlan); err != nil || command != "ip link add link d0 name d0.10 type vlan id 10" {
+		t.Errorf("VlanToIPCommand: %q, %v", command, err)
+	}
+	if command, err := AddrToIPCommand(fake, addr); err != nil || command != "ip address add 10.0.0.5/24 dev d0" {
+		t.Errorf("AddrToIPCommand: %q, %v", command, err)
+	}
+	if command, err := RouteToIPCommand(fake, route); err != nil || command != "ip route add to 10.1.0.0/16 table 100 dev d0 proto static scope global" {
+		t.Errorf("RouteToIPCommand: %q, %v", command, err)
+	}
+
+	// e.g. the links of another namespace
+	other := NewFakeNetlink()
+	if _, err := VlanToIPCommand(other, vlan); err == nil {
+		t.Errorf("VlanToIPCommand of a vlan whose parent doesn't exist: got no error")
+	}
+	if _, err := AddrToIPCommand(other, addr); err == nil {
+		t.Errorf("AddrToIPCommand of an address whose link doesn't exist: got no error")
+	}
+	if _, err := RouteToIPCommand(other, route); err == nil {
+		t.Errorf("RouteToIPCommand of a route whose link doesn't exist: got no error")
+	}
+}
+
+func TestNamespaceIPCommand(t *testing.T) {
+	cases := map[string]string{
+		"":     "ip -6 route add to 2001:db8::/64 dev d0; ip link set d0 up",
+		"blue": "ip -n blue -6 route add to 2001:db8::/64 dev d0; ip -n blue link set d0 up",
+	}
+	for namespace, expected := range cases {
+		if command, err := NamespaceIPCommand(namespace, "ip -6 route add to 2001:db8::/64 dev d0; ip link set d0 up"); err != nil || command != expected {
+			t.Errorf("namespace %q: expected (%s), got (%s) %v", namespace, expected, command, err)
+		}
+	}
+	for _, namespace := range []string{"1234", "/run/netns/red"} {
+		if command, err := NamespaceIPCommand(namespace, "ip link set d0 up"); err == nil {
+			t.Errorf("namespace %s: got (%s), want an error", namespace, command)
+		}
+	}
+}
+
+func TestNexthopsEquality(t *testing.T) {
+	hop1 := &netlink.NexthopInfo{LinkIndex: 2, Gw: net.ParseIP("10.0.0.1"), Hops: 1}
+	hop2 := &netlink.NexthopInfo{LinkIndex: 3, Gw: net.ParseIP("10.0.1.1")}
+	downHop2 := &netlink.NexthopInfo{LinkIndex: 3, Gw: net.ParseIP("10.0.1.1"), Flags: unix.RTNH_F_LINKDOWN}
+	otherWeightHop2 := &netlink.NexthopInfo{LinkIndex: 3, Gw: net.ParseIP("10.0.1.1"), Hops: 2}
+
+	if !NexthopsEquality([]*netlink.NexthopInfo{hop1, hop2}, []*netlink.NexthopInfo{hop2, hop1}) {
+		t.Error("expected nexthops to be equal regardless of their order")
+	}
+	if !NexthopsEquality([]*netlink.NexthopInfo{hop1, hop2}, []*netlink.NexthopInfo{hop1, downHop2}) {
+		t.Error("expected nexthops to be equal regardless of their link state")
+	}
+	if NexthopsEquality([]*netlink.NexthopInfo{hop1, hop2}, []*netlink.NexthopInfo{hop1, otherWeightHop2}) {
+		t.Error("expected nexthops with different weights to differ")
+	}
+	if NexthopsEquality([]*netlink.NexthopInfo{hop1, hop1}, []*netlink.NexthopInfo{hop1, hop2}) {
+		t.Error("expected nexthops with different members to differ")
+	}
+}
+
+func TestGetTableID(t *testing.T) {
+	cases := map[string]int{"102": 102, "main": unix.RT_TABLE_MAIN, "local": unix.RT_TABLE_LOCAL}
+	for table, expected := range cases {
+		if id, exists := GetTableID(table); !exists || id != expected {
+			t.Errorf("table %s: expected %d, got %d (%t)", table, expected, id, exists)
+		}
+	}
+	if _, exists := GetTableID("surely-not-a-table"); exists {
+		t.Error("expected an unknown table name not to be resolved")
+	}
+}
+
+func TestGetRouteProtocol(t *testing.T) {
+	cases := map[string]int{"static": unix.RTPROT_STATIC, "bird": unix.RTPROT_BIRD, "201": 201, "0x10": 16}
+	for protocol, expected := range cases {
+		if id, exists := GetRouteProtocol(protocol); !exists || id != expected {
+			t.Errorf("protocol %s: expected %d, got %d (%t)", protocol, expected, id, exists)
+		}
+	}
+	if _, exists := GetRouteProtocol("256"); exists {
+		t.Error("expected protocol ids above 255 not to be resolved")
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var native = nl.NativeEndian()
+
+// An l3mdev rule is a `to table` rule without a table, the table is taken from the l3mdev (VRF)
+// device of iif/oif. The kernel rejects a table-less `to table` rule unless it's an l3mdev rule.
+func IsL3mdevRule(r *netlink.Rule) bool {
+	return r.Table == unix.RT_TABLE_UNSPEC && (r.Type == unix.RTN_UNSPEC || r.Type == nl.FR_ACT_TO_TBL)
+}
+
+// The rules the kernel creates for every family (`ip rule` of a fresh network namespace)
+var defaultRules map[int]int = map[int]int{
+	0:     unix.RT_TABLE_LOCAL,
+	32766: unix.RT_TABLE_MAIN,
+	32767: unix.RT_TABLE_DEFAULT,
+}
+
+// IsDefaultRule reports whether the rule is one of the selector-less rules that the kernel creates.
+func IsDefaultRule(r *netlink.Rule) bool {
+	table, exists := defaultRules[r.Priority]
+	return exists && r.Table == table && r.Src == nil && r.Dst == nil && r.Mark == 0 && r.Mask == nil &&
+		r.IifName == "" && r.OifName == "" && r.Tos == 0 && r.IPProto == 0 && r.Sport == nil && r.Dport == nil &&
+		r.UIDRange == nil && !r.Invert
+}
+
+// lists the rules of the family like netlink.RuleList, but it also keeps the action of the rules
+// (netlink.Rule.Type) which netlink.RuleList drops. The request goes through the sockets, or a socket of the
+// current thread when they are nil.
+func ruleList(sockets map[int]*nl.SocketHandle, family int) ([]netlink.Rule, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETRULE, unix.NLM_F_DUMP|unix.NLM_F_REQUEST)
+	req.Sockets = sockets
+	req.AddData(nl.NewIfInfomsg(family))
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWRULE)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]netlink.Rule, 0, len(msgs))
+	for _, m := range msgs {
+		rule, err := deserializeRule(m)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+	return rules, nil
+}
+
+func deserializeRule(m []byte) (*netlink.Rule, error) {
+	msg := nl.DeserializeRtMsg(m)
+	attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+	if err != nil {
+		return nil, err
+	}
+
+	rule := netlink.NewRule()
+	rule.Priority = 0 // The default priority from kernel
+	rule.Family = int(msg.Family)
+	rule.Type = msg.Type
+	rule.Tos = uint(msg.Tos)
+	rule.Invert = msg.Flags&netlink.FibRuleInvert > 0
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.FRA_TABLE:
+			rule.Table = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_SRC:
+			rule.Src = &net.IPNet{IP: attr.Value, Mask: net.CIDRMask(int(msg.Src_len), 8*len(attr.Value))}
+		case nl.FRA_DST:
+			rule.Dst = &net.IPNet{IP: attr.Value, Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value))}
+		case nl.FRA_FWMARK:
+			rule.Mark = native.Uint32(attr.Value[0:4])
+		case nl.FRA_FWMASK:
+			mask := native.Uint32(attr.Value[0:4])
+			rule.Mask = &mask
+		case nl.FRA_TUN_ID:
+			rule.TunID = uint(native.Uint64(attr.Value[0:8]))
+		case nl.FRA_IIFNAME:
+			rule.IifName = string(attr.Value[:len(attr.Value)-1])
+		case nl.FRA_OIFNAME:
+			rule.OifName = string(attr.Value[:len(attr.Value)-1])
+		case nl.FRA_SUPPRESS_PREFIXLEN:
+			if value := native.Uint32(attr.Value[0:4]); value != 0xffffffff {
+				rule.SuppressPrefixlen = int(value)
+			}
+		case nl.FRA_SUPPRESS_IFGROUP:
+			if value := native.Uint32(attr.Value[0:4]); value != 0xffffffff {
+				rule.SuppressIfgroup = int(value)
+			}
+		case nl.FRA_FLOW:
+			rule.Flow = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_GOTO:
+			rule.Goto = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_PRIORITY:
+			rule.Priority = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_IP_PROTO:
+			rule.IPProto = int(attr.Value[0])
+		case nl.FRA_DPORT_RANGE:
+			rule.Dport = netlink.NewRulePortRange(native.Uint16(attr.Value[0:2]), native.Uint16(attr.Value[2:4]))
+		case nl.FRA_SPORT_RANGE:
+			rule.Sport = netlink.NewRulePortRange(native.Uint16(attr.Value[0:2]), native.Uint16(attr.Value[2:4]))
+		case nl.FRA_UID_RANGE:
+			rule.UIDRange = netlink.NewRuleUIDRange(native.Uint32(attr.Value[0:4]), native.Uint32(attr.Value[4:8]))
+		case nl.FRA_PROTOCOL:
+			rule.Protocol = attr.Value[0]
+		}
+	}
+	return rule, nil
+}
+
+// A rule added or deleted, netlink has no RuleSubscribe
+type RuleUpdate struct {
+	// unix.RTM_NEWRULE or unix.RTM_DELRULE
+	Type uint16
+	netlink.Rule
+}
+
+// sends the rules of the namespace which are added or deleted to ch, until done is closed. ch is closed when the
+// subscription fails, e.g. when the kernel drops notifications (ENOBUFS).
+func ruleSubscribe(ns netns.NsHandle, ch chan<- RuleUpdate, done <-chan struct{}) error {
+	s, err := nl.SubscribeAt(ns, netns.None(), unix.NETLINK_ROUTE, unix.RTNLGRP_IPV4_RULE, unix.RTNLGRP_IPV6_RULE)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, from, err := s.Receive()
+			if err != nil {
+				return
+			}
+			if from.Pid != nl.PidKernel {
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != unix.RTM_NEWRULE && m.Header.Type != unix.RTM_DELRULE {
+					continue
+				}
+				rule, err := deserializeRule(m.Data)
+				if err != nil {
+					continue
+				}
+				select {
+				case ch <- RuleUpdate{Type: m.Header.Type, Rule: *rule}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func ipAttrData(ip net.IP) []byte {
+	if GetIPFamily(ip) == netlink.FAMILY_V4 {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// adds an l3mdev rule by hand, as netlink.RuleAdd does not support FRA_L3MDEV
+func l3mdevRuleAdd(sockets map[int]*nl.SocketHandle, r *netlink.Rule) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.Sockets = sockets
+
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(r.Family)
+	msg.Protocol = unix.RTPROT_BOOT
+	msg.Scope = unix.RT_SCOPE_UNIVERSE
+	msg.Table = unix.RT_TABLE_UNSPEC
+	msg.Type = nl.FR_ACT_TO_TBL
+	msg.Tos = uint8(r.Tos)
+	if r.Invert {
+		msg.Flags |= netlink.FibRuleInvert
+	}
+
+	attrs := []*nl.RtAttr{nl.NewRtAttr(nl.FRA_L3MDEV, []byte{1})}
+	if r.Src != nil {
+		srcLen, _ := r.Src.Mask.Size()
+		msg.Src_len = uint8(srcLen)
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_SRC, ipAttrData(r.Src.IP)))
+	}
+	if r.Dst != nil {
+		dstLen, _ := r.Dst.Mask.Size()
+		msg.Dst_len = uint8(dstLen)
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_DST, ipAttrData(r.Dst.IP)))
+	}
+	if r.Priority >= 0 {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_PRIORITY, nl.Uint32Attr(uint32(r.Priority))))
+	}
+	if r.Mark != 0 || r.Mask != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_FWMARK, nl.Uint32Attr(r.Mark)))
+	}
+	if r.Mask != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_FWMASK, nl.Uint32Attr(*r.Mask)))
+	}
+	if r.IifName != "" {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_IIFNAME, nl.ZeroTerminated(r.IifName)))
+	}
+	if r.OifName != "" {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_OIFNAME, nl.ZeroTerminated(r.OifName)))
+	}
+	if r.IPProto > 0 {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_IP_PROTO, nl.Uint8Attr(uint8(r.IPProto))))
+	}
+	if r.Sport != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_SPORT_RANGE, append(nl.Uint16Attr(r.Sport.Start), nl.Uint16Attr(r.Sport.End)...)))
+	}
+	if r.Dport != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_DPORT_RANGE, append(nl.Uint16Attr(r.Dport.Start), nl.Uint16Attr(r.Dport.End)...)))
+	}
+	if r.UIDRange != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.FRA_UID_RANGE, append(nl.Uint32Attr(r.UIDRange.Start), nl.Uint32Attr(r.UIDRange.End)...)))
+	}
+
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}